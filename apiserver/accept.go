@@ -0,0 +1,126 @@
+package apiserver
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// acceptRange is a media range of an Accept header.
+type acceptRange struct {
+	Type    string // e.g. "image"
+	Subtype string // e.g. "png"
+	Q       float64
+}
+
+// parseAccept parses the media ranges of an Accept header. Invalid
+// ranges are skipped.
+func parseAccept(header string) []acceptRange {
+	var ranges []acceptRange
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		mt := strings.ToLower(strings.TrimSpace(params[0]))
+		slash := strings.Index(mt, "/")
+		if slash <= 0 || slash == len(mt)-1 {
+			continue
+		}
+		ar := acceptRange{Type: mt[:slash], Subtype: mt[slash+1:], Q: 1}
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) != 2 || strings.ToLower(kv[0]) != "q" {
+				continue
+			}
+			if q, err := strconv.ParseFloat(kv[1], 64); err == nil {
+				ar.Q = q
+			}
+		}
+		ranges = append(ranges, ar)
+	}
+	return ranges
+}
+
+// acceptQuality returns the quality of the given content type in the
+// media ranges, as set by the most specific range that matches it.
+func acceptQuality(ranges []acceptRange, contentType string) float64 {
+	q, _ := acceptMatch(ranges, contentType)
+	return q
+}
+
+// acceptMatch returns the quality of the given content type in the
+// media ranges, and whether any range matches it.
+func acceptMatch(ranges []acceptRange, contentType string) (float64, bool) {
+	q, specificity := 0.0, -1
+	parts := strings.SplitN(contentType, "/", 2)
+	for _, ar := range ranges {
+		var s int
+		switch {
+		case ar.Type == parts[0] && ar.Subtype == parts[1]:
+			s = 2
+		case ar.Type == parts[0] && ar.Subtype == "*":
+			s = 1
+		case ar.Type == "*" && ar.Subtype == "*":
+			s = 0
+		default:
+			continue
+		}
+		if s > specificity {
+			q, specificity = ar.Q, s
+		}
+	}
+	return q, specificity >= 0
+}
+
+// negotiatedFormats are the output formats considered by
+// negotiateFormat, from most to least preferred on ties. Wildcards
+// alone never select BMP or TIFF over the compressed formats.
+var negotiatedFormats = []string{"png", "jpeg", "gif", "tiff", "bmp"}
+
+// negotiateFormat returns the output format preferred by the given
+// Accept header, among the supported formats. The source format wins
+// ties, and is returned when the header is empty or doesn't name any
+// of the formats. Decode-only sources are replaced by
+// defaultOutputFormat. It returns nil if the header refuses the source
+// with q=0 and accepts none of the formats.
+func negotiateFormat(accept string, src *imageFormat) *imageFormat {
+	if src.Encode == nil {
+		src = defaultOutputFormat
+	}
+	ranges := parseAccept(accept)
+	if len(ranges) == 0 {
+		return src
+	}
+	best, bestQ := src, acceptQuality(ranges, src.ContentType)
+	for _, name := range negotiatedFormats {
+		f := imageFormats[name]
+		if q := acceptQuality(ranges, f.ContentType); q > bestQ {
+			best, bestQ = f, q
+		}
+	}
+	if bestQ <= 0 {
+		if _, refused := acceptMatch(ranges, src.ContentType); refused {
+			return nil
+		}
+		return src
+	}
+	return best
+}
+
+// negotiationKey returns the output formats negotiated by the given
+// Accept header for every source format, so that equivalent headers,
+// such as the ones of different browsers, have the same key.
+func negotiationKey(accept string) string {
+	names := make([]string, 0, len(imageFormats))
+	for name := range imageFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	key := make([]string, len(names))
+	for i, name := range names {
+		out := "none"
+		if f := negotiateFormat(accept, imageFormats[name]); f != nil {
+			out = f.Name
+		}
+		key[i] = name + "=" + out
+	}
+	return strings.Join(key, ",")
+}
@@ -0,0 +1,51 @@
+package apiserver
+
+import "testing"
+
+func TestNegotiateFormat(t *testing.T) {
+	png, jpeg, gif := imageFormats["png"], imageFormats["jpeg"], imageFormats["gif"]
+	tiff, webp := imageFormats["tiff"], imageFormats["webp"]
+	tests := []struct {
+		Accept string
+		Source *imageFormat
+		Want   *imageFormat
+	}{
+		{"", png, png},
+		{"*/*", png, png},
+		{"image/*", gif, gif},
+		{"image/jpeg", png, jpeg},
+		{"image/webp,image/apng,image/*,*/*;q=0.8", jpeg, jpeg},
+		{"image/png;q=0.5, image/gif", png, gif},
+		{"image/*;q=0.5, image/gif;q=0.4, image/jpeg;q=0.3", gif, png},
+		{"image/png;q=0", png, nil},
+		{"image/png;q=0, image/jpeg;q=0", png, nil},
+		{"image/*;q=0", gif, nil},
+		{"*/*;q=0", jpeg, nil},
+		{"image/png;q=0, */*;q=0.1", png, jpeg},
+		{"text/html, image/png;q=0", jpeg, jpeg},
+		{"text/html", jpeg, jpeg},
+		{"image/gif, image/jpeg;q=0.9, */*;q=0.1", png, gif},
+		{"image/*", tiff, tiff},
+		{"image/*", jpeg, jpeg},
+		{"image/tiff, image/*;q=0.5", png, tiff},
+		{"", webp, png},
+		{"image/webp", webp, png},
+		{"image/webp, image/jpeg;q=0.5", webp, jpeg},
+	}
+	for _, tc := range tests {
+		if f := negotiateFormat(tc.Accept, tc.Source); f != tc.Want {
+			t.Errorf("%q from %s: want %v, have %v", tc.Accept, tc.Source.Name, tc.Want, f)
+		}
+	}
+}
+
+func TestNegotiationKey(t *testing.T) {
+	chrome := "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8"
+	firefox := "image/avif,image/webp,*/*"
+	if negotiationKey(chrome) != negotiationKey(firefox) || negotiationKey(firefox) != negotiationKey("") {
+		t.Fatal("equivalent headers have different keys")
+	}
+	if negotiationKey("image/jpeg") == negotiationKey("") {
+		t.Fatal("different headers have the same key")
+	}
+}
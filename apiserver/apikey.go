@@ -0,0 +1,380 @@
+package apiserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// keyReloadInterval is how often the key file is checked for changes.
+var keyReloadInterval = 5 * time.Second
+
+// maxKeyLabels is the max number of key names used as metric labels.
+// Requests of other keys are counted as "other".
+const maxKeyLabels = 100
+
+// apiKey is an API key and its settings, as loaded from the key file.
+type apiKey struct {
+	Name       string  `json:"name"` // metric label, must be unique
+	Key        string  `json:"key"`
+	Rate       float64 `json:"rate"`        // requests per second, 0 for no limit
+	Burst      int     `json:"burst"`       // default: rate rounded up
+	DailyQuota int64   `json:"daily_quota"` // requests per UTC day, 0 for no limit
+	Overlay    string  `json:"overlay"`     // default overlay
+
+	// Allow restricts the values of the named params. Params with
+	// an empty list can't be used at all.
+	Allow map[string][]string `json:"allow"`
+
+	limit *tokenBucket
+	quota *dailyQuota
+	label string // metric label
+}
+
+// Errors of rejected API keys.
+var (
+	errMissingKey    = errors.New("Missing API key")
+	errInvalidKey    = errors.New("Invalid API key")
+	errRateLimited   = errors.New("Rate limit exceeded")
+	errQuotaExceeded = errors.New("Daily quota exceeded")
+)
+
+// takeRate takes a token of the rate limit of the key at now. If there
+// is none, it returns how long until there is.
+func (k *apiKey) takeRate(now time.Time) (time.Duration, error) {
+	if k.limit != nil {
+		if ok, wait := k.limit.Take(now); !ok {
+			defacerAPIKeyRequestsSum.WithLabelValues(k.label, "rate_limited").Inc()
+			return wait, errRateLimited
+		}
+	}
+	return 0, nil
+}
+
+// takeQuota counts n requests at now for the quota of the key. If they
+// exceed it, it returns how long until the quota is reset.
+func (k *apiKey) takeQuota(now time.Time, n int64) (time.Duration, error) {
+	if k.quota != nil {
+		if ok, wait := k.quota.Take(now, n); !ok {
+			defacerAPIKeyRequestsSum.WithLabelValues(k.label, "quota_exceeded").Inc()
+			return wait, errQuotaExceeded
+		}
+	}
+	return 0, nil
+}
+
+// refundQuota gives back n requests counted at now for the quota of
+// the key, when they are rejected afterwards.
+func (k *apiKey) refundQuota(now time.Time, n int64) {
+	if k.quota != nil {
+		k.quota.Refund(now, n)
+	}
+}
+
+// check checks that the given params are allowed for the key.
+func (k *apiKey) check(get func(string) string) error {
+	for name, allowed := range k.Allow {
+		if v := get(name); v != "" && !hasString(allowed, v) {
+			return fmt.Errorf("`%s` %q is not allowed for this API key", name, v)
+		}
+	}
+	return nil
+}
+
+// keyContext is the context key of the API key of a request.
+type keyContext struct{}
+
+// requestKey returns the API key of r, or nil.
+func requestKey(r *http.Request) *apiKey {
+	k, _ := r.Context().Value(keyContext{}).(*apiKey)
+	return k
+}
+
+// keyParams checks the params of a batch of n URLs against the API key
+// of r, sets the default overlay of the key, and counts the URLs for
+// the quota of the key, see keyStore.WrapItems.
+func keyParams(w http.ResponseWriter, r *http.Request, params map[string]string, n int) (int, error) {
+	k := requestKey(r)
+	if k == nil {
+		return 0, nil
+	}
+	if err := k.check(mapGetter(params)); err != nil {
+		return http.StatusForbidden, err
+	}
+	if k.Overlay != "" && params["overlay"] == "" {
+		params["overlay"] = k.Overlay
+	}
+	if wait, err := k.takeQuota(time.Now(), int64(n)); err != nil {
+		w.Header().Set("Retry-After", retryAfter(wait))
+		return http.StatusTooManyRequests, err
+	}
+	return 0, nil
+}
+
+// keyStore holds the API keys of a key file, which is reloaded when
+// it changes. Rate limits and quotas are kept across reloads.
+//
+// The key file is a JSON object with the list of keys:
+//
+//	{"keys": [{"name": "app", "key": "secret", "rate": 10}]}
+type keyStore struct {
+	Path     string
+	ErrorLog *log.Logger
+
+	mu      sync.RWMutex
+	keys    map[string]*apiKey // by key
+	names   map[string]*apiKey // by name
+	modTime time.Time
+	size    int64
+	labels  map[string]bool // names used as metric labels
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// newKeyStore loads the keys of the file at path, and reloads them
+// when the file changes.
+func newKeyStore(path string, logger *log.Logger) (*keyStore, error) {
+	ks := &keyStore{
+		Path:     path,
+		ErrorLog: logger,
+		labels:   map[string]bool{},
+		stop:     make(chan struct{}),
+	}
+	if err := ks.reload(); err != nil {
+		return nil, err
+	}
+	go ks.watch()
+	return ks, nil
+}
+
+// watch reloads the key file periodically.
+func (ks *keyStore) watch() {
+	t := time.NewTicker(keyReloadInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ks.stop:
+			return
+		}
+		if err := ks.reload(); err != nil {
+			ks.logf("failed to reload API keys from %q: %v", ks.Path, err)
+		}
+	}
+}
+
+// Close stops reloading the key file.
+func (ks *keyStore) Close() error {
+	ks.once.Do(func() { close(ks.stop) })
+	return nil
+}
+
+// reload loads the key file if it changed since the last load. The
+// current keys are kept if it fails.
+func (ks *keyStore) reload() error {
+	fi, err := os.Stat(ks.Path)
+	if err != nil {
+		return err
+	}
+	ks.mu.RLock()
+	changed := ks.keys == nil || !fi.ModTime().Equal(ks.modTime) || fi.Size() != ks.size
+	ks.mu.RUnlock()
+	if !changed {
+		return nil
+	}
+	keys, err := loadKeys(ks.Path)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		k.label = ks.label(k.Name)
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	for v, k := range keys {
+		old := ks.keys[v]
+		if k.Rate > 0 {
+			if old != nil && old.limit != nil && old.Rate == k.Rate && old.Burst == k.Burst {
+				k.limit = old.limit
+			} else {
+				k.limit = newTokenBucket(k.Rate, k.Burst)
+			}
+		}
+		if k.DailyQuota > 0 {
+			if old != nil && old.quota != nil {
+				k.quota = old.quota
+				k.quota.SetLimit(k.DailyQuota)
+			} else {
+				k.quota = newDailyQuota(k.DailyQuota)
+			}
+		}
+	}
+	names := make(map[string]*apiKey, len(keys))
+	for _, k := range keys {
+		names[k.Name] = k
+	}
+	ks.keys, ks.names, ks.modTime, ks.size = keys, names, fi.ModTime(), fi.Size()
+	return nil
+}
+
+// loadKeys loads the keys of the file at path, by key.
+func loadKeys(path string) (map[string]*apiKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var file struct {
+		Keys []*apiKey `json:"keys"`
+	}
+	if err = json.NewDecoder(f).Decode(&file); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*apiKey, len(file.Keys))
+	names := make(map[string]bool, len(file.Keys))
+	for i, k := range file.Keys {
+		switch {
+		case k.Key == "":
+			return nil, fmt.Errorf("key %d: missing key", i)
+		case k.Name == "":
+			return nil, fmt.Errorf("key %d: missing name", i)
+		case keys[k.Key] != nil:
+			return nil, fmt.Errorf("key %q: duplicate key", k.Name)
+		case names[k.Name]:
+			return nil, fmt.Errorf("key %q: duplicate name", k.Name)
+		case k.Rate < 0 || k.Burst < 0 || k.DailyQuota < 0:
+			return nil, fmt.Errorf("key %q: invalid limits", k.Name)
+		}
+		if allowed, ok := k.Allow["overlay"]; ok && k.Overlay != "" && !hasString(allowed, k.Overlay) {
+			return nil, fmt.Errorf("key %q: overlay %q is not allowed", k.Name, k.Overlay)
+		}
+		keys[k.Key], names[k.Name] = k, true
+	}
+	return keys, nil
+}
+
+// Get returns the key v, or nil.
+func (ks *keyStore) Get(v string) *apiKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.keys[v]
+}
+
+// lookup returns the key v, counting missing and invalid keys.
+func (ks *keyStore) lookup(v string) (*apiKey, error) {
+	if v == "" {
+		defacerAPIKeyRequestsSum.WithLabelValues("none", "unauthorized").Inc()
+		return nil, errMissingKey
+	}
+	k := ks.Get(v)
+	if k == nil {
+		defacerAPIKeyRequestsSum.WithLabelValues("invalid", "unauthorized").Inc()
+		return nil, errInvalidKey
+	}
+	return k, nil
+}
+
+// named returns the key with the given name, or nil.
+func (ks *keyStore) named(name string) *apiKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.names[name]
+}
+
+// label returns the metric label of the named key.
+func (ks *keyStore) label(name string) string {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if !ks.labels[name] {
+		if len(ks.labels) >= maxKeyLabels {
+			return "other"
+		}
+		ks.labels[name] = true
+	}
+	return name
+}
+
+// Wrap returns a handler that requires an API key to call next. The
+// key is read from the X-Defacer-Key header, or the key query param.
+// Signed requests, such as the image URLs of pages, can name the key
+// in the key_name query param instead. Requests are checked against
+// the settings of the key, and the default overlay of the key is added
+// to them.
+func (ks *keyStore) Wrap(next http.Handler) http.Handler {
+	return ks.wrap(next, true)
+}
+
+// WrapItems is like Wrap for handlers of batches, which count their
+// URLs for the quota of the key with keyParams. Other requests, such
+// as polling jobs, don't count for the quota.
+func (ks *keyStore) WrapItems(next http.Handler) http.Handler {
+	return ks.wrap(next, false)
+}
+
+func (ks *keyStore) wrap(next http.Handler, quota bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, status, err := ks.authorize(w, r, quota)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (ks *keyStore) authorize(w http.ResponseWriter, r *http.Request, quota bool) (*http.Request, int, error) {
+	q := r.URL.Query()
+	v := r.Header.Get("X-Defacer-Key")
+	if v == "" {
+		v = q.Get("key")
+	}
+	var k *apiKey
+	var err error
+	if name := q.Get("key_name"); v == "" && name != "" && signedRequest(r) {
+		if k = ks.named(name); k == nil {
+			defacerAPIKeyRequestsSum.WithLabelValues("invalid", "unauthorized").Inc()
+			err = errInvalidKey
+		}
+	} else {
+		k, err = ks.lookup(v)
+	}
+	if err != nil {
+		return nil, http.StatusUnauthorized, err
+	}
+	if err = k.check(q.Get); err != nil {
+		defacerAPIKeyRequestsSum.WithLabelValues(k.label, "forbidden").Inc()
+		return nil, http.StatusForbidden, err
+	}
+	now := time.Now()
+	wait, err := k.takeRate(now)
+	if err == nil && quota {
+		wait, err = k.takeQuota(now, 1)
+	}
+	if err != nil {
+		w.Header().Set("Retry-After", retryAfter(wait))
+		return nil, http.StatusTooManyRequests, err
+	}
+	defacerAPIKeyRequestsSum.WithLabelValues(k.label, "ok").Inc()
+	r = r.WithContext(context.WithValue(r.Context(), keyContext{}, k))
+	if k.Overlay != "" && q.Get("overlay") == "" {
+		q.Set("overlay", k.Overlay)
+		u := *r.URL
+		u.RawQuery = q.Encode()
+		r.URL = &u
+	}
+	return r, 0, nil
+}
+
+func (ks *keyStore) logf(format string, args ...interface{}) {
+	if ks.ErrorLog != nil {
+		ks.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
@@ -0,0 +1,315 @@
+package apiserver
+
+import (
+	"encoding/json"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestKeyStore(t *testing.T, keys string) (*keyStore, string) {
+	dir, err := ioutil.TempDir("", "defacer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "keys.json")
+	if err = ioutil.WriteFile(path, []byte(keys), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ks := &keyStore{Path: path, labels: map[string]bool{}}
+	if err = ks.reload(); err != nil {
+		t.Fatal(err)
+	}
+	return ks, dir
+}
+
+func serveKey(h http.Handler, query, key string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("GET", "/v1/deface?"+query, nil)
+	if key != "" {
+		r.Header.Set("X-Defacer-Key", key)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestKeyStore(t *testing.T) {
+	ks, dir := newTestKeyStore(t, `{"keys": [
+		{"name": "a", "key": "ka", "overlay": "cat", "allow": {"overlay": ["cat", "dog"], "passthrough": []}},
+		{"name": "b", "key": "kb", "rate": 1, "daily_quota": 2}
+	]}`)
+	defer os.RemoveAll(dir)
+	var got *http.Request
+	h := ks.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { got = r }))
+	for _, tc := range []struct {
+		query, key string
+		status     int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"", "wrong", http.StatusUnauthorized},
+		{"overlay=bird", "ka", http.StatusForbidden},
+		{"passthrough=true", "ka", http.StatusForbidden},
+		{"key=ka&overlay=dog", "", http.StatusOK},
+		{"", "kb", http.StatusOK},
+		{"", "kb", http.StatusTooManyRequests},
+	} {
+		if w := serveKey(h, tc.query, tc.key); w.Code != tc.status {
+			t.Errorf("%q %q: unexpected status: %d", tc.query, tc.key, w.Code)
+		}
+	}
+	serveKey(h, "url=x", "ka")
+	if v := got.URL.Query().Get("overlay"); v != "cat" {
+		t.Fatal("default overlay not set:", v)
+	}
+	if k := requestKey(got); k == nil || k.Name != "a" {
+		t.Fatal("missing request key:", k)
+	}
+	w := serveKey(h, "", "kb")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatal("unexpected response:", w.Code, w.Header())
+	}
+	// rate limited requests don't count for the quota
+	ks.Get("kb").limit = newTokenBucket(1000, 0)
+	if w = serveKey(h, "", "kb"); w.Code != http.StatusOK {
+		t.Fatal("unexpected status:", w.Code)
+	}
+	if w = serveKey(h, "", "kb"); w.Code != http.StatusTooManyRequests || w.Body.String() != "Daily quota exceeded\n" {
+		t.Fatal("unexpected response:", w.Code, w.Body.String())
+	}
+}
+
+func TestKeyStoreReload(t *testing.T) {
+	ks, dir := newTestKeyStore(t, `{"keys": [{"name": "a", "key": "ka", "daily_quota": 1}]}`)
+	defer os.RemoveAll(dir)
+	h := ks.Wrap(http.NotFoundHandler())
+	serveKey(h, "", "ka")
+	keys := `{"keys": [{"name": "a", "key": "ka", "daily_quota": 1}, {"name": "b", "key": "kb"}]}`
+	if err := ioutil.WriteFile(ks.Path, []byte(keys), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if w := serveKey(h, "", "kb"); w.Code != http.StatusNotFound {
+		t.Fatal("new key not loaded:", w.Code)
+	}
+	if w := serveKey(h, "", "ka"); w.Code != http.StatusTooManyRequests {
+		t.Fatal("quota reset by reload:", w.Code)
+	}
+	// invalid files keep the current keys
+	if err := ioutil.WriteFile(ks.Path, []byte(`{"keys": [{"key": "kc"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.reload(); err == nil {
+		t.Fatal("invalid key file loaded")
+	}
+	if ks.Get("kb") == nil {
+		t.Fatal("keys dropped by failed reload")
+	}
+}
+
+func TestLoadKeysInvalid(t *testing.T) {
+	for _, keys := range []string{
+		`{"keys": [{"name": "a"}]}`,
+		`{"keys": [{"key": "ka"}]}`,
+		`{"keys": [{"name": "a", "key": "ka"}, {"name": "b", "key": "ka"}]}`,
+		`{"keys": [{"name": "a", "key": "ka"}, {"name": "a", "key": "kb"}]}`,
+		`{"keys": [{"name": "a", "key": "ka", "rate": -1}]}`,
+		`{"keys": [{"name": "a", "key": "ka", "overlay": "cat", "allow": {"overlay": ["dog"]}}]}`,
+		`{"keys": `,
+	} {
+		ks := &keyStore{labels: map[string]bool{}}
+		f, err := ioutil.TempFile("", "defacer")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(keys)
+		f.Close()
+		ks.Path = f.Name()
+		if err = ks.reload(); err == nil {
+			t.Errorf("%s: loaded", keys)
+		}
+		os.Remove(f.Name())
+	}
+}
+
+func TestKeyLabels(t *testing.T) {
+	ks := &keyStore{labels: map[string]bool{}}
+	for i := 0; i < maxKeyLabels; i++ {
+		ks.label(string(rune('a' + i)))
+	}
+	if v := ks.label("a"); v != "a" {
+		t.Fatal("unexpected label:", v)
+	}
+	if v := ks.label("new"); v != "other" {
+		t.Fatal("unexpected label:", v)
+	}
+}
+
+func TestBatchKeyParams(t *testing.T) {
+	b, upstream := newTestBatch(t)
+	defer upstream.Close()
+	ks, dir := newTestKeyStore(t, `{"keys": [{"name": "a", "key": "ka", "allow": {"format": ["png"]}}]}`)
+	defer os.RemoveAll(dir)
+	h := ks.Wrap(b)
+	for body, status := range map[string]int{
+		`{"urls": ["` + upstream.URL + `/image.png"], "options": {"format": "gif"}}`: http.StatusForbidden,
+		`{"urls": ["` + upstream.URL + `/image.png"], "options": {"format": "png"}}`: http.StatusOK,
+	} {
+		r, _ := http.NewRequest("POST", "/v1/batch", strings.NewReader(body))
+		r.Header.Set("X-Defacer-Key", "ka")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != status {
+			t.Errorf("%s: unexpected status: %d", body, w.Code)
+		}
+	}
+}
+
+func TestPageKey(t *testing.T) {
+	upstream := newTestUpstream("text/html", []byte(`<img src="/image.png">`))
+	defer upstream.Close()
+	ks, dir := newTestKeyStore(t, `{"keys": [{"name": "a", "key": "ka"}]}`)
+	defer os.RemoveAll(dir)
+	s := &urlSigner{Secrets: [][]byte{[]byte("secret")}}
+	p := &page{proxy: newTestProxy(t), Deface: "/v1/deface", Signer: s}
+	r, _ := http.NewRequest("GET", "/v1/page?key=ka&url="+url.QueryEscape(upstream.URL), nil)
+	w := httptest.NewRecorder()
+	s.Wrap(ks.Wrap(p)).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatal("unexpected status:", w.Code, w.Body.String())
+	}
+	m := regexp.MustCompile(`src="([^"]+)"`).FindStringSubmatch(w.Body.String())
+	if m == nil {
+		t.Fatal("missing image:", w.Body.String())
+	}
+	u, _ := url.Parse(html.UnescapeString(m[1]))
+	q := u.Query()
+	if q.Get("key") != "" || q.Get("key_name") != "a" || q.Get("sig") == "" {
+		t.Fatal("unexpected image URL:", u)
+	}
+	var got *http.Request
+	h := s.Wrap(ks.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { got = r })))
+	if w = serveKey(h, u.RawQuery, ""); w.Code != http.StatusOK {
+		t.Fatal("unexpected status:", w.Code, w.Body.String())
+	}
+	if k := requestKey(got); k == nil || k.Name != "a" {
+		t.Fatal("unexpected request key:", k)
+	}
+	// key names are only trusted in signed requests
+	q.Del("sig")
+	if w = serveKey(h, q.Encode(), ""); w.Code != http.StatusUnauthorized {
+		t.Fatal("unexpected status:", w.Code)
+	}
+}
+
+func TestBatchKeyQuota(t *testing.T) {
+	b, upstream := newTestBatch(t)
+	defer upstream.Close()
+	ks, dir := newTestKeyStore(t, `{"keys": [{"name": "a", "key": "ka", "daily_quota": 3}]}`)
+	defer os.RemoveAll(dir)
+	h := ks.WrapItems(b)
+	body := `{"urls": ["` + upstream.URL + `/image.png", "` + upstream.URL + `/image.png"]}`
+	for i, status := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		r, _ := http.NewRequest("POST", "/v1/batch", strings.NewReader(body))
+		r.Header.Set("X-Defacer-Key", "ka")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != status {
+			t.Errorf("batch %d: unexpected status: %d", i, w.Code)
+		}
+	}
+}
+
+func TestJobsKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "defacer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	js, upstream := newTestJobs(t, dir)
+	defer upstream.Close()
+	ks, kdir := newTestKeyStore(t, `{"keys": [
+		{"name": "a", "key": "ka", "daily_quota": 1},
+		{"name": "b", "key": "kb"}
+	]}`)
+	defer os.RemoveAll(kdir)
+	h := ks.WrapItems(js)
+	serve := func(method, path, body, key string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("X-Defacer-Key", key)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	w := serve("POST", "/v1/jobs", `{"urls": ["`+upstream.URL+`/image.png"]}`, "ka")
+	if w.Code != http.StatusAccepted {
+		t.Fatal("unexpected status:", w.Code, w.Body.String())
+	}
+	var j job
+	if err = json.NewDecoder(w.Body).Decode(&j); err != nil {
+		t.Fatal(err)
+	}
+	waitJob(t, js, j.ID)
+	// polling doesn't count for the quota
+	for i := 0; i < 3; i++ {
+		if w = serve("GET", "/v1/jobs/"+j.ID, "", "ka"); w.Code != http.StatusOK {
+			t.Fatal("unexpected status:", w.Code, w.Body.String())
+		}
+	}
+	if w = serve("GET", "/v1/jobs/"+j.ID, "", "kb"); w.Code != http.StatusNotFound {
+		t.Fatal("job of another key found:", w.Code)
+	}
+	if w = serve("GET", "/v1/jobs/"+j.ID+"/0.png", "", "kb"); w.Code != http.StatusNotFound {
+		t.Fatal("result of another key found:", w.Code)
+	}
+	w = serve("POST", "/v1/jobs", `{"urls": ["`+upstream.URL+`/image.png"]}`, "ka")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatal("unexpected status:", w.Code, w.Body.String())
+	}
+}
+
+func TestJobsKeyQueueFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "defacer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b, upstream := newTestBatch(t)
+	defer upstream.Close()
+	js, err := newJobs(b, "/v1/jobs", dir, nil, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer js.Close()
+	ks, kdir := newTestKeyStore(t, `{"keys": [{"name": "a", "key": "ka", "daily_quota": 1}]}`)
+	defer os.RemoveAll(kdir)
+	h := ks.WrapItems(js)
+	create := func() int {
+		r, _ := http.NewRequest("POST", "/v1/jobs", strings.NewReader(`{"urls": ["`+upstream.URL+`/image.png"]}`))
+		r.Header.Set("X-Defacer-Key", "ka")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	js.queue = make(chan string)
+	if status := create(); status != http.StatusServiceUnavailable {
+		t.Fatal("unexpected status:", status)
+	}
+	// rejected jobs don't count for the quota
+	js.queue = make(chan string, 2)
+	if status := create(); status != http.StatusAccepted {
+		t.Fatal("unexpected status:", status)
+	}
+	if status := create(); status != http.StatusTooManyRequests {
+		t.Fatal("unexpected status:", status)
+	}
+}
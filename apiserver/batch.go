@@ -0,0 +1,307 @@
+package apiserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+)
+
+// Default batch settings.
+const (
+	DefaultBatchSize        = 100
+	DefaultBatchConcurrency = 8
+)
+
+// maxBatchRequestBytes is the max size of the JSON body of a batch.
+const maxBatchRequestBytes = 1 << 20
+
+// batch defaces many upstream images in one request. Images are
+// fetched and defaced with bounded concurrency, and returned in a ZIP
+// archive with a manifest, or in a multipart response, with the status
+// of each item. Failed items don't abort the batch.
+type batch struct {
+	*proxy
+	MaxSize     int // max URLs per batch
+	Concurrency int // max images fetched at once
+}
+
+// batchRequest is the JSON body of a batch request. Options are the
+// query params of the deface endpoint, applied to all URLs.
+type batchRequest struct {
+	URLs    []string               `json:"urls"`
+	Options map[string]interface{} `json:"options"`
+}
+
+// batchItem is the result of an item of a batch.
+type batchItem struct {
+	URL         string `json:"url"`
+	Status      int    `json:"status"`
+	Error       string `json:"error,omitempty"`
+	Faces       int    `json:"faces"`
+	ContentType string `json:"content_type,omitempty"`
+	File        string `json:"file,omitempty"`
+
+	body []byte
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (b *batch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status, err := b.handler(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+}
+
+func (b *batch) handler(w http.ResponseWriter, r *http.Request) (int, error) {
+	var req batchRequest
+	body := http.MaxBytesReader(w, r.Body, maxBatchRequestBytes)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("Invalid batch: %v", err)
+	}
+	switch {
+	case len(req.URLs) == 0:
+		return http.StatusBadRequest, errors.New("Missing `urls`")
+	case len(req.URLs) > b.MaxSize:
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("Too many `urls`, max %d", b.MaxSize)
+	}
+	params, err := b.params(req.Options)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if status, err := keyParams(w, r, params, len(req.URLs)); err != nil {
+		return status, err
+	}
+	// items stop when the client is gone, or writing to it fails
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	items, done := b.start(r.WithContext(ctx), req.URLs, params)
+	if multipartAccepted(r.Header.Get("Accept")) {
+		writeBatchMultipart(w, items, done)
+	} else {
+		writeBatchZip(w, items, done)
+	}
+	return 0, nil
+}
+
+// params returns the deface params of the given batch options, and
+// checks that they are valid.
+func (b *batch) params(opts map[string]interface{}) (map[string]string, error) {
+	params := make(map[string]string, len(opts))
+	for k, v := range opts {
+		params[k] = fmt.Sprint(v)
+	}
+	// check the options once, with a placeholder URL
+	params["url"] = "batch"
+	if _, err := b.parseRequest(mapGetter(params)); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+// start defaces the images at urls, up to Concurrency at a time. The
+// item of each URL is set when its done channel is closed. Items that
+// haven't started when the context of r is done fail.
+func (b *batch) start(r *http.Request, urls []string, params map[string]string) ([]*batchItem, []chan struct{}) {
+	r = itemRequest(r)
+	items := make([]*batchItem, len(urls))
+	done := make([]chan struct{}, len(urls))
+	sem := make(chan struct{}, b.Concurrency)
+	ctx := r.Context()
+	for i, u := range urls {
+		done[i] = make(chan struct{})
+		go func(i int, u string) {
+			defer close(done[i])
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+			}
+			if err := ctx.Err(); err != nil {
+				items[i] = &batchItem{URL: u, Status: http.StatusServiceUnavailable, Error: err.Error()}
+				return
+			}
+			items[i] = b.item(r, u, params)
+		}(i, u)
+	}
+	return items, done
+}
+
+// itemRequest returns a copy of the batch request r for its items,
+// without the headers that apply to the batch response: conditional
+// and range requests, and the archive formats it accepts.
+func itemRequest(r *http.Request) *http.Request {
+	c := *r
+	c.Header = cloneHeader(r.Header)
+	for _, k := range []string{
+		"Accept",
+		"If-Match",
+		"If-Modified-Since",
+		"If-None-Match",
+		"If-Range",
+		"If-Unmodified-Since",
+		"Range",
+	} {
+		c.Header.Del(k)
+	}
+	return &c
+}
+
+// item defaces the image at u with the given params.
+func (b *batch) item(r *http.Request, u string, params map[string]string) *batchItem {
+	item := &batchItem{URL: u}
+	get := mapGetter(params)
+	dr, err := b.parseRequest(func(k string) string {
+		if k == "url" {
+			return u
+		}
+		return get(k)
+	})
+	if err != nil {
+		item.Status, item.Error = http.StatusBadRequest, err.Error()
+		return item
+	}
+	dr.Status = true
+	rec := &batchRecorder{header: http.Header{}, status: http.StatusOK}
+	status, err := b.deface(rec, r, dr)
+	faces := rec.header.Get("X-Defacer-Faces")
+	switch {
+	case err != nil:
+		item.Status, item.Error = status, err.Error()
+	case rec.status != http.StatusOK:
+		item.Status, item.Error = rec.status, http.StatusText(rec.status)
+	case faces == "":
+		item.Status, item.Error = http.StatusBadGateway, errNotImage.Error()
+	default:
+		item.Status = http.StatusOK
+		item.Faces, _ = strconv.Atoi(faces)
+		item.ContentType = rec.header.Get("Content-Type")
+		item.body = rec.buf.Bytes()
+	}
+	defacerBatchItemsSum.WithLabelValues(strconv.Itoa(item.Status)).Inc()
+	return item
+}
+
+// writeBatchZip writes the items to w in a ZIP archive, in order, followed
+// by a manifest.json file with the list of items. Items are released
+// as they are written, and writing stops when it fails.
+func writeBatchZip(w http.ResponseWriter, items []*batchItem, done []chan struct{}) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="batch.zip"`)
+	zw := zip.NewWriter(w)
+	for i := range items {
+		<-done[i]
+		item := items[i]
+		if item.body == nil {
+			continue
+		}
+		item.File = batchFileName(i, item.ContentType)
+		// images are compressed already
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: item.File, Method: zip.Store})
+		if err != nil {
+			return
+		}
+		if _, err = f.Write(item.body); err != nil {
+			return
+		}
+		item.body = nil
+	}
+	f, err := zw.Create("manifest.json")
+	if err != nil {
+		return
+	}
+	json.NewEncoder(f).Encode(items)
+	zw.Close()
+}
+
+// writeBatchMultipart writes the items to w as the parts of a multipart
+// response, in order. Each part has the status, URL and face count of
+// the item in its header, and the image or error message as body. Items
+// are released as they are written, and writing stops when it fails.
+func writeBatchMultipart(w http.ResponseWriter, items []*batchItem, done []chan struct{}) {
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	for i := range items {
+		<-done[i]
+		item := items[i]
+		h := textproto.MIMEHeader{}
+		h.Set("X-Defacer-URL", item.URL)
+		h.Set("X-Defacer-Status", strconv.Itoa(item.Status))
+		body := item.body
+		if body != nil {
+			h.Set("Content-Type", item.ContentType)
+			h.Set("X-Defacer-Faces", strconv.Itoa(item.Faces))
+		} else {
+			h.Set("Content-Type", "text/plain; charset=utf-8")
+			body = []byte(item.Error)
+		}
+		part, err := mw.CreatePart(h)
+		if err != nil {
+			return
+		}
+		if _, err = part.Write(body); err != nil {
+			return
+		}
+		item.body = nil
+	}
+	mw.Close()
+}
+
+// multipartAccepted reports whether the Accept header prefers a
+// multipart response over a ZIP archive.
+func multipartAccepted(accept string) bool {
+	ranges := parseAccept(accept)
+	return acceptQuality(ranges, "multipart/mixed") > acceptQuality(ranges, "application/zip")
+}
+
+// batchFileName returns the file name of the i-th item of a batch,
+// with the extension of the given content type.
+func batchFileName(i int, contentType string) string {
+	ext := "bin"
+	switch f := formatByContentType(contentType); {
+	case f == nil:
+	case f.Name == "jpeg":
+		ext = "jpg"
+	default:
+		ext = f.Name
+	}
+	return fmt.Sprintf("%04d.%s", i, ext)
+}
+
+// mapGetter returns a function that gets params from m.
+func mapGetter(m map[string]string) func(string) string {
+	return func(k string) string { return m[k] }
+}
+
+// batchRecorder is the http.ResponseWriter of batch items.
+type batchRecorder struct {
+	header http.Header
+	status int
+	wrote  bool
+	buf    bytes.Buffer
+}
+
+func (rec *batchRecorder) Header() http.Header { return rec.header }
+
+func (rec *batchRecorder) WriteHeader(code int) {
+	if !rec.wrote {
+		rec.status, rec.wrote = code, true
+	}
+}
+
+func (rec *batchRecorder) Write(p []byte) (int, error) {
+	rec.wrote = true
+	return rec.buf.Write(p)
+}
@@ -0,0 +1,210 @@
+package apiserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func serveBatch(b *batch, body, accept string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("POST", "/v1/batch", strings.NewReader(body))
+	r.Header.Set("Accept", accept)
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, r)
+	return w
+}
+
+func newTestBatch(t *testing.T) (*batch, *httptest.Server) {
+	src := blankPNG(t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/image.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(src)
+		case "/page.html":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html></html>"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return &batch{proxy: newTestProxy(t), MaxSize: 3, Concurrency: 2}, upstream
+}
+
+func TestBatchZip(t *testing.T) {
+	b, upstream := newTestBatch(t)
+	defer upstream.Close()
+	req, _ := json.Marshal(&batchRequest{
+		URLs: []string{
+			upstream.URL + "/image.png",
+			upstream.URL + "/page.html",
+			upstream.URL + "/image.png",
+		},
+		Options: map[string]interface{}{"format": "jpeg", "quality": 90},
+	})
+	w := serveBatch(b, string(req), "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatal("unexpected response:", w.Code, w.Body.String())
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]*zip.File{}
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	if len(files) != 3 || files["0000.jpg"] == nil || files["0002.jpg"] == nil {
+		t.Fatal("unexpected files:", files)
+	}
+	rc, _ := files["0000.jpg"].Open()
+	if _, format, err := image.Decode(rc); err != nil || format != "jpeg" {
+		t.Fatal("unexpected image:", format, err)
+	}
+	rc, _ = files["manifest.json"].Open()
+	var items []batchItem
+	if err = json.NewDecoder(rc).Decode(&items); err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 3 {
+		t.Fatal("unexpected manifest:", items)
+	}
+	if items[0].Status != http.StatusOK || items[0].File != "0000.jpg" || items[0].ContentType != "image/jpeg" {
+		t.Fatal("unexpected item:", items[0])
+	}
+	if items[1].Status != http.StatusBadGateway || items[1].Error == "" || items[1].File != "" {
+		t.Fatal("unexpected item:", items[1])
+	}
+}
+
+func TestBatchMultipart(t *testing.T) {
+	b, upstream := newTestBatch(t)
+	defer upstream.Close()
+	req := `{"urls": ["` + upstream.URL + `/image.png", "` + upstream.URL + `/missing.png"]}`
+	w := serveBatch(b, req, "multipart/mixed")
+	mt, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil || mt != "multipart/mixed" {
+		t.Fatal("unexpected content type:", mt, err)
+	}
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	part, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if part.Header.Get("X-Defacer-Status") != "200" || part.Header.Get("X-Defacer-Faces") != "0" {
+		t.Fatal("unexpected part:", part.Header)
+	}
+	if _, format, err := image.Decode(part); err != nil || format != "png" {
+		t.Fatal("unexpected image:", format, err)
+	}
+	part, err = mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(part)
+	if part.Header.Get("X-Defacer-Status") != "404" || len(body) == 0 {
+		t.Fatal("unexpected part:", part.Header, string(body))
+	}
+}
+
+func TestBatchItemHeaders(t *testing.T) {
+	b, upstream := newTestBatch(t)
+	defer upstream.Close()
+	req := `{"urls": ["` + upstream.URL + `/image.png"]}`
+	r, _ := http.NewRequest("POST", "/v1/batch", strings.NewReader(req))
+	r.Header.Set("Accept", "multipart/mixed, image/gif")
+	r.Header.Set("If-None-Match", "*")
+	r.Header.Set("Range", "bytes=0-1")
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, r)
+	_, params, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	part, err := multipart.NewReader(w.Body, params["boundary"]).NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if part.Header.Get("X-Defacer-Status") != "200" {
+		t.Fatal("unexpected part:", part.Header)
+	}
+	if _, format, err := image.Decode(part); err != nil || format != "png" {
+		t.Fatal("unexpected image:", format, err)
+	}
+}
+
+func TestBatchInvalid(t *testing.T) {
+	b, upstream := newTestBatch(t)
+	defer upstream.Close()
+	for req, status := range map[string]int{
+		`not json`:                       http.StatusBadRequest,
+		`{"urls": []}`:                   http.StatusBadRequest,
+		`{"urls": ["a", "b", "c", "d"]}`: http.StatusRequestEntityTooLarge,
+		`{"urls": ["a"], "options": {"format": "xyz"}}`: http.StatusBadRequest,
+	} {
+		if w := serveBatch(b, req, ""); w.Code != status {
+			t.Errorf("%s: unexpected status: %d", req, w.Code)
+		}
+	}
+}
+
+// failingWriter is a ResponseWriter that fails to write.
+type failingWriter struct {
+	header http.Header
+}
+
+func (w *failingWriter) Header() http.Header       { return w.header }
+func (w *failingWriter) WriteHeader(int)           {}
+func (w *failingWriter) Write([]byte) (int, error) { return 0, errors.New("write failed") }
+
+func TestBatchCancel(t *testing.T) {
+	src := blankPNG(t)
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if r.URL.Path != "/0.png" {
+			// slow images, until the batch gives up
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(src)
+	}))
+	defer upstream.Close()
+	b := &batch{proxy: newTestProxy(t), MaxSize: 3, Concurrency: 3}
+	req, _ := json.Marshal(&batchRequest{URLs: []string{
+		upstream.URL + "/0.png",
+		upstream.URL + "/1.png",
+		upstream.URL + "/2.png",
+	}})
+	// the client is gone
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r, _ := http.NewRequest("POST", "/v1/batch", bytes.NewReader(req))
+	b.ServeHTTP(httptest.NewRecorder(), r.WithContext(ctx))
+	if n := atomic.LoadInt32(&hits); n != 0 {
+		t.Fatal("unexpected upstream requests:", n)
+	}
+	// writing to the client fails
+	r, _ = http.NewRequest("POST", "/v1/batch", bytes.NewReader(req))
+	r.Header.Set("Accept", "multipart/mixed")
+	done := make(chan struct{})
+	go func() {
+		b.ServeHTTP(&failingWriter{header: http.Header{}}, r)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch items not stopped")
+	}
+}
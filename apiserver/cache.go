@@ -1,58 +1,182 @@
 package apiserver
 
 import (
+	"container/list"
 	"image"
 	"sync"
 	"time"
 )
 
-// imageCache holds resized overlay images indexed by their width and height.
-type imageCache struct {
+// Default ImageCache settings.
+const (
+	DefaultImageCacheBytes = 64 << 20
+	DefaultImageCacheTTL   = 5 * time.Minute
+)
+
+// ImageCache holds resized overlay images indexed by the resizer that
+// produced them and their width and height. Least recently used items
+// are evicted when the cache grows over its byte budget, and items
+// that are inactive for longer than the TTL are evicted by a sweeper.
+//
+// An ImageCache can be shared by multiple ImageResizers.
+type ImageCache struct {
 	sync.Mutex
-	m    map[image.Point]*imageCacheItem
-	once sync.Once
+	maxBytes int64
+	ttl      time.Duration
+	bytes    int64
+	ll       *list.List // front is most recently used
+	m        map[imageCacheKey]*list.Element
+	stop     chan struct{}
+	once     sync.Once
+}
+
+// imageCacheKey identifies a resized overlay. Resizers have unique IDs
+// so that different overlays of the same size don't collide.
+type imageCacheKey struct {
+	ID   uint64
+	Size image.Point
 }
 
 type imageCacheItem struct {
+	Key   imageCacheKey
 	Time  time.Time
 	Image image.Image
+	Bytes int64
 }
 
-var defaultImageCache = &imageCache{
-	m: make(map[image.Point]*imageCacheItem),
+// NewImageCache creates and initializes a new ImageCache that holds up
+// to maxBytes of images, and evicts images that are not used for ttl.
+// If maxBytes is 0 or less the cache is unbounded, and if ttl is 0 or
+// less items never expire. The cache must be closed to stop its sweeper.
+func NewImageCache(maxBytes int64, ttl time.Duration) *ImageCache {
+	ic := &ImageCache{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		ll:       list.New(),
+		m:        make(map[imageCacheKey]*list.Element),
+		stop:     make(chan struct{}),
+	}
+	if ttl > 0 {
+		go ic.sweep()
+	}
+	return ic
 }
 
-func (ic *imageCache) Get(size *image.Point) image.Image {
-	ic.once.Do(func() { go ic.flush() })
+// Get returns the image of the given key, or nil if it's not cached.
+func (ic *ImageCache) Get(key *imageCacheKey) image.Image {
 	ic.Lock()
 	defer ic.Unlock()
-	item := ic.m[*size]
-	if item == nil {
+	e := ic.m[*key]
+	if e == nil {
 		defacerImageCacheMissSum.Inc()
 		return nil
 	}
+	item := e.Value.(*imageCacheItem)
 	item.Time = time.Now()
+	ic.ll.MoveToFront(e)
 	defacerImageCacheHitsSum.Inc()
 	return item.Image
 }
 
-func (ic *imageCache) Set(size *image.Point, m image.Image) {
+// Set adds the image to the cache, evicting least recently used images
+// to make room for it. Images larger than the cache are not stored.
+func (ic *ImageCache) Set(key *imageCacheKey, m image.Image) {
+	n := imageBytes(m)
+	if ic.maxBytes > 0 && n > ic.maxBytes {
+		return
+	}
 	ic.Lock()
-	ic.m[*size] = &imageCacheItem{Time: time.Now(), Image: m}
-	ic.Unlock()
+	defer ic.Unlock()
+	if e := ic.m[*key]; e != nil {
+		ic.remove(e)
+	}
+	item := &imageCacheItem{
+		Key:   *key,
+		Time:  time.Now(),
+		Image: m,
+		Bytes: n,
+	}
+	ic.m[*key] = ic.ll.PushFront(item)
+	ic.bytes += n
 	defacerImageCacheItemsCount.Inc()
+	defacerImageCacheBytes.Add(float64(n))
+	for ic.maxBytes > 0 && ic.bytes > ic.maxBytes {
+		ic.remove(ic.ll.Back())
+		defacerImageCacheEvictionsSum.WithLabelValues("size").Inc()
+	}
+}
+
+// Len returns the number of images in the cache.
+func (ic *ImageCache) Len() int {
+	ic.Lock()
+	defer ic.Unlock()
+	return ic.ll.Len()
+}
+
+// Close stops the sweeper and removes all images from the cache.
+func (ic *ImageCache) Close() error {
+	ic.once.Do(func() { close(ic.stop) })
+	ic.Lock()
+	defer ic.Unlock()
+	for e := ic.ll.Back(); e != nil; e = ic.ll.Back() {
+		ic.remove(e)
+	}
+	return nil
+}
+
+// remove removes the given element from the cache. The caller must
+// hold the lock.
+func (ic *ImageCache) remove(e *list.Element) {
+	item := ic.ll.Remove(e).(*imageCacheItem)
+	delete(ic.m, item.Key)
+	ic.bytes -= item.Bytes
+	defacerImageCacheItemsCount.Dec()
+	defacerImageCacheBytes.Sub(float64(item.Bytes))
+}
+
+// sweep runs periodically to evict items that are inactive for longer
+// than the cache TTL, until the cache is closed.
+func (ic *ImageCache) sweep() {
+	interval := 5 * time.Second
+	if ic.ttl < interval {
+		interval = ic.ttl
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ic.stop:
+			return
+		case <-t.C:
+			ic.expire(time.Now())
+		}
+	}
 }
 
-// flush runs every 5s to evict items that are inactive for up to 5min.
-func (ic *imageCache) flush() {
-	for range time.Tick(5 * time.Second) {
-		ic.Lock()
-		for k, v := range ic.m {
-			if time.Since(v.Time) > 5*time.Minute {
-				delete(ic.m, k)
-				defacerImageCacheItemsCount.Dec()
-			}
+// expire evicts items that are inactive since before now minus the TTL.
+func (ic *ImageCache) expire(now time.Time) {
+	ic.Lock()
+	defer ic.Unlock()
+	for e := ic.ll.Back(); e != nil; e = ic.ll.Back() {
+		if now.Sub(e.Value.(*imageCacheItem).Time) <= ic.ttl {
+			break
 		}
-		ic.Unlock()
+		ic.remove(e)
+		defacerImageCacheEvictionsSum.WithLabelValues("ttl").Inc()
+	}
+}
+
+// imageBytes returns the approximate memory used by the pixels of m.
+func imageBytes(m image.Image) int64 {
+	b := m.Bounds()
+	bpp := int64(4)
+	switch m.(type) {
+	case *image.Gray, *image.Alpha, *image.Paletted:
+		bpp = 1
+	case *image.Gray16, *image.Alpha16:
+		bpp = 2
+	case *image.RGBA64, *image.NRGBA64:
+		bpp = 8
 	}
+	return int64(b.Dx()) * int64(b.Dy()) * bpp
 }
@@ -3,6 +3,7 @@ package apiserver
 import (
 	"image"
 	"testing"
+	"time"
 
 	"github.com/fiorix/defacer/apiserver/internal"
 )
@@ -12,14 +13,64 @@ func TestImageCache(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	size := image.Point{10, 20}
-	m := defaultImageCache.Get(&size)
+	ic := NewImageCache(0, time.Minute)
+	defer ic.Close()
+	key := imageCacheKey{Size: image.Point{10, 20}}
+	m := ic.Get(&key)
 	if m != nil {
 		t.Fatal("unexpected image from cache")
 	}
-	defaultImageCache.Set(&size, overlay)
-	m = defaultImageCache.Get(&size)
+	ic.Set(&key, overlay)
+	m = ic.Get(&key)
 	if m != overlay {
 		t.Fatal("image missing from cache")
 	}
+	key.ID++
+	m = ic.Get(&key)
+	if m != nil {
+		t.Fatal("unexpected image from another resizer")
+	}
+}
+
+func TestImageCacheLRU(t *testing.T) {
+	// room for two 10x10 RGBA images
+	ic := NewImageCache(800, 0)
+	defer ic.Close()
+	keys := []imageCacheKey{
+		{Size: image.Point{1, 1}},
+		{Size: image.Point{2, 2}},
+		{Size: image.Point{3, 3}},
+	}
+	ic.Set(&keys[0], image.NewRGBA(image.Rect(0, 0, 10, 10)))
+	ic.Set(&keys[1], image.NewRGBA(image.Rect(0, 0, 10, 10)))
+	ic.Get(&keys[0])
+	ic.Set(&keys[2], image.NewRGBA(image.Rect(0, 0, 10, 10)))
+	if ic.Len() != 2 {
+		t.Fatal("unexpected cache length:", ic.Len())
+	}
+	if ic.Get(&keys[1]) != nil {
+		t.Fatal("least recently used image not evicted")
+	}
+	if ic.Get(&keys[0]) == nil || ic.Get(&keys[2]) == nil {
+		t.Fatal("recently used image evicted")
+	}
+	ic.Set(&keys[1], image.NewRGBA(image.Rect(0, 0, 100, 100)))
+	if ic.Get(&keys[1]) != nil {
+		t.Fatal("image larger than the cache was stored")
+	}
+}
+
+func TestImageCacheExpire(t *testing.T) {
+	ic := NewImageCache(0, time.Minute)
+	defer ic.Close()
+	key := imageCacheKey{Size: image.Point{10, 10}}
+	ic.Set(&key, image.NewRGBA(image.Rect(0, 0, 10, 10)))
+	ic.expire(time.Now())
+	if ic.Len() != 1 {
+		t.Fatal("active image expired")
+	}
+	ic.expire(time.Now().Add(2 * time.Minute))
+	if ic.Len() != 0 {
+		t.Fatal("inactive image not expired")
+	}
 }
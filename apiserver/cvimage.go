@@ -0,0 +1,67 @@
+package apiserver
+
+import (
+	"image"
+	"image/draw"
+
+	"github.com/lazywei/go-opencv/opencv"
+)
+
+// grayIplImage converts m to the 8-bit grayscale IplImage scanned by
+// the haar cascade. The luma of YCbCr and Gray images is copied row by
+// row, and RGBA and NRGBA images are converted without going through
+// the image.Image interface. Other images are converted to Gray first.
+//
+// The returned image must be released by the caller.
+func grayIplImage(m image.Image) *opencv.IplImage {
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w == 0 || h == 0 {
+		return nil
+	}
+	dst := opencv.CreateImage(w, h, opencv.IPL_DEPTH_8U, 1)
+	if dst == nil {
+		return nil
+	}
+	step := dst.WidthStep()
+	data := (*[1 << 30]byte)(dst.ImageData())[: step*h : step*h]
+	switch src := m.(type) {
+	case *image.YCbCr:
+		for y := 0; y < h; y++ {
+			i := src.YOffset(b.Min.X, b.Min.Y+y)
+			copy(data[y*step:y*step+w], src.Y[i:i+w])
+		}
+	case *image.Gray:
+		for y := 0; y < h; y++ {
+			i := src.PixOffset(b.Min.X, b.Min.Y+y)
+			copy(data[y*step:y*step+w], src.Pix[i:i+w])
+		}
+	case *image.RGBA:
+		for y := 0; y < h; y++ {
+			i := src.PixOffset(b.Min.X, b.Min.Y+y)
+			rgbaToGray(data[y*step:y*step+w], src.Pix[i:i+4*w])
+		}
+	case *image.NRGBA:
+		for y := 0; y < h; y++ {
+			i := src.PixOffset(b.Min.X, b.Min.Y+y)
+			rgbaToGray(data[y*step:y*step+w], src.Pix[i:i+4*w])
+		}
+	default:
+		gray := image.NewGray(image.Rect(0, 0, w, h))
+		draw.Draw(gray, gray.Bounds(), m, b.Min, draw.Src)
+		for y := 0; y < h; y++ {
+			copy(data[y*step:y*step+w], gray.Pix[y*gray.Stride:y*gray.Stride+w])
+		}
+	}
+	return dst
+}
+
+// rgbaToGray converts a row of 4-byte RGBA pixels to luma, using the
+// same coefficients as color.GrayModel.
+func rgbaToGray(dst, src []byte) {
+	for i := range dst {
+		p := src[4*i : 4*i+3]
+		r, g, b := uint32(p[0]), uint32(p[1]), uint32(p[2])
+		dst[i] = uint8((19595*r + 38470*g + 7471*b + 1<<15) >> 16)
+	}
+}
@@ -0,0 +1,91 @@
+package apiserver
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/lazywei/go-opencv/opencv"
+
+	"github.com/fiorix/defacer/apiserver/internal"
+)
+
+func TestGrayIplImage(t *testing.T) {
+	src, err := internal.DefaultFaceBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _, err := image.Decode(bytes.NewBuffer(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := m.Bounds()
+	rgba := image.NewRGBA(b)
+	draw.Draw(rgba, b, m, b.Min, draw.Src)
+	nrgba := image.NewNRGBA(b)
+	draw.Draw(nrgba, b, m, b.Min, draw.Src)
+	gray := image.NewGray(b)
+	draw.Draw(gray, b, m, b.Min, draw.Src)
+	cmyk := image.NewCMYK(b)
+	draw.Draw(cmyk, b, m, b.Min, draw.Src)
+	sub := image.Rect(10, 20, 110, 120)
+	for _, m := range []image.Image{
+		m,
+		rgba,
+		nrgba,
+		gray,
+		cmyk,
+		m.(*image.YCbCr).SubImage(sub),
+		rgba.SubImage(sub),
+	} {
+		cvimg := grayIplImage(m)
+		if cvimg == nil {
+			t.Fatalf("%T: failed to convert image", m)
+		}
+		checkGrayIplImage(t, cvimg, m)
+		cvimg.Release()
+	}
+}
+
+func checkGrayIplImage(t *testing.T, cvimg *opencv.IplImage, m image.Image) {
+	b := m.Bounds()
+	if cvimg.Width() != b.Dx() || cvimg.Height() != b.Dy() {
+		t.Fatalf("%T: unexpected size: %dx%d", m, cvimg.Width(), cvimg.Height())
+	}
+	step := cvimg.WidthStep()
+	data := (*[1 << 30]byte)(cvimg.ImageData())[: step*b.Dy() : step*b.Dy()]
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			want := color.GrayModel.Convert(m.At(b.Min.X+x, b.Min.Y+y)).(color.Gray).Y
+			have := data[y*step+x]
+			if d := int(want) - int(have); d < -1 || d > 1 {
+				t.Fatalf("%T: unexpected gray at %d,%d: want %d, have %d", m, x, y, want, have)
+			}
+		}
+	}
+}
+
+func benchmarkIplImage(b *testing.B, conv func(image.Image) *opencv.IplImage) {
+	src, err := internal.DefaultFaceBytes()
+	if err != nil {
+		b.Fatal(err)
+	}
+	m, _, err := image.Decode(bytes.NewBuffer(src))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conv(m).Release()
+	}
+}
+
+func BenchmarkFromImage(b *testing.B) {
+	benchmarkIplImage(b, opencv.FromImage)
+}
+
+func BenchmarkGrayIplImage(b *testing.B) {
+	benchmarkIplImage(b, grayIplImage)
+}
@@ -1,14 +1,19 @@
 package apiserver
 
 import (
+	"bytes"
 	"errors"
 	"image"
+	"image/color"
 	"image/draw"
 	"io"
+	"io/ioutil"
 	"runtime"
 	"sync"
+	"time"
 
 	"github.com/lazywei/go-opencv/opencv"
+	"github.com/nfnt/resize"
 
 	"github.com/fiorix/defacer/apiserver/internal"
 )
@@ -16,12 +21,56 @@ import (
 // A Defacer can scan and deface people's faces in images.
 type Defacer interface {
 	// Deface reads binary image bytes from a given reader
-	// and returns a defaced version of the image.
-	Deface(io.Reader) (image.Image, error)
+	// and returns a defaced version of the image. If opts is
+	// nil the Defacer's defaults are used.
+	Deface(r io.Reader, opts *DefaceOptions) (*DefaceResult, error)
+}
+
+// DefaceResult is the result of a Deface call.
+type DefaceResult struct {
+	Image  image.Image       // defaced image, or the source if no faces
+	Format string            // format name of the source, e.g. "jpeg"
+	Faces  []image.Rectangle // where faces were detected
+	Source []byte            // encoded source, see DefaceOptions.KeepSource
+}
+
+// DefaceOptions are per-call options for a Defacer.
+type DefaceOptions struct {
+	// Resizer provides the overlay image drawn on faces.
+	// Default: the resizer the Defacer was created with.
+	Resizer ImageResizer
+
+	// MaxDetectSize is the max width or height of the image that
+	// is scanned for faces. Larger images are downscaled for the
+	// scan, and faces are mapped back and defaced on the original
+	// image. Default: no limit.
+	MaxDetectSize int
+
+	// TileSize enables tiled detection: images larger than TileSize
+	// are scanned in square tiles that overlap by TileOverlap pixels,
+	// after downscaling to MaxDetectSize. Default: no tiling.
+	TileSize    int
+	TileOverlap int // default: TileSize/4
+
+	// KeepSource keeps the encoded source image in the result
+	// when no faces are found, so it can be used as is. Sources
+	// with more than one frame are never kept, as only the first
+	// frame is scanned.
+	KeepSource bool
+
+	// DetectOnly returns the faces and the decoded image without
+	// defacing it.
+	DetectOnly bool
 }
 
 // NewDefacer creates and initializes a new Defacer.
 func NewDefacer(resizer ImageResizer) (Defacer, error) {
+	return newDefacer(resizer, nil)
+}
+
+// newDefacer creates a defacer that offers tiles to the given channel
+// for detection, or scans them itself if tiles is nil.
+func newDefacer(resizer ImageResizer, tiles chan *detectReq) (*defacer, error) {
 	hc, err := internal.DefaultHaarCascade()
 	if err != nil {
 		return nil, err
@@ -29,6 +78,7 @@ func NewDefacer(resizer ImageResizer) (Defacer, error) {
 	df := &defacer{
 		Resizer:     resizer,
 		HaarCascade: hc,
+		Tiles:       tiles,
 	}
 	return df, nil
 }
@@ -37,77 +87,232 @@ type defacer struct {
 	sync.Mutex
 	Resizer     ImageResizer
 	HaarCascade *opencv.HaarCascade
+	Tiles       chan *detectReq
 }
 
-// Deface implements the Defacer interface.
-func (df *defacer) Deface(r io.Reader) (image.Image, error) {
-	img, faces, err := df.scan(r)
+// Deface implements the Defacer interface. Images without faces are
+// returned as decoded, and faces are drawn in place on the decoded
+// image unless its color model can't be drawn on.
+func (df *defacer) Deface(r io.Reader, opts *DefaceOptions) (*DefaceResult, error) {
+	if opts == nil {
+		opts = &DefaceOptions{}
+	}
+	var src *bytes.Buffer
+	if opts.KeepSource {
+		src = &bytes.Buffer{}
+		r = io.TeeReader(r, src)
+	}
+	start := time.Now()
+	img, format, faces, err := df.scan(r, opts)
 	if err != nil {
 		return nil, err
 	}
-	b := img.Bounds()
-	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
-	draw.Draw(dst, dst.Bounds(), image.Transparent, image.ZP, draw.Src)
-	draw.DrawMask(dst, dst.Bounds(), img, b.Min, img, b.Min, draw.Over)
+	defer observeImageSeconds(defacerImageDefaceSeconds, img, start)
+	res := &DefaceResult{
+		Image:  img,
+		Format: format,
+		Faces:  faces,
+	}
+	if opts.DetectOnly {
+		return res, nil
+	}
+	if len(faces) == 0 {
+		if src != nil {
+			// the decoder may stop before the end of the source
+			if _, err = io.Copy(ioutil.Discard, r); err != nil {
+				return nil, err
+			}
+			// faces of other frames would be passed through
+			if !multiFrame(format, src.Bytes()) {
+				res.Source = src.Bytes()
+			}
+		}
+		return res, nil
+	}
+	resizer := df.Resizer
+	if opts.Resizer != nil {
+		resizer = opts.Resizer
+	}
+	dst := drawable(img)
 	switch len(faces) {
-	case 0: // nothing to do
 	case 1:
-		df.draw(nil, nil, dst, faces[0])
+		df.draw(nil, nil, resizer, dst, faces[0])
 	default:
 		mu, wg := &sync.Mutex{}, &sync.WaitGroup{}
 		for _, rect := range faces {
 			wg.Add(1)
-			go df.draw(mu, wg, dst, rect)
+			go df.draw(mu, wg, resizer, dst, rect)
 		}
 		wg.Wait()
 	}
-	return dst, nil
+	res.Image = dst
+	return res, nil
+}
+
+// drawable returns m if drawOver can draw on it in place without losing
+// the colors of the overlay, or a copy of m as RGBA. Gray and paletted
+// images are copied, as the overlay would be flattened to their colors.
+func drawable(m image.Image) image.Image {
+	switch m.(type) {
+	case *image.RGBA, *image.NRGBA, *image.YCbCr:
+		return m
+	}
+	b := m.Bounds()
+	dst := image.NewRGBA(b)
+	draw.Draw(dst, b, m, b.Min, draw.Src)
+	return dst
+}
+
+// drawOver draws the overlay m over r of dst, which is an RGBA, NRGBA
+// or YCbCr image, see drawable.
+func drawOver(dst image.Image, r image.Rectangle, m image.Image) {
+	if ycc, ok := dst.(*image.YCbCr); ok {
+		drawYCbCr(ycc, r, m)
+		return
+	}
+	b := m.Bounds()
+	draw.DrawMask(dst.(draw.Image), r, m, b.Min, m, b.Min, draw.Over)
+}
+
+// drawYCbCr draws the overlay m over r of dst, such as a decoded JPEG,
+// without copying the whole image. Only r, grown to whole chroma
+// samples, is copied to RGBA to be drawn on, and converted back. The
+// chroma of subsampled pixels is averaged, using the original chroma
+// of the pixels outside r.
+func drawYCbCr(dst *image.YCbCr, r image.Rectangle, m image.Image) {
+	clip := r.Intersect(dst.Rect)
+	if clip.Empty() {
+		return
+	}
+	sx, sy := chromaSubsample(dst.SubsampleRatio)
+	pr := image.Rect(
+		clip.Min.X/sx*sx, clip.Min.Y/sy*sy,
+		(clip.Max.X+sx-1)/sx*sx, (clip.Max.Y+sy-1)/sy*sy,
+	).Intersect(dst.Rect)
+	patch := image.NewRGBA(pr)
+	draw.Draw(patch, pr, dst, pr.Min, draw.Src)
+	b := m.Bounds()
+	draw.DrawMask(patch, r, m, b.Min, m, b.Min, draw.Over)
+
+	// sums of the chroma of the pixels of each sample
+	x0, y0 := pr.Min.X/sx, pr.Min.Y/sy
+	cw := (pr.Max.X-1)/sx - x0 + 1
+	sums := make([][3]int, cw*((pr.Max.Y-1)/sy-y0+1))
+	for y := pr.Min.Y; y < pr.Max.Y; y++ {
+		for x := pr.Min.X; x < pr.Max.X; x++ {
+			var cb, cr uint8
+			if (image.Point{x, y}).In(clip) {
+				c := patch.RGBAAt(x, y)
+				dst.Y[dst.YOffset(x, y)], cb, cr = color.RGBToYCbCr(c.R, c.G, c.B)
+			} else {
+				off := dst.COffset(x, y)
+				cb, cr = dst.Cb[off], dst.Cr[off]
+			}
+			sum := &sums[(y/sy-y0)*cw+x/sx-x0]
+			sum[0] += int(cb)
+			sum[1] += int(cr)
+			sum[2]++
+		}
+	}
+	for y := pr.Min.Y; y < pr.Max.Y; y += sy - y%sy {
+		for x := pr.Min.X; x < pr.Max.X; x += sx - x%sx {
+			sum := sums[(y/sy-y0)*cw+x/sx-x0]
+			off := dst.COffset(x, y)
+			dst.Cb[off] = uint8((sum[0] + sum[2]/2) / sum[2])
+			dst.Cr[off] = uint8((sum[1] + sum[2]/2) / sum[2])
+		}
+	}
+}
+
+// chromaSubsample returns the number of pixels per chroma sample of a
+// YCbCr image, horizontally and vertically.
+func chromaSubsample(ratio image.YCbCrSubsampleRatio) (int, int) {
+	switch ratio {
+	case image.YCbCrSubsampleRatio422:
+		return 2, 1
+	case image.YCbCrSubsampleRatio420:
+		return 2, 2
+	case image.YCbCrSubsampleRatio440:
+		return 1, 2
+	case image.YCbCrSubsampleRatio411:
+		return 4, 1
+	case image.YCbCrSubsampleRatio410:
+		return 4, 2
+	}
+	return 1, 1
 }
 
 // scan reads binary image data from the given reader and scans for
 // faces, returning a slice of rectangles where faces were detected.
-func (df *defacer) scan(src io.Reader) (m image.Image, r []image.Rectangle, err error) {
-	img, _, err := image.Decode(src)
+func (df *defacer) scan(src io.Reader, opts *DefaceOptions) (m image.Image, format string, r []image.Rectangle, err error) {
+	img, format, err := image.Decode(src)
 	if err != nil {
-		return nil, nil, err
+		return nil, "", nil, err
 	}
-	df.Lock()
-	defer df.Unlock()
-	cvimg := opencv.FromImage(img)
-	if cvimg == nil {
-		return nil, nil, errors.New("failed to load source image")
+	start := time.Now()
+	defer observeImageSeconds(defacerImageDetectSeconds, img, start)
+	b := img.Bounds()
+	det := img
+	if size := fitSize(b.Size(), opts.MaxDetectSize); size != b.Size() {
+		det = resize.Resize(uint(size.X), uint(size.Y), img, resize.Bilinear)
 	}
-	faces := df.HaarCascade.DetectObjects(cvimg)
-	if faces == nil {
-		return img, []image.Rectangle{}, nil
+	var faces []image.Rectangle
+	db := det.Bounds()
+	if n := opts.TileSize; n > 0 && (db.Dx() > n || db.Dy() > n) {
+		faces, err = df.detectTiles(det, n, opts.TileOverlap)
+	} else {
+		faces, err = df.detect(det)
+	}
+	if err != nil {
+		return nil, "", nil, err
 	}
+	sx := float64(b.Dx()) / float64(db.Dx())
+	sy := float64(b.Dy()) / float64(db.Dy())
 	fr := make([]image.Rectangle, len(faces))
 	for i, rect := range faces {
-		x, y, w, h := rect.X(), rect.Y(), rect.Width(), rect.Height()
+		rect = rect.Sub(db.Min)
 		fr[i] = image.Rectangle{
 			image.Point{
-				roundDown(x),
-				roundDown(y),
+				roundDown(scale(rect.Min.X, sx)),
+				roundDown(scale(rect.Min.Y, sy)),
 			},
 			image.Point{
-				roundUp(x + w),
-				roundUp(y + h),
+				roundUp(scale(rect.Max.X, sx)),
+				roundUp(scale(rect.Max.Y, sy)),
 			},
-		}
+		}.Add(b.Min)
 	}
-	return img, fr, nil
+	return img, format, fr, nil
+}
+
+// detect scans m for faces, returning rectangles in m's coordinates.
+func (df *defacer) detect(m image.Image) ([]image.Rectangle, error) {
+	df.Lock()
+	defer df.Unlock()
+	cvimg := grayIplImage(m)
+	if cvimg == nil {
+		return nil, errors.New("failed to load source image")
+	}
+	defer cvimg.Release()
+	faces := df.HaarCascade.DetectObjects(cvimg)
+	min := m.Bounds().Min
+	fr := make([]image.Rectangle, len(faces))
+	for i, rect := range faces {
+		x, y, w, h := rect.X(), rect.Y(), rect.Width(), rect.Height()
+		fr[i] = image.Rect(x, y, x+w, y+h).Add(min)
+	}
+	return fr, nil
 }
 
 // draw blends the deface image onto dst, of the size of the given rectangle.
-func (df *defacer) draw(mu *sync.Mutex, wg *sync.WaitGroup, dst draw.Image, r image.Rectangle) {
+func (df *defacer) draw(mu *sync.Mutex, wg *sync.WaitGroup, resizer ImageResizer, dst image.Image, r image.Rectangle) {
 	size := image.Point{r.Max.X - r.Min.X, r.Max.Y - r.Min.Y}
-	img := df.Resizer.Resize(size)
-	b := img.Bounds()
+	img := resizer.Resize(size)
 	if mu != nil {
 		mu.Lock()
 		defer mu.Unlock()
 	}
-	draw.DrawMask(dst, r, img, b.Min, img, b.Min, draw.Over)
+	drawOver(dst, r, img)
 	if wg != nil {
 		wg.Done()
 	}
@@ -116,23 +321,28 @@ func (df *defacer) draw(mu *sync.Mutex, wg *sync.WaitGroup, dst draw.Image, r im
 
 type defacerPool struct {
 	Inbox   chan *defacerReq
+	Tiles   chan *detectReq
 	Resizer ImageResizer
+
+	once sync.Once
 }
 
 type defacerReq struct {
-	Reader io.Reader
-	Resp   chan *defacerResp
+	Reader  io.Reader
+	Options *DefaceOptions
+	Resp    chan *defacerResp
 }
 
 type defacerResp struct {
-	Image image.Image
-	Error error
+	Result *DefaceResult
+	Error  error
 }
 
 // NewDefacerPool creates a pool of Defacers.
 func NewDefacerPool(resizer ImageResizer, workers uint) (Defacer, error) {
 	dp := &defacerPool{
 		Inbox:   make(chan *defacerReq, workers),
+		Tiles:   make(chan *detectReq),
 		Resizer: resizer,
 	}
 	i := uint(0)
@@ -153,20 +363,28 @@ func NewDefacerPool(resizer ImageResizer, workers uint) (Defacer, error) {
 	}
 }
 
-func (dp *defacerPool) Deface(r io.Reader) (image.Image, error) {
+func (dp *defacerPool) Deface(r io.Reader, opts *DefaceOptions) (*DefaceResult, error) {
 	req := &defacerReq{
-		Reader: r,
-		Resp:   make(chan *defacerResp),
+		Reader:  r,
+		Options: opts,
+		Resp:    make(chan *defacerResp),
 	}
 	defer close(req.Resp)
 	dp.Inbox <- req
 	resp := <-req.Resp
-	return resp.Image, resp.Error
+	return resp.Result, resp.Error
+}
+
+// Close stops the workers of the pool. The pool must not be used
+// after it's closed.
+func (dp *defacerPool) Close() error {
+	dp.once.Do(func() { close(dp.Inbox) })
+	return nil
 }
 
 func (dp *defacerPool) run(wg *sync.WaitGroup, errc chan error) {
 	runtime.LockOSThread()
-	df, err := NewDefacer(dp.Resizer)
+	df, err := newDefacer(dp.Resizer, dp.Tiles)
 	if err != nil {
 		select {
 		case errc <- err:
@@ -176,11 +394,19 @@ func (dp *defacerPool) run(wg *sync.WaitGroup, errc chan error) {
 		return
 	}
 	wg.Done()
-	for req := range dp.Inbox {
-		img, err := df.Deface(req.Reader)
-		req.Resp <- &defacerResp{
-			Image: img,
-			Error: err,
+	for {
+		select {
+		case req, ok := <-dp.Inbox:
+			if !ok {
+				return
+			}
+			res, err := df.Deface(req.Reader, req.Options)
+			req.Resp <- &defacerResp{
+				Result: res,
+				Error:  err,
+			}
+		case req := <-dp.Tiles:
+			req.run(df)
 		}
 	}
 }
@@ -2,6 +2,12 @@ package apiserver
 
 import (
 	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
 	"testing"
 
 	"github.com/fiorix/defacer/apiserver/internal"
@@ -12,7 +18,7 @@ func TestDefacer(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	df, err := NewDefacer(NewImageResizer(overlay))
+	df, err := NewDefacer(NewImageResizer(overlay, nil))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -20,18 +26,234 @@ func TestDefacer(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = df.Deface(bytes.NewBuffer(src))
+	_, err = df.Deface(bytes.NewBuffer(src), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
+func TestDefacerMaxDetectSize(t *testing.T) {
+	overlay, err := internal.DefaultDefaceImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	df, err := NewDefacer(NewImageResizer(overlay, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := internal.DefaultFaceBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _, err := image.Decode(bytes.NewBuffer(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &DefaceOptions{MaxDetectSize: m.Bounds().Dx() / 2}
+	res, err := df.Deface(bytes.NewBuffer(src), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Image.Bounds().Size() != m.Bounds().Size() {
+		t.Fatal("unexpected size:", res.Image.Bounds().Size())
+	}
+}
+
+func TestDefacerKeepSource(t *testing.T) {
+	overlay, err := internal.DefaultDefaceImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	df, err := NewDefacer(NewImageResizer(overlay, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := internal.DefaultFaceBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := df.Deface(bytes.NewBuffer(src), &DefaceOptions{KeepSource: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Format != "jpeg" {
+		t.Fatal("unexpected format:", res.Format)
+	}
+	switch {
+	case len(res.Faces) == 0 && !bytes.Equal(res.Source, src):
+		t.Fatal("source missing from result without faces")
+	case len(res.Faces) > 0 && res.Source != nil:
+		t.Fatal("unexpected source in result with faces")
+	}
+}
+
+func TestDefacerKeepSourceAnimated(t *testing.T) {
+	overlay, err := internal.DefaultDefaceImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	df, err := NewDefacer(NewImageResizer(overlay, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := internal.DefaultFaceBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	face, _, err := image.Decode(bytes.NewBuffer(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the face is only in the second frame
+	b := face.Bounds()
+	blank := image.NewPaletted(b, palette.Plan9)
+	draw.Draw(blank, b, image.White, image.ZP, draw.Src)
+	frame := image.NewPaletted(b, palette.Plan9)
+	draw.Draw(frame, b, face, b.Min, draw.Src)
+	var buf bytes.Buffer
+	anim := &gif.GIF{Image: []*image.Paletted{blank, frame}, Delay: []int{10, 10}}
+	if err = gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+	res, err := df.Deface(&buf, &DefaceOptions{KeepSource: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Faces) != 0 || res.Source != nil {
+		t.Fatal("animated source kept:", res.Faces, len(res.Source))
+	}
+}
+
+func TestDrawable(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	if dst := drawable(m); dst != m {
+		t.Fatal("drawable image was copied")
+	}
+	ycc := image.NewYCbCr(image.Rect(5, 5, 10, 10), image.YCbCrSubsampleRatio420)
+	if dst := drawable(ycc); dst != ycc {
+		t.Fatal("YCbCr image was copied")
+	}
+	for _, m := range []image.Image{
+		image.NewNYCbCrA(image.Rect(5, 5, 10, 10), image.YCbCrSubsampleRatio420),
+		image.NewGray(image.Rect(5, 5, 10, 10)),
+		image.NewPaletted(image.Rect(5, 5, 10, 10), palette.Plan9),
+	} {
+		dst := drawable(m)
+		if _, ok := dst.(*image.RGBA); !ok || dst.Bounds() != m.Bounds() {
+			t.Fatalf("%T: unexpected copy: %T %v", m, dst, dst.Bounds())
+		}
+	}
+}
+
+func TestDrawYCbCr(t *testing.T) {
+	red := color.RGBA{R: 0xff, A: 0xff}
+	overlay := solidImage(red)
+	for _, ratio := range []image.YCbCrSubsampleRatio{
+		image.YCbCrSubsampleRatio444,
+		image.YCbCrSubsampleRatio422,
+		image.YCbCrSubsampleRatio420,
+		image.YCbCrSubsampleRatio440,
+		image.YCbCrSubsampleRatio411,
+		image.YCbCrSubsampleRatio410,
+	} {
+		ycc := image.NewYCbCr(image.Rect(0, 0, 40, 30), ratio)
+		for i := range ycc.Y {
+			ycc.Y[i] = 0x80
+		}
+		for i := range ycc.Cb {
+			ycc.Cb[i], ycc.Cr[i] = 0x80, 0x80
+		}
+		// odd bounds, and partly outside the image
+		drawOver(ycc, image.Rect(5, 7, 15, 17), overlay)
+		drawOver(ycc, image.Rect(35, 25, 45, 35), overlay)
+		y, cb, cr := color.RGBToYCbCr(0xff, 0, 0)
+		for _, p := range []image.Point{{10, 10}, {9, 12}, {38, 28}} {
+			if c := ycc.YCbCrAt(p.X, p.Y); c != (color.YCbCr{y, cb, cr}) {
+				t.Errorf("%v: unexpected color at %v: %v", ratio, p, c)
+			}
+		}
+		// the chroma of the edges is shared with the pixels around
+		for _, p := range []image.Point{{5, 7}, {14, 16}, {35, 25}, {39, 29}} {
+			if c := ycc.YCbCrAt(p.X, p.Y); c.Y != y {
+				t.Errorf("%v: unexpected luma at %v: %d", ratio, p, c.Y)
+			}
+		}
+		gray := color.YCbCr{0x80, 0x80, 0x80}
+		for _, p := range []image.Point{{4, 6}, {15, 17}, {34, 24}} {
+			if c := ycc.YCbCrAt(p.X, p.Y); c.Y != gray.Y {
+				t.Errorf("%v: unexpected luma at %v: %d", ratio, p, c.Y)
+			}
+		}
+		for _, p := range []image.Point{{0, 0}, {20, 20}, {0, 29}, {39, 0}} {
+			if c := ycc.YCbCrAt(p.X, p.Y); c != gray {
+				t.Errorf("%v: unexpected color at %v: %v", ratio, p, c)
+			}
+		}
+	}
+}
+
+// jpegImage returns a decoded JPEG of the given size.
+func jpegImage(b testing.TB, w, h int) image.Image {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h)), nil); err != nil {
+		b.Fatal(err)
+	}
+	m, err := jpeg.Decode(&buf)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return m
+}
+
+func benchmarkDrawJPEG(b *testing.B, copy bool) {
+	src := jpegImage(b, 1024, 768)
+	overlay := solidImage(color.RGBA{R: 0xff, A: 0xff})
+	face := image.Rect(100, 100, 200, 200)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m := src
+		if copy {
+			bounds := m.Bounds()
+			rgba := image.NewRGBA(bounds)
+			draw.Draw(rgba, bounds, m, bounds.Min, draw.Src)
+			m = rgba
+		}
+		drawOver(drawable(m), face, overlay)
+	}
+}
+
+// BenchmarkDrawJPEG draws on the YCbCr image decoded from JPEG, and
+// BenchmarkDrawJPEGCopy on an RGBA copy of it, as it used to. Compare
+// their bytes allocated with -benchmem.
+func BenchmarkDrawJPEG(b *testing.B)     { benchmarkDrawJPEG(b, false) }
+func BenchmarkDrawJPEGCopy(b *testing.B) { benchmarkDrawJPEG(b, true) }
+
 func TestDefacerPool(t *testing.T) {
 	overlay, err := internal.DefaultDefaceImage()
 	if err != nil {
 		t.Fatal(err)
 	}
-	df, err := NewDefacerPool(NewImageResizer(overlay), 1)
+	df, err := NewDefacerPool(NewImageResizer(overlay, nil), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := internal.DefaultFaceBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = df.Deface(bytes.NewBuffer(src), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDefacerPoolTiles(t *testing.T) {
+	overlay, err := internal.DefaultDefaceImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	df, err := NewDefacerPool(NewImageResizer(overlay, nil), 4)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -39,7 +261,8 @@ func TestDefacerPool(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = df.Deface(bytes.NewBuffer(src))
+	opts := &DefaceOptions{TileSize: 100}
+	_, err = df.Deface(bytes.NewBuffer(src), opts)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,263 @@
+// Package defacerpb provides the messages, client and service
+// registration of the defacer gRPC service, described in defacer.proto.
+//
+// The types are written by hand to match defacer.proto, and must be
+// kept in sync with it. They are encoded by the protobuf package from
+// their struct tags.
+package defacerpb
+
+import (
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// DefaceRequest is an image to deface, with the same options as the
+// query params of the HTTP deface endpoint.
+type DefaceRequest struct {
+	Image       []byte `protobuf:"bytes,1,opt,name=image,proto3" json:"image,omitempty"`
+	Overlay     string `protobuf:"bytes,2,opt,name=overlay" json:"overlay,omitempty"`
+	Format      string `protobuf:"bytes,3,opt,name=format" json:"format,omitempty"`
+	Quality     int32  `protobuf:"varint,4,opt,name=quality" json:"quality,omitempty"`
+	Compression string `protobuf:"bytes,5,opt,name=compression" json:"compression,omitempty"`
+	Colors      int32  `protobuf:"varint,6,opt,name=colors" json:"colors,omitempty"`
+	Quantizer   string `protobuf:"bytes,7,opt,name=quantizer" json:"quantizer,omitempty"`
+}
+
+func (m *DefaceRequest) Reset()         { *m = DefaceRequest{} }
+func (m *DefaceRequest) String() string { return proto.CompactTextString(m) }
+func (*DefaceRequest) ProtoMessage()    {}
+
+// DefaceResponse is a defaced image. Passthrough is set when the
+// image is the source, because no faces were found.
+type DefaceResponse struct {
+	Image       []byte  `protobuf:"bytes,1,opt,name=image,proto3" json:"image,omitempty"`
+	ContentType string  `protobuf:"bytes,2,opt,name=content_type" json:"content_type,omitempty"`
+	Faces       []*Face `protobuf:"bytes,3,rep,name=faces" json:"faces,omitempty"`
+	Passthrough bool    `protobuf:"varint,4,opt,name=passthrough" json:"passthrough,omitempty"`
+}
+
+func (m *DefaceResponse) Reset()         { *m = DefaceResponse{} }
+func (m *DefaceResponse) String() string { return proto.CompactTextString(m) }
+func (*DefaceResponse) ProtoMessage()    {}
+
+// DetectRequest is an image to scan for faces.
+type DetectRequest struct {
+	Image []byte `protobuf:"bytes,1,opt,name=image,proto3" json:"image,omitempty"`
+}
+
+func (m *DetectRequest) Reset()         { *m = DetectRequest{} }
+func (m *DetectRequest) String() string { return proto.CompactTextString(m) }
+func (*DetectRequest) ProtoMessage()    {}
+
+// DetectResponse has the faces found in an image, and its format
+// and size.
+type DetectResponse struct {
+	Format string  `protobuf:"bytes,1,opt,name=format" json:"format,omitempty"`
+	Width  int32   `protobuf:"varint,2,opt,name=width" json:"width,omitempty"`
+	Height int32   `protobuf:"varint,3,opt,name=height" json:"height,omitempty"`
+	Faces  []*Face `protobuf:"bytes,4,rep,name=faces" json:"faces,omitempty"`
+}
+
+func (m *DetectResponse) Reset()         { *m = DetectResponse{} }
+func (m *DetectResponse) String() string { return proto.CompactTextString(m) }
+func (*DetectResponse) ProtoMessage()    {}
+
+// Face is the bounding box of a face, in pixels.
+type Face struct {
+	X      int32 `protobuf:"varint,1,opt,name=x" json:"x,omitempty"`
+	Y      int32 `protobuf:"varint,2,opt,name=y" json:"y,omitempty"`
+	Width  int32 `protobuf:"varint,3,opt,name=width" json:"width,omitempty"`
+	Height int32 `protobuf:"varint,4,opt,name=height" json:"height,omitempty"`
+}
+
+func (m *Face) Reset()         { *m = Face{} }
+func (m *Face) String() string { return proto.CompactTextString(m) }
+func (*Face) ProtoMessage()    {}
+
+// DefaceBatchResponse has the results of a batch, in request order.
+type DefaceBatchResponse struct {
+	Results []*DefaceBatchResult `protobuf:"bytes,1,rep,name=results" json:"results,omitempty"`
+}
+
+func (m *DefaceBatchResponse) Reset()         { *m = DefaceBatchResponse{} }
+func (m *DefaceBatchResponse) String() string { return proto.CompactTextString(m) }
+func (*DefaceBatchResponse) ProtoMessage()    {}
+
+// DefaceBatchResult is the result of an image of a batch. Code is the
+// gRPC status code of the image, and Response is only set if it's OK.
+type DefaceBatchResult struct {
+	Code     int32           `protobuf:"varint,1,opt,name=code" json:"code,omitempty"`
+	Error    string          `protobuf:"bytes,2,opt,name=error" json:"error,omitempty"`
+	Response *DefaceResponse `protobuf:"bytes,3,opt,name=response" json:"response,omitempty"`
+}
+
+func (m *DefaceBatchResult) Reset()         { *m = DefaceBatchResult{} }
+func (m *DefaceBatchResult) String() string { return proto.CompactTextString(m) }
+func (*DefaceBatchResult) ProtoMessage()    {}
+
+// DefacerClient is the client API of the Defacer service.
+type DefacerClient interface {
+	Deface(ctx context.Context, in *DefaceRequest, opts ...grpc.CallOption) (*DefaceResponse, error)
+	Detect(ctx context.Context, in *DetectRequest, opts ...grpc.CallOption) (*DetectResponse, error)
+	DefaceBatch(ctx context.Context, opts ...grpc.CallOption) (Defacer_DefaceBatchClient, error)
+}
+
+type defacerClient struct {
+	cc *grpc.ClientConn
+}
+
+// NewDefacerClient returns a client of the Defacer service.
+func NewDefacerClient(cc *grpc.ClientConn) DefacerClient {
+	return &defacerClient{cc}
+}
+
+func (c *defacerClient) Deface(ctx context.Context, in *DefaceRequest, opts ...grpc.CallOption) (*DefaceResponse, error) {
+	out := new(DefaceResponse)
+	err := grpc.Invoke(ctx, "/defacer.Defacer/Deface", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *defacerClient) Detect(ctx context.Context, in *DetectRequest, opts ...grpc.CallOption) (*DetectResponse, error) {
+	out := new(DetectResponse)
+	err := grpc.Invoke(ctx, "/defacer.Defacer/Detect", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *defacerClient) DefaceBatch(ctx context.Context, opts ...grpc.CallOption) (Defacer_DefaceBatchClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &serviceDesc.Streams[0], c.cc, "/defacer.Defacer/DefaceBatch", opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &defacerDefaceBatchClient{stream}, nil
+}
+
+// Defacer_DefaceBatchClient is the client stream of DefaceBatch.
+type Defacer_DefaceBatchClient interface {
+	Send(*DefaceRequest) error
+	CloseAndRecv() (*DefaceBatchResponse, error)
+	grpc.ClientStream
+}
+
+type defacerDefaceBatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *defacerDefaceBatchClient) Send(m *DefaceRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *defacerDefaceBatchClient) CloseAndRecv() (*DefaceBatchResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(DefaceBatchResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// DefacerServer is the server API of the Defacer service.
+type DefacerServer interface {
+	Deface(context.Context, *DefaceRequest) (*DefaceResponse, error)
+	Detect(context.Context, *DetectRequest) (*DetectResponse, error)
+	DefaceBatch(Defacer_DefaceBatchServer) error
+}
+
+// RegisterDefacerServer registers srv as the Defacer service of s.
+func RegisterDefacerServer(s *grpc.Server, srv DefacerServer) {
+	s.RegisterService(&serviceDesc, srv)
+}
+
+func defaceHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DefaceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DefacerServer).Deface(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/defacer.Defacer/Deface",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DefacerServer).Deface(ctx, req.(*DefaceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func detectHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DetectRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DefacerServer).Detect(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/defacer.Defacer/Detect",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DefacerServer).Detect(ctx, req.(*DetectRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func defaceBatchHandler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(DefacerServer).DefaceBatch(&defacerDefaceBatchServer{stream})
+}
+
+// Defacer_DefaceBatchServer is the server stream of DefaceBatch.
+type Defacer_DefaceBatchServer interface {
+	SendAndClose(*DefaceBatchResponse) error
+	Recv() (*DefaceRequest, error)
+	grpc.ServerStream
+}
+
+type defacerDefaceBatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *defacerDefaceBatchServer) SendAndClose(m *DefaceBatchResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *defacerDefaceBatchServer) Recv() (*DefaceRequest, error) {
+	m := new(DefaceRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: "defacer.Defacer",
+	HandlerType: (*DefacerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Deface",
+			Handler:    defaceHandler,
+		},
+		{
+			MethodName: "Detect",
+			Handler:    detectHandler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "DefaceBatch",
+			Handler:       defaceBatchHandler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "defacer.proto",
+}
@@ -0,0 +1,142 @@
+package apiserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+)
+
+// errNotImage is returned when the upstream of an image is not one.
+var errNotImage = errors.New("Upstream is not an image")
+
+// detector is the face detection endpoint. It returns the faces of an
+// upstream image, or of the image in the request body, as JSON.
+type detector struct {
+	*proxy
+}
+
+// detection is the JSON response of the detection endpoint.
+type detection struct {
+	Format string         `json:"format"`
+	Width  int            `json:"width"`
+	Height int            `json:"height"`
+	Faces  []detectedFace `json:"faces"`
+}
+
+// detectedFace is the bounding box of a face, in pixels.
+type detectedFace struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (d *detector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status, err := d.handler(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+}
+
+func (d *detector) handler(w http.ResponseWriter, r *http.Request) (int, error) {
+	opts, _, err := d.options(r.URL.Query().Get)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	var det *detection
+	if r.Method == "POST" {
+		img, status, err := d.readImage(w, r)
+		if err != nil {
+			return status, err
+		}
+		if _, status, err = d.sniffImage(img); err != nil {
+			return status, err
+		}
+		if det, err = d.detect(bytes.NewReader(img), opts); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	} else {
+		u := r.URL.Query().Get("url")
+		if u == "" {
+			return http.StatusBadRequest, errors.New("Missing `url` param")
+		}
+		resp, err := d.req(u, r, nil)
+		if err != nil {
+			return http.StatusServiceUnavailable, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return http.StatusBadGateway, fmt.Errorf("Upstream returned %s", resp.Status)
+		}
+		body := bufio.NewReader(resp.Body)
+		if formatByContentType(resp.Header.Get("Content-Type")) == nil {
+			head, _ := body.Peek(sniffLen)
+			if sniffFormat(head) == nil {
+				return http.StatusBadGateway, errNotImage
+			}
+		}
+		if d.MaxBytes > 0 && resp.ContentLength > d.MaxBytes {
+			return http.StatusBadGateway, errImageTooLarge
+		}
+		var in io.Reader = body
+		var limit *maxBytesReader
+		if d.MaxBytes > 0 {
+			limit = &maxBytesReader{R: body, N: d.MaxBytes}
+			in = limit
+		}
+		det, err = d.detect(in, opts)
+		switch {
+		case limit != nil && limit.Exceeded:
+			return http.StatusBadGateway, errImageTooLarge
+		case err != nil:
+			return http.StatusInternalServerError, err
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(det)
+	return 0, nil
+}
+
+// detect returns the faces of the image read from r.
+func (p *proxy) detect(r io.Reader, opts *DefaceOptions) (*detection, error) {
+	o := *opts
+	o.KeepSource = false
+	o.DetectOnly = true
+	res, err := p.Defacer.Deface(r, &o)
+	if err != nil {
+		return nil, err
+	}
+	b := res.Image.Bounds()
+	return &detection{
+		Format: res.Format,
+		Width:  b.Dx(),
+		Height: b.Dy(),
+		Faces:  detectedFaces(res.Faces),
+	}, nil
+}
+
+// detectedFaces returns the faces of rects.
+func detectedFaces(rects []image.Rectangle) []detectedFace {
+	faces := make([]detectedFace, len(rects))
+	for i, r := range rects {
+		faces[i] = detectedFace{
+			X:      r.Min.X,
+			Y:      r.Min.Y,
+			Width:  r.Dx(),
+			Height: r.Dy(),
+		}
+	}
+	return faces
+}
@@ -0,0 +1,59 @@
+package apiserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func serveDetect(d *detector, method, query string, body []byte) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest(method, "/v1/detect?"+query, bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	d.ServeHTTP(w, r)
+	return w
+}
+
+func TestDetect(t *testing.T) {
+	src := blankPNG(t)
+	upstream := newTestUpstream("image/png", src)
+	defer upstream.Close()
+	d := &detector{proxy: newTestProxy(t)}
+	for _, w := range []*httptest.ResponseRecorder{
+		serveDetect(d, "GET", "url="+url.QueryEscape(upstream.URL), nil),
+		serveDetect(d, "POST", "max_detect_size=32", src),
+	} {
+		if w.Code != http.StatusOK {
+			t.Fatal("unexpected status:", w.Code, w.Body.String())
+		}
+		var det detection
+		if err := json.NewDecoder(w.Body).Decode(&det); err != nil {
+			t.Fatal(err)
+		}
+		if det.Format != "png" || det.Width != 64 || det.Height != 64 || det.Faces == nil {
+			t.Fatal("unexpected detection:", det)
+		}
+	}
+}
+
+func TestDetectInvalid(t *testing.T) {
+	upstream := newTestUpstream("text/plain", []byte("not an image"))
+	defer upstream.Close()
+	d := &detector{proxy: newTestProxy(t)}
+	for _, tc := range []struct {
+		method, query string
+		status        int
+	}{
+		{"GET", "", http.StatusBadRequest},
+		{"GET", "url=" + url.QueryEscape(upstream.URL), http.StatusBadGateway},
+		{"GET", "url=" + url.QueryEscape(upstream.URL+"/img.png") + "&max_detect_size=0", http.StatusBadRequest},
+		{"POST", "", http.StatusBadRequest},
+		{"PUT", "", http.StatusMethodNotAllowed},
+	} {
+		if w := serveDetect(d, tc.method, tc.query, nil); w.Code != tc.status {
+			t.Errorf("%s %q: unexpected status: %d", tc.method, tc.query, w.Code)
+		}
+	}
+}
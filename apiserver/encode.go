@@ -0,0 +1,435 @@
+package apiserver
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"sort"
+	"strconv"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+// EncodeOptions configure the encoding of defaced images.
+type EncodeOptions struct {
+	JPEGQuality    int                  // 1-100, default: jpeg.DefaultQuality
+	PNGCompression png.CompressionLevel // default: png.DefaultCompression
+	GIFColors      int                  // 1-256, default: 256
+	GIFQuantizer   string               // see GIFQuantizers, default: "plan9"
+}
+
+// encoderFunc is an adapter function for image encoders.
+type encoderFunc func(w io.Writer, m image.Image, o *EncodeOptions) error
+
+// imageFormat is an image format known to the proxy. Formats without
+// an encoder can be defaced, but not served.
+type imageFormat struct {
+	Name        string
+	ContentType string
+	Encode      encoderFunc // nil for decode-only formats
+	Aliases     []string    // other content types of the format
+	Magic       []string    // signatures, '?' matches any byte
+}
+
+// imageFormats are the supported image formats, indexed by name.
+var imageFormats = map[string]*imageFormat{
+	"bmp": {
+		Name:        "bmp",
+		ContentType: "image/bmp",
+		Encode:      encodeBMP,
+		Aliases:     []string{"image/x-bmp", "image/x-ms-bmp"},
+		Magic:       []string{"BM????\x00\x00\x00\x00"},
+	},
+	"gif": {
+		Name:        "gif",
+		ContentType: "image/gif",
+		Encode:      encodeGIF,
+		Magic:       []string{"GIF87a", "GIF89a"},
+	},
+	"jpeg": {
+		Name:        "jpeg",
+		ContentType: "image/jpeg",
+		Encode:      encodeJPEG,
+		Aliases:     []string{"image/jpg", "image/pjpeg"},
+		Magic:       []string{"\xff\xd8"},
+	},
+	"png": {
+		Name:        "png",
+		ContentType: "image/png",
+		Encode:      encodePNG,
+		Magic:       []string{"\x89PNG\r\n\x1a\n"},
+	},
+	"tiff": {
+		Name:        "tiff",
+		ContentType: "image/tiff",
+		Encode:      encodeTIFF,
+		Aliases:     []string{"image/x-tiff"},
+		Magic:       []string{"II*\x00", "MM\x00*"},
+	},
+	"webp": {
+		Name:        "webp",
+		ContentType: "image/webp",
+		Magic:       []string{"RIFF????WEBPVP8"},
+	},
+}
+
+// defaultOutputFormat is served for decode-only source formats.
+var defaultOutputFormat = imageFormats["png"]
+
+// imageFormatNames returns the sorted names of the output formats.
+func imageFormatNames() []string {
+	var names []string
+	for name, f := range imageFormats {
+		if f.Encode != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// outputFormat returns the format of the given name if it can be
+// served, or nil.
+func outputFormat(name string) *imageFormat {
+	if f := imageFormats[name]; f != nil && f.Encode != nil {
+		return f
+	}
+	return nil
+}
+
+// formatByContentType returns the image format of the given content
+// type, or nil if it's not supported.
+func formatByContentType(contentType string) *imageFormat {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	for _, f := range imageFormats {
+		if f.ContentType == mt {
+			return f
+		}
+		for _, alias := range f.Aliases {
+			if alias == mt {
+				return f
+			}
+		}
+	}
+	return nil
+}
+
+// sniffLen is the number of bytes needed by sniffFormat.
+const sniffLen = 16
+
+// sniffFormat returns the image format of the data that starts with
+// the given bytes, or nil if it's not supported.
+func sniffFormat(b []byte) *imageFormat {
+	for _, f := range imageFormats {
+		for _, magic := range f.Magic {
+			if matchMagic(magic, b) {
+				return f
+			}
+		}
+	}
+	return nil
+}
+
+// matchMagic reports whether b starts with magic.
+func matchMagic(magic string, b []byte) bool {
+	if len(b) < len(magic) {
+		return false
+	}
+	for i, c := range b[:len(magic)] {
+		if magic[i] != c && magic[i] != '?' {
+			return false
+		}
+	}
+	return true
+}
+
+func encodeJPEG(w io.Writer, m image.Image, o *EncodeOptions) error {
+	q := o.JPEGQuality
+	if q == 0 {
+		q = jpeg.DefaultQuality
+	}
+	return jpeg.Encode(w, m, &jpeg.Options{Quality: q})
+}
+
+func encodePNG(w io.Writer, m image.Image, o *EncodeOptions) error {
+	enc := &png.Encoder{CompressionLevel: o.PNGCompression}
+	return enc.Encode(w, m)
+}
+
+func encodeBMP(w io.Writer, m image.Image, o *EncodeOptions) error {
+	return bmp.Encode(w, m)
+}
+
+func encodeTIFF(w io.Writer, m image.Image, o *EncodeOptions) error {
+	return tiff.Encode(w, m, &tiff.Options{Compression: tiff.Deflate, Predictor: true})
+}
+
+func encodeGIF(w io.Writer, m image.Image, o *EncodeOptions) error {
+	n := o.GIFColors
+	if n == 0 {
+		n = 256
+	}
+	q := gifQuantizers[o.GIFQuantizer]
+	if q == nil && n < len(palette.Plan9) {
+		// the encoder would use the first n colors of palette.Plan9
+		q = fixedQuantizer(palette.Plan9)
+	}
+	return gif.Encode(w, m, &gif.Options{NumColors: n, Quantizer: q})
+}
+
+// pngCompressionLevels are the names of the PNG compression levels.
+var pngCompressionLevels = map[string]png.CompressionLevel{
+	"default": png.DefaultCompression,
+	"none":    png.NoCompression,
+	"fast":    png.BestSpeed,
+	"best":    png.BestCompression,
+}
+
+// ParsePNGCompression returns the PNG compression level of the given
+// name: default, none, fast or best.
+func ParsePNGCompression(name string) (png.CompressionLevel, error) {
+	if name == "" {
+		return png.DefaultCompression, nil
+	}
+	c, ok := pngCompressionLevels[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown png compression %q", name)
+	}
+	return c, nil
+}
+
+// gifQuantizers are the palette quantizers for GIF images. The nil
+// quantizer makes the encoder use palette.Plan9, and is replaced by a
+// fixedQuantizer of it for fewer colors.
+var gifQuantizers = map[string]draw.Quantizer{
+	"":        nil,
+	"plan9":   nil,
+	"websafe": fixedQuantizer(palette.WebSafe),
+	"median":  medianCutQuantizer{},
+}
+
+// GIFQuantizers returns the names of the supported GIF quantizers.
+func GIFQuantizers() []string {
+	var names []string
+	for name := range gifQuantizers {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Validate checks that the options are within range.
+func (o *EncodeOptions) Validate() error {
+	if o.JPEGQuality < 0 || o.JPEGQuality > 100 {
+		return fmt.Errorf("jpeg quality %d out of range 1-100", o.JPEGQuality)
+	}
+	if o.GIFColors < 0 || o.GIFColors > 256 {
+		return fmt.Errorf("gif colors %d out of range 1-256", o.GIFColors)
+	}
+	if _, ok := gifQuantizers[o.GIFQuantizer]; !ok {
+		return fmt.Errorf("unknown gif quantizer %q", o.GIFQuantizer)
+	}
+	return nil
+}
+
+// parseEncodeOptions overrides the given options with the ones set in
+// the query params of an HTTP request: quality, compression, colors
+// and quantizer.
+func parseEncodeOptions(o EncodeOptions, get func(string) string) (*EncodeOptions, error) {
+	var err error
+	if v := get("quality"); v != "" {
+		if o.JPEGQuality, err = strconv.Atoi(v); err != nil || o.JPEGQuality == 0 {
+			return nil, fmt.Errorf("Invalid `quality` param: %q", v)
+		}
+	}
+	if v := get("compression"); v != "" {
+		if o.PNGCompression, err = ParsePNGCompression(v); err != nil {
+			return nil, fmt.Errorf("Invalid `compression` param: %q", v)
+		}
+	}
+	if v := get("colors"); v != "" {
+		if o.GIFColors, err = strconv.Atoi(v); err != nil || o.GIFColors == 0 {
+			return nil, fmt.Errorf("Invalid `colors` param: %q", v)
+		}
+	}
+	if v := get("quantizer"); v != "" {
+		o.GIFQuantizer = v
+	}
+	if err = o.Validate(); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// fixedQuantizer is a quantizer that returns colors of a fixed
+// palette. When fewer colors fit, the ones nearest to most pixels of
+// the image are returned.
+type fixedQuantizer color.Palette
+
+// Quantize implements the draw.Quantizer interface.
+func (q fixedQuantizer) Quantize(p color.Palette, m image.Image) color.Palette {
+	n := cap(p) - len(p)
+	if n >= len(q) {
+		return append(p, q...)
+	}
+	if n <= 0 {
+		return p
+	}
+	b := m.Bounds()
+	step := sampleStep(b)
+	counts := make([]int, len(q))
+	for y := b.Min.Y; y < b.Max.Y; y += step {
+		for x := b.Min.X; x < b.Max.X; x += step {
+			counts[color.Palette(q).Index(m.At(x, y))]++
+		}
+	}
+	order := make([]int, len(q))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Sort(colorCountSorter{order, counts})
+	for _, i := range order[:n] {
+		p = append(p, q[i])
+	}
+	return p
+}
+
+// sampleStep returns the step between the pixels of b sampled by
+// quantizers, so that up to 64k pixels are sampled.
+func sampleStep(b image.Rectangle) int {
+	step := 1
+	for (b.Dx()/step)*(b.Dy()/step) > 1<<16 {
+		step++
+	}
+	return step
+}
+
+// medianCutQuantizer builds a palette by recursively splitting the
+// box of image colors with the largest range at its median.
+type medianCutQuantizer struct{}
+
+// Quantize implements the draw.Quantizer interface.
+func (medianCutQuantizer) Quantize(p color.Palette, m image.Image) color.Palette {
+	n := cap(p) - len(p)
+	if n <= 0 {
+		return p
+	}
+	b := m.Bounds()
+	step := sampleStep(b)
+	var px colorBox
+	for y := b.Min.Y; y < b.Max.Y; y += step {
+		for x := b.Min.X; x < b.Max.X; x += step {
+			c := color.RGBAModel.Convert(m.At(x, y)).(color.RGBA)
+			px = append(px, [4]uint8{c.R, c.G, c.B, c.A})
+		}
+	}
+	if len(px) == 0 {
+		return p
+	}
+	boxes := []colorBox{px}
+	for len(boxes) < n {
+		i, ch := 0, -1
+		max := uint8(0)
+		for j, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			if c, r := box.widest(); ch < 0 || r > max {
+				i, ch, max = j, c, r
+			}
+		}
+		if ch < 0 || max == 0 {
+			break
+		}
+		box := boxes[i]
+		sort.Sort(colorBoxSorter{box, ch})
+		boxes[i] = box[:len(box)/2]
+		boxes = append(boxes, box[len(box)/2:])
+	}
+	for _, box := range boxes {
+		p = append(p, box.mean())
+	}
+	return p
+}
+
+// colorBox is a set of RGBA colors.
+type colorBox [][4]uint8
+
+// widest returns the channel with the largest range, and the range.
+func (box colorBox) widest() (int, uint8) {
+	lo := [4]uint8{255, 255, 255, 255}
+	var hi [4]uint8
+	for _, c := range box {
+		for i, v := range c {
+			if v < lo[i] {
+				lo[i] = v
+			}
+			if v > hi[i] {
+				hi[i] = v
+			}
+		}
+	}
+	ch, r := 0, uint8(0)
+	for i := range lo {
+		if hi[i]-lo[i] > r {
+			ch, r = i, hi[i]-lo[i]
+		}
+	}
+	return ch, r
+}
+
+// mean returns the average color of the box.
+func (box colorBox) mean() color.Color {
+	var sum [4]int
+	for _, c := range box {
+		for i, v := range c {
+			sum[i] += int(v)
+		}
+	}
+	n := len(box)
+	return color.RGBA{
+		uint8(sum[0] / n),
+		uint8(sum[1] / n),
+		uint8(sum[2] / n),
+		uint8(sum[3] / n),
+	}
+}
+
+// colorBoxSorter sorts a colorBox by one of its channels.
+type colorBoxSorter struct {
+	box colorBox
+	ch  int
+}
+
+func (s colorBoxSorter) Len() int           { return len(s.box) }
+func (s colorBoxSorter) Less(i, j int) bool { return s.box[i][s.ch] < s.box[j][s.ch] }
+func (s colorBoxSorter) Swap(i, j int)      { s.box[i], s.box[j] = s.box[j], s.box[i] }
+
+// colorCountSorter sorts palette indexes by descending pixel count.
+type colorCountSorter struct {
+	order  []int
+	counts []int
+}
+
+func (s colorCountSorter) Len() int      { return len(s.order) }
+func (s colorCountSorter) Swap(i, j int) { s.order[i], s.order[j] = s.order[j], s.order[i] }
+func (s colorCountSorter) Less(i, j int) bool {
+	a, b := s.order[i], s.order[j]
+	if s.counts[a] != s.counts[b] {
+		return s.counts[a] > s.counts[b]
+	}
+	return a < b
+}
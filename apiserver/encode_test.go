@@ -0,0 +1,146 @@
+package apiserver
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"net/url"
+	"testing"
+)
+
+func TestParseEncodeOptions(t *testing.T) {
+	defaults := EncodeOptions{JPEGQuality: 80}
+	o, err := parseEncodeOptions(defaults, url.Values{}.Get)
+	if err != nil || *o != defaults {
+		t.Fatal("unexpected options:", o, err)
+	}
+	o, err = parseEncodeOptions(defaults, url.Values{
+		"quality":     {"90"},
+		"compression": {"best"},
+		"colors":      {"16"},
+		"quantizer":   {"median"},
+	}.Get)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.JPEGQuality != 90 || o.GIFColors != 16 || o.GIFQuantizer != "median" {
+		t.Fatal("unexpected options:", o)
+	}
+	for _, v := range []url.Values{
+		{"quality": {"101"}},
+		{"quality": {"high"}},
+		{"compression": {"max"}},
+		{"colors": {"0"}},
+		{"colors": {"257"}},
+		{"quantizer": {"octree"}},
+	} {
+		if _, err = parseEncodeOptions(defaults, v.Get); err == nil {
+			t.Fatal("invalid options accepted:", v)
+		}
+	}
+}
+
+func TestEncodeGIF(t *testing.T) {
+	m := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			m.Set(x, y, color.RGBA{uint8(4 * x), uint8(4 * y), 0x80, 0xff})
+		}
+	}
+	for _, q := range GIFQuantizers() {
+		var b bytes.Buffer
+		o := &EncodeOptions{GIFColors: 16, GIFQuantizer: q}
+		if err := encodeGIF(&b, m, o); err != nil {
+			t.Fatal(err)
+		}
+		g, err := gif.Decode(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := len(g.ColorModel().(color.Palette)); n > 16 {
+			t.Fatalf("%s: unexpected palette size: %d", q, n)
+		}
+		// mean error per channel
+		var sum int
+		for y := 0; y < 64; y++ {
+			for x := 0; x < 64; x++ {
+				a := m.RGBAAt(x, y)
+				r, g, b, _ := g.At(x, y).RGBA()
+				sum += absDiff(int(a.R), int(r>>8)) + absDiff(int(a.G), int(g>>8)) + absDiff(int(a.B), int(b>>8))
+			}
+		}
+		if e := sum / (64 * 64 * 3); e > 24 {
+			t.Errorf("%s: unexpected error: %d", q, e)
+		}
+	}
+}
+
+func TestFormatByContentType(t *testing.T) {
+	for contentType, name := range map[string]string{
+		"image/jpeg":               "jpeg",
+		"image/pjpeg":              "jpeg",
+		"image/x-ms-bmp":           "bmp",
+		"image/tiff":               "tiff",
+		"image/webp":               "webp",
+		"image/png; charset=utf-8": "png",
+		"text/html":                "",
+		"":                         "",
+	} {
+		f := formatByContentType(contentType)
+		if (f == nil && name != "") || (f != nil && f.Name != name) {
+			t.Fatalf("%q: unexpected format: %v", contentType, f)
+		}
+	}
+}
+
+func TestSniffFormat(t *testing.T) {
+	for head, name := range map[string]string{
+		"\x89PNG\r\n\x1a\n\x00\x00":          "png",
+		"GIF89a\x01\x00":                     "gif",
+		"\xff\xd8\xff\xe0":                   "jpeg",
+		"BM\x36\x30\x00\x00\x00\x00\x00\x00": "bmp",
+		"II*\x00\x08\x00":                    "tiff",
+		"MM\x00*\x00\x08":                    "tiff",
+		"RIFF\x24\x00\x00\x00WEBPVP8L":       "webp",
+		"RIFF\x24\x00\x00\x00WAVEfmt ":       "",
+		"BM":                                 "",
+		"<html>":                             "",
+	} {
+		f := sniffFormat([]byte(head))
+		if (f == nil && name != "") || (f != nil && f.Name != name) {
+			t.Fatalf("%q: unexpected format: %v", head, f)
+		}
+	}
+}
+
+func TestEncodeFormats(t *testing.T) {
+	m := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	m.Set(1, 1, color.White)
+	for _, name := range imageFormatNames() {
+		var b bytes.Buffer
+		if err := imageFormats[name].Encode(&b, m, &EncodeOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if f := sniffFormat(b.Bytes()); f == nil || f.Name != name {
+			t.Fatalf("%s: unexpected sniffed format: %v", name, f)
+		}
+		_, f, err := image.Decode(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f != name {
+			t.Fatalf("%s: unexpected image format: %q", name, f)
+		}
+	}
+	if outputFormat("webp") != nil {
+		t.Fatal("webp has no encoder")
+	}
+}
+
+func absDiff(a, b int) int {
+	if a < b {
+		return b - a
+	}
+	return a - b
+}
@@ -0,0 +1,107 @@
+package apiserver
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+)
+
+// etagPrefix returns the prefix of the ETags of images defaced for
+// the given request, with the format negotiated from the given Accept
+// header if not set. The ETag of a defaced image is the prefix
+// followed by the opaque tag of the upstream image, so that
+// conditional requests can be forwarded upstream. The prefix is also
+// part of the result cache key, see negotiationKey.
+func (p *proxy) etagPrefix(dr *defaceRequest, accept string) string {
+	format := "accept:" + negotiationKey(accept)
+	if dr.Format != nil {
+		format = dr.Format.Name
+	}
+	opts := dr.Options
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\n%s\n%t %d %d %d\n%+v\n%+v",
+		format, dr.Overlay,
+		opts.KeepSource, opts.MaxDetectSize, opts.TileSize, opts.TileOverlap,
+		*dr.Encode, p.Metadata,
+	)
+	return fmt.Sprintf("df-%016x-", h.Sum64())
+}
+
+// defacedETag returns the weak ETag of an image defaced from the
+// upstream image with the given ETag. Defaced images are only
+// semantically equivalent, as overlays may be picked at random.
+func defacedETag(prefix, upstream string) string {
+	return `W/"` + prefix + etagOpaque(upstream) + `"`
+}
+
+// etagOpaque returns the opaque tag of an ETag, without the weak
+// indicator and quotes.
+func etagOpaque(etag string) string {
+	etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+	return strings.Trim(etag, `"`)
+}
+
+// parseETags returns the entity tags of an If-None-Match header.
+func parseETags(header string) []string {
+	var tags []string
+	for s := strings.TrimSpace(header); s != ""; s = strings.TrimLeft(s, ", \t") {
+		if s[0] == '*' {
+			tags = append(tags, "*")
+			s = s[1:]
+			continue
+		}
+		start := 0
+		if strings.HasPrefix(s, "W/") {
+			start = 2
+		}
+		if len(s) <= start || s[start] != '"' {
+			break
+		}
+		end := strings.IndexByte(s[start+1:], '"')
+		if end < 0 {
+			break
+		}
+		end += start + 2
+		tags = append(tags, s[:end])
+		s = s[end:]
+	}
+	return tags
+}
+
+// etagMatch reports whether the If-None-Match header matches the
+// given ETag, using the weak comparison function.
+func etagMatch(header, etag string) bool {
+	for _, tag := range parseETags(header) {
+		if tag == "*" || etagOpaque(tag) == etagOpaque(etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamConditions returns the conditional headers of r to send
+// upstream. Tags of defaced images with the given prefix are replaced
+// by the upstream tags, and tags of images defaced with other options
+// are dropped. If-Modified-Since is never sent, as defaced images have
+// no Last-Modified, and an upstream 304 for a date the proxy can't
+// check would not be for the image the client has.
+func upstreamConditions(r *http.Request, prefix string) http.Header {
+	h := http.Header{}
+	var tags []string
+	for _, tag := range parseETags(r.Header.Get("If-None-Match")) {
+		opaque := etagOpaque(tag)
+		switch {
+		case strings.HasPrefix(opaque, prefix):
+			tags = append(tags, `"`+strings.TrimPrefix(opaque, prefix)+`"`)
+		case strings.HasPrefix(opaque, "df-"):
+			continue
+		default:
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > 0 {
+		h.Set("If-None-Match", strings.Join(tags, ", "))
+	}
+	return h
+}
@@ -0,0 +1,73 @@
+package apiserver
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseETags(t *testing.T) {
+	tests := map[string][]string{
+		``:                      nil,
+		`*`:                     {`*`},
+		`"a"`:                   {`"a"`},
+		`"a", W/"b,c" ,"d"`:     {`"a"`, `W/"b,c"`, `"d"`},
+		`W/"a", invalid, "b"`:   {`W/"a"`},
+		`"unterminated, "x`:     {`"unterminated, "`},
+		`W/"df-0123-a", *, "b"`: {`W/"df-0123-a"`, `*`, `"b"`},
+	}
+	for header, want := range tests {
+		if tags := parseETags(header); !reflect.DeepEqual(tags, want) {
+			t.Errorf("%q: want %q, have %q", header, want, tags)
+		}
+	}
+}
+
+func TestETagMatch(t *testing.T) {
+	etag := defacedETag("df-0123-", `"v1"`)
+	if etag != `W/"df-0123-v1"` {
+		t.Fatal("unexpected etag:", etag)
+	}
+	for header, want := range map[string]bool{
+		``:                    false,
+		`*`:                   true,
+		`"df-0123-v1"`:        true,
+		`"x", W/"df-0123-v1"`: true,
+		`W/"df-0123-v2"`:      false,
+		`"v1"`:                false,
+	} {
+		if etagMatch(header, etag) != want {
+			t.Errorf("%q: want %t", header, want)
+		}
+	}
+}
+
+func TestUpstreamConditions(t *testing.T) {
+	prefix := "df-0123-"
+	tests := []struct {
+		INM, IMS string
+		Want     http.Header
+	}{
+		{"", "", http.Header{}},
+		{"", "Mon, 02 Jan 2006 15:04:05 GMT", http.Header{}},
+		{`W/"df-0123-v1"`, "Mon, 02 Jan 2006 15:04:05 GMT", http.Header{
+			"If-None-Match": {`"v1"`},
+		}},
+		{`W/"df-0123-v1", W/"df-4567-v2", "raw"`, "", http.Header{
+			"If-None-Match": {`"v1", "raw"`},
+		}},
+		{`W/"df-4567-v2"`, "", http.Header{}},
+	}
+	for _, tc := range tests {
+		r, _ := http.NewRequest("GET", "/", nil)
+		if tc.INM != "" {
+			r.Header.Set("If-None-Match", tc.INM)
+		}
+		if tc.IMS != "" {
+			r.Header.Set("If-Modified-Since", tc.IMS)
+		}
+		if h := upstreamConditions(r, prefix); !reflect.DeepEqual(h, tc.Want) {
+			t.Errorf("%q %q: want %v, have %v", tc.INM, tc.IMS, tc.Want, h)
+		}
+	}
+}
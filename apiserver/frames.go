@@ -0,0 +1,95 @@
+package apiserver
+
+import "encoding/binary"
+
+// multiFrame reports whether the encoded image b of the given format
+// has more than one frame, such as animated GIFs and multi-page TIFFs.
+// Only the first frame is scanned for faces, so these images can't be
+// passed through. Images that can't be parsed are reported as multi
+// frame.
+func multiFrame(format string, b []byte) bool {
+	switch format {
+	case "gif":
+		return gifFrames(b) != 1
+	case "tiff":
+		return tiffPages(b) != 1
+	}
+	return false
+}
+
+// gifFrames returns the number of image descriptors of the GIF image
+// b, or -1 if it can't be parsed.
+func gifFrames(b []byte) int {
+	if len(b) < 13 {
+		return -1
+	}
+	i := 13
+	if flags := b[10]; flags&0x80 != 0 {
+		i += 3 << (flags&7 + 1) // global color table
+	}
+	frames := 0
+	for i < len(b) {
+		switch b[i] {
+		case 0x21: // extension
+			i += 2
+		case 0x2c: // image descriptor
+			if i+10 > len(b) {
+				return -1
+			}
+			if flags := b[i+9]; flags&0x80 != 0 {
+				i += 3 << (flags&7 + 1) // local color table
+			}
+			i += 11 // descriptor and LZW minimum code size
+			frames++
+		case 0x3b: // trailer
+			return frames
+		default:
+			return -1
+		}
+		// data sub-blocks
+		for {
+			if i >= len(b) {
+				return -1
+			}
+			n := int(b[i])
+			i += n + 1
+			if n == 0 {
+				break
+			}
+		}
+	}
+	// decoders accept GIF images without a trailer
+	return frames
+}
+
+// tiffPages returns the number of IFDs of the TIFF image b, or -1 if
+// it can't be parsed.
+func tiffPages(b []byte) int {
+	if len(b) < 8 {
+		return -1
+	}
+	var order binary.ByteOrder
+	switch string(b[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return -1
+	}
+	pages := 0
+	seen := map[uint32]bool{}
+	for off := order.Uint32(b[4:]); off != 0; pages++ {
+		if seen[off] || uint64(off)+2 > uint64(len(b)) {
+			return -1
+		}
+		seen[off] = true
+		n := uint64(order.Uint16(b[off:]))
+		next := uint64(off) + 2 + 12*n
+		if next+4 > uint64(len(b)) {
+			return -1
+		}
+		off = order.Uint32(b[next:])
+	}
+	return pages
+}
@@ -0,0 +1,50 @@
+package apiserver
+
+import (
+	"bytes"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"testing"
+
+	"golang.org/x/image/tiff"
+)
+
+func TestMultiFrame(t *testing.T) {
+	m := image.NewPaletted(image.Rect(0, 0, 4, 4), palette.Plan9[:16])
+	var single, anim, page bytes.Buffer
+	if err := gif.Encode(&single, m, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := gif.EncodeAll(&anim, &gif.GIF{Image: []*image.Paletted{m, m, m}, Delay: []int{1, 1, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tiff.Encode(&page, m, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := gifFrames(anim.Bytes()); n != 3 {
+		t.Fatal("unexpected frames:", n)
+	}
+	// two IFDs without entries
+	pages := []byte("II*\x00\x08\x00\x00\x00\x00\x00\x0e\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+	loop := []byte("II*\x00\x08\x00\x00\x00\x00\x00\x08\x00\x00\x00")
+	for _, tc := range []struct {
+		format string
+		b      []byte
+		multi  bool
+	}{
+		{"gif", single.Bytes(), false},
+		{"gif", bytes.TrimSuffix(single.Bytes(), []byte{0x3b}), false},
+		{"gif", anim.Bytes(), true},
+		{"gif", single.Bytes()[:20], true},
+		{"tiff", page.Bytes(), false},
+		{"tiff", pages, true},
+		{"tiff", loop, true},
+		{"tiff", pages[:12], true},
+		{"png", nil, false},
+	} {
+		if v := multiFrame(tc.format, tc.b); v != tc.multi {
+			t.Errorf("%s %d bytes: want %t, have %t", tc.format, len(tc.b), tc.multi, v)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package apiserver
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/fiorix/defacer/apiserver/defacerpb"
+)
+
+// rpcServer is the defacer gRPC service. Images are sent in requests
+// rather than fetched from URLs, and defaced like the proxy does.
+type rpcServer struct {
+	*proxy
+	MaxBatch    int // max images per batch
+	Concurrency int // max images of a batch defaced at once
+}
+
+// rpcKeyHeader is the gRPC metadata key of API keys.
+const rpcKeyHeader = "x-defacer-key"
+
+// RegisterGRPC registers the defacer gRPC service to the given server.
+// The service shares the defacers and options of the HTTP API, so it
+// must be called after Register. API keys can't be checked without
+// interceptors, and neither can client limits, see NewGRPCServer.
+func (h *Handler) RegisterGRPC(s *grpc.Server) error {
+	if h.proxy == nil {
+		return errors.New("RegisterGRPC called before Register")
+	}
+	if h.keys != nil || h.limiter != nil {
+		return errors.New("API keys and client limits require a server from NewGRPCServer")
+	}
+	h.registerGRPC(s)
+	return nil
+}
+
+// NewGRPCServer returns a gRPC server with the defacer service, which
+// must be created after Register. When KeyFile is set, requests need
+// an API key in the x-defacer-key metadata, and every image counts for
+// its quota. Calls are limited per client like HTTP requests. The given
+// options must not set interceptors.
+func (h *Handler) NewGRPCServer(opt ...grpc.ServerOption) (*grpc.Server, error) {
+	if h.proxy == nil {
+		return nil, errors.New("NewGRPCServer called before Register")
+	}
+	var unary []grpc.UnaryServerInterceptor
+	var stream []grpc.StreamServerInterceptor
+	if h.keys != nil {
+		unary = append(unary, h.keys.unaryInterceptor)
+		stream = append(stream, h.keys.streamInterceptor)
+	}
+	if h.limiter != nil {
+		unary = append(unary, h.limiter.unaryInterceptor)
+		stream = append(stream, h.limiter.streamInterceptor)
+	}
+	if len(unary) > 0 {
+		opt = append(opt,
+			grpc.UnaryInterceptor(chainUnary(unary)),
+			grpc.StreamInterceptor(chainStream(stream)),
+		)
+	}
+	s := grpc.NewServer(opt...)
+	h.registerGRPC(s)
+	return s, nil
+}
+
+// chainUnary returns an interceptor that calls the given ones in order.
+func chainUnary(list []grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		next := handler
+		for i := len(list) - 1; i >= 0; i-- {
+			f, h := list[i], next
+			next = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return f(ctx, req, info, h)
+			}
+		}
+		return next(ctx, req)
+	}
+}
+
+// chainStream returns an interceptor that calls the given ones in order.
+func chainStream(list []grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		next := handler
+		for i := len(list) - 1; i >= 0; i-- {
+			f, h := list[i], next
+			next = func(srv interface{}, ss grpc.ServerStream) error {
+				return f(srv, ss, info, h)
+			}
+		}
+		return next(srv, ss)
+	}
+}
+
+func (h *Handler) registerGRPC(s *grpc.Server) {
+	defacerpb.RegisterDefacerServer(s, &rpcServer{
+		proxy:       h.proxy,
+		MaxBatch:    h.BatchSize,
+		Concurrency: h.BatchConcurrency,
+	})
+}
+
+// Deface implements the defacerpb.DefacerServer interface.
+func (s *rpcServer) Deface(ctx context.Context, in *defacerpb.DefaceRequest) (*defacerpb.DefaceResponse, error) {
+	resp, err := s.deface(in)
+	defacerGRPCRequestsSum.WithLabelValues("Deface", grpc.Code(err).String()).Inc()
+	return resp, err
+}
+
+// Detect implements the defacerpb.DefacerServer interface.
+func (s *rpcServer) Detect(ctx context.Context, in *defacerpb.DetectRequest) (*defacerpb.DetectResponse, error) {
+	resp, err := s.detect(in)
+	defacerGRPCRequestsSum.WithLabelValues("Detect", grpc.Code(err).String()).Inc()
+	return resp, err
+}
+
+// DefaceBatch implements the defacerpb.DefacerServer interface. Images
+// are defaced as they are received, up to Concurrency at a time.
+func (s *rpcServer) DefaceBatch(stream defacerpb.Defacer_DefaceBatchServer) error {
+	err := s.defaceBatch(stream)
+	defacerGRPCRequestsSum.WithLabelValues("DefaceBatch", grpc.Code(err).String()).Inc()
+	return err
+}
+
+func (s *rpcServer) defaceBatch(stream defacerpb.Defacer_DefaceBatchServer) error {
+	var results []*defacerpb.DefaceBatchResult
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	sem := make(chan struct{}, s.Concurrency)
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(results) == s.MaxBatch {
+			return grpc.Errorf(codes.InvalidArgument, "Too many images, max %d", s.MaxBatch)
+		}
+		res := &defacerpb.DefaceBatchResult{}
+		results = append(results, res)
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(in *defacerpb.DefaceRequest, res *defacerpb.DefaceBatchResult) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			resp, err := s.deface(in)
+			res.Code = int32(grpc.Code(err))
+			if err != nil {
+				res.Error = grpc.ErrorDesc(err)
+				return
+			}
+			res.Response = resp
+		}(in, res)
+	}
+	wg.Wait()
+	return stream.SendAndClose(&defacerpb.DefaceBatchResponse{Results: results})
+}
+
+// deface defaces the image of in, and encodes it in the requested
+// format, or in the source format when possible.
+func (s *rpcServer) deface(in *defacerpb.DefaceRequest) (*defacerpb.DefaceResponse, error) {
+	dr := &defaceRequest{}
+	if err := s.parseOptions(dr, rpcParams(in)); err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	res, status, err := s.defaceBytes(in.Image, dr, "")
+	if err != nil {
+		return nil, grpc.Errorf(rpcCode(status), "%v", err)
+	}
+	return &defacerpb.DefaceResponse{
+		Image:       res.Body,
+		ContentType: res.ContentType,
+		Faces:       rpcFaces(detectedFaces(res.Faces)),
+		Passthrough: res.Passthrough,
+	}, nil
+}
+
+// detect returns the faces of the image of in.
+func (s *rpcServer) detect(in *defacerpb.DetectRequest) (*defacerpb.DetectResponse, error) {
+	if _, status, err := s.sniffImage(in.Image); err != nil {
+		return nil, grpc.Errorf(rpcCode(status), "%v", err)
+	}
+	det, err := s.proxy.detect(bytes.NewReader(in.Image), &s.Options)
+	if err != nil {
+		return nil, grpc.Errorf(codes.Internal, "%v", err)
+	}
+	return &defacerpb.DetectResponse{
+		Format: det.Format,
+		Width:  int32(det.Width),
+		Height: int32(det.Height),
+		Faces:  rpcFaces(det.Faces),
+	}, nil
+}
+
+// rpcCode returns the gRPC code of an HTTP error status.
+func rpcCode(status int) codes.Code {
+	switch status {
+	case http.StatusBadRequest,
+		http.StatusRequestEntityTooLarge,
+		http.StatusUnsupportedMediaType:
+		return codes.InvalidArgument
+	}
+	return codes.Internal
+}
+
+// rpcFaces returns the faces of a detection.
+func rpcFaces(faces []detectedFace) []*defacerpb.Face {
+	out := make([]*defacerpb.Face, len(faces))
+	for i, f := range faces {
+		out[i] = &defacerpb.Face{
+			X:      int32(f.X),
+			Y:      int32(f.Y),
+			Width:  int32(f.Width),
+			Height: int32(f.Height),
+		}
+	}
+	return out
+}
+
+// rpcParams returns a function that gets the options of in by the
+// names of the query params of the HTTP deface endpoint.
+func rpcParams(in *defacerpb.DefaceRequest) func(string) string {
+	return func(k string) string {
+		switch k {
+		case "overlay":
+			return in.Overlay
+		case "format":
+			return in.Format
+		case "compression":
+			return in.Compression
+		case "quantizer":
+			return in.Quantizer
+		case "quality":
+			if in.Quality != 0 {
+				return strconv.Itoa(int(in.Quality))
+			}
+		case "colors":
+			if in.Colors != 0 {
+				return strconv.Itoa(int(in.Colors))
+			}
+		}
+		return ""
+	}
+}
+
+// unaryInterceptor checks the API key of unary calls, like Wrap.
+func (ks *keyStore) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	k, err := ks.rpcKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if in, ok := req.(*defacerpb.DefaceRequest); ok {
+		if err = rpcKeyParams(k, in); err != nil {
+			return nil, err
+		}
+	}
+	now := time.Now()
+	wait, err := k.takeRate(now)
+	if err == nil {
+		wait, err = k.takeQuota(now, 1)
+	}
+	if err != nil {
+		grpc.SetTrailer(ctx, metadata.Pairs("retry-after", retryAfter(wait)))
+		return nil, grpc.Errorf(codes.ResourceExhausted, "%v", err)
+	}
+	defacerAPIKeyRequestsSum.WithLabelValues(k.label, "ok").Inc()
+	return handler(context.WithValue(ctx, keyContext{}, k), req)
+}
+
+// streamInterceptor checks the API key of streams. The stream takes a
+// token of the rate limit, and every image counts for the quota.
+func (ks *keyStore) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	k, err := ks.rpcKey(ss.Context())
+	if err != nil {
+		return err
+	}
+	if wait, err := k.takeRate(time.Now()); err != nil {
+		ss.SetTrailer(metadata.Pairs("retry-after", retryAfter(wait)))
+		return grpc.Errorf(codes.ResourceExhausted, "%v", err)
+	}
+	defacerAPIKeyRequestsSum.WithLabelValues(k.label, "ok").Inc()
+	ctx := context.WithValue(ss.Context(), keyContext{}, k)
+	return handler(srv, &keyStream{ServerStream: ss, key: k, ctx: ctx})
+}
+
+// rpcKey returns the API key in the metadata of ctx.
+func (ks *keyStore) rpcKey(ctx context.Context) (*apiKey, error) {
+	var v string
+	if md, ok := metadata.FromContext(ctx); ok && len(md[rpcKeyHeader]) > 0 {
+		v = md[rpcKeyHeader][0]
+	}
+	k, err := ks.lookup(v)
+	if err != nil {
+		return nil, grpc.Errorf(codes.Unauthenticated, "%v", err)
+	}
+	return k, nil
+}
+
+// rpcKeyParams checks the options of in against k, and sets the default
+// overlay of k.
+func rpcKeyParams(k *apiKey, in *defacerpb.DefaceRequest) error {
+	if err := k.check(rpcParams(in)); err != nil {
+		defacerAPIKeyRequestsSum.WithLabelValues(k.label, "forbidden").Inc()
+		return grpc.Errorf(codes.PermissionDenied, "%v", err)
+	}
+	if k.Overlay != "" && in.Overlay == "" {
+		in.Overlay = k.Overlay
+	}
+	return nil
+}
+
+// keyStream checks the images received by a stream against its API
+// key, and counts them for the quota.
+type keyStream struct {
+	grpc.ServerStream
+	key *apiKey
+	ctx context.Context
+}
+
+// Context implements the grpc.ServerStream interface.
+func (s *keyStream) Context() context.Context {
+	return s.ctx
+}
+
+// RecvMsg implements the grpc.ServerStream interface.
+func (s *keyStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	in, ok := m.(*defacerpb.DefaceRequest)
+	if !ok {
+		return nil
+	}
+	if err := rpcKeyParams(s.key, in); err != nil {
+		return err
+	}
+	if wait, err := s.key.takeQuota(time.Now(), 1); err != nil {
+		s.SetTrailer(metadata.Pairs("retry-after", retryAfter(wait)))
+		return grpc.Errorf(codes.ResourceExhausted, "%v", err)
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package apiserver
+
+import (
+	"bytes"
+	"image"
+	"net"
+	"os"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/fiorix/defacer/apiserver/defacerpb"
+)
+
+func newTestRPC(t *testing.T, opt ...grpc.ServerOption) (defacerpb.DefacerClient, func()) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := grpc.NewServer(opt...)
+	defacerpb.RegisterDefacerServer(s, &rpcServer{
+		proxy:       newTestProxy(t),
+		MaxBatch:    3,
+		Concurrency: 2,
+	})
+	go s.Serve(lis)
+	cc, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return defacerpb.NewDefacerClient(cc), func() {
+		cc.Close()
+		s.Stop()
+	}
+}
+
+func TestRPCDeface(t *testing.T) {
+	cli, stop := newTestRPC(t)
+	defer stop()
+	ctx := context.Background()
+	src := blankPNG(t)
+	resp, err := cli.Deface(ctx, &defacerpb.DefaceRequest{Image: src, Format: "gif", Colors: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ContentType != "image/gif" {
+		t.Fatal("unexpected content type:", resp.ContentType)
+	}
+	if _, format, err := image.Decode(bytes.NewReader(resp.Image)); err != nil || format != "gif" {
+		t.Fatal("unexpected image:", format, err)
+	}
+	for _, in := range []*defacerpb.DefaceRequest{
+		{},
+		{Image: []byte("not an image")},
+		{Image: src, Format: "webp"},
+		{Image: src, Quality: 101},
+		{Image: src, Overlay: "missing"},
+	} {
+		if _, err = cli.Deface(ctx, in); grpc.Code(err) != codes.InvalidArgument {
+			t.Errorf("%v: unexpected error: %v", in, err)
+		}
+	}
+}
+
+func TestRPCDetect(t *testing.T) {
+	cli, stop := newTestRPC(t)
+	defer stop()
+	resp, err := cli.Detect(context.Background(), &defacerpb.DetectRequest{Image: blankPNG(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Format != "png" || resp.Width != 64 || resp.Height != 64 || len(resp.Faces) != 0 {
+		t.Fatal("unexpected response:", resp)
+	}
+}
+
+func TestRPCDefaceBatch(t *testing.T) {
+	cli, stop := newTestRPC(t)
+	defer stop()
+	stream, err := cli.DefaceBatch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := blankPNG(t)
+	for _, in := range []*defacerpb.DefaceRequest{
+		{Image: src},
+		{Image: []byte("not an image")},
+		{Image: src, Format: "jpeg"},
+	} {
+		if err = stream.Send(in); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Results) != 3 {
+		t.Fatal("unexpected results:", resp.Results)
+	}
+	if r := resp.Results[0]; r.Code != int32(codes.OK) || r.Response.ContentType != "image/png" {
+		t.Error("unexpected result:", r)
+	}
+	if r := resp.Results[1]; r.Code != int32(codes.InvalidArgument) || r.Response != nil {
+		t.Error("unexpected result:", r)
+	}
+	if r := resp.Results[2]; r.Code != int32(codes.OK) || r.Response.ContentType != "image/jpeg" {
+		t.Error("unexpected result:", r)
+	}
+}
+
+func TestRPCDefaceBatchSize(t *testing.T) {
+	cli, stop := newTestRPC(t)
+	defer stop()
+	stream, err := cli.DefaceBatch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := blankPNG(t)
+	for i := 0; i < 4; i++ {
+		if err = stream.Send(&defacerpb.DefaceRequest{Image: src}); err != nil {
+			break
+		}
+	}
+	if _, err = stream.CloseAndRecv(); grpc.Code(err) != codes.InvalidArgument {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestRegisterGRPC(t *testing.T) {
+	if err := (&Handler{}).RegisterGRPC(grpc.NewServer()); err == nil {
+		t.Fatal("RegisterGRPC before Register didn't fail")
+	}
+	h := &Handler{proxy: newTestProxy(t), keys: &keyStore{}}
+	if err := h.RegisterGRPC(grpc.NewServer()); err == nil {
+		t.Fatal("RegisterGRPC with API keys didn't fail")
+	}
+	h = &Handler{proxy: newTestProxy(t), limiter: &clientLimiter{}}
+	if err := h.RegisterGRPC(grpc.NewServer()); err == nil {
+		t.Fatal("RegisterGRPC with client limits didn't fail")
+	}
+}
+
+func TestRPCKeys(t *testing.T) {
+	ks, dir := newTestKeyStore(t, `{"keys": [
+		{"name": "a", "key": "ka", "daily_quota": 3, "allow": {"format": ["png"]}}
+	]}`)
+	defer os.RemoveAll(dir)
+	cli, stop := newTestRPC(t,
+		grpc.UnaryInterceptor(ks.unaryInterceptor),
+		grpc.StreamInterceptor(ks.streamInterceptor),
+	)
+	defer stop()
+	withKey := func(key string) context.Context {
+		return metadata.NewContext(context.Background(), metadata.Pairs(rpcKeyHeader, key))
+	}
+	src := blankPNG(t)
+	for _, tc := range []struct {
+		ctx  context.Context
+		in   *defacerpb.DefaceRequest
+		code codes.Code
+	}{
+		{context.Background(), &defacerpb.DefaceRequest{Image: src}, codes.Unauthenticated},
+		{withKey("wrong"), &defacerpb.DefaceRequest{Image: src}, codes.Unauthenticated},
+		{withKey("ka"), &defacerpb.DefaceRequest{Image: src, Format: "gif"}, codes.PermissionDenied},
+		{withKey("ka"), &defacerpb.DefaceRequest{Image: src}, codes.OK},
+	} {
+		if _, err := cli.Deface(tc.ctx, tc.in); grpc.Code(err) != tc.code {
+			t.Errorf("%v: unexpected error: %v", tc.in, err)
+		}
+	}
+	if _, err := cli.Detect(context.Background(), &defacerpb.DetectRequest{Image: src}); grpc.Code(err) != codes.Unauthenticated {
+		t.Fatal("unexpected error:", err)
+	}
+	// every image of a batch counts for the quota
+	stream, err := cli.DefaceBatch(withKey("ka"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err = stream.Send(&defacerpb.DefaceRequest{Image: src}); err != nil {
+			break
+		}
+	}
+	if _, err = stream.CloseAndRecv(); grpc.Code(err) != codes.ResourceExhausted {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestRPCClientLimits(t *testing.T) {
+	ks, dir := newTestKeyStore(t, `{"keys": [
+		{"name": "a", "key": "ka"},
+		{"name": "b", "key": "kb"}
+	]}`)
+	defer os.RemoveAll(dir)
+	cl := &clientLimiter{Rate: 1, Burst: 1, clients: map[string]*clientState{}}
+	cli, stop := newTestRPC(t,
+		grpc.UnaryInterceptor(chainUnary([]grpc.UnaryServerInterceptor{ks.unaryInterceptor, cl.unaryInterceptor})),
+		grpc.StreamInterceptor(chainStream([]grpc.StreamServerInterceptor{ks.streamInterceptor, cl.streamInterceptor})),
+	)
+	defer stop()
+	withKey := func(key string) context.Context {
+		return metadata.NewContext(context.Background(), metadata.Pairs(rpcKeyHeader, key))
+	}
+	in := &defacerpb.DetectRequest{Image: blankPNG(t)}
+	if _, err := cli.Detect(withKey("ka"), in); err != nil {
+		t.Fatal(err)
+	}
+	var trailer metadata.MD
+	if _, err := cli.Detect(withKey("ka"), in, grpc.Trailer(&trailer)); grpc.Code(err) != codes.ResourceExhausted {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(trailer["retry-after"]) == 0 {
+		t.Fatal("missing retry-after:", trailer)
+	}
+	// clients are limited by key
+	if _, err := cli.Detect(withKey("kb"), in); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := cli.DefaceBatch(withKey("kb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stream.CloseAndRecv(); grpc.Code(err) != codes.ResourceExhausted {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestRPCClientLimitsAddress(t *testing.T) {
+	cl := &clientLimiter{Concurrency: 1, Rate: 1, Burst: 1, clients: map[string]*clientState{}}
+	cli, stop := newTestRPC(t, grpc.UnaryInterceptor(cl.unaryInterceptor))
+	defer stop()
+	in := &defacerpb.DetectRequest{Image: blankPNG(t)}
+	if _, err := cli.Detect(context.Background(), in); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Detect(context.Background(), in); grpc.Code(err) != codes.ResourceExhausted {
+		t.Fatal("unexpected error:", err)
+	}
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if _, ok := cl.clients["ip:127.0.0.1"]; !ok {
+		t.Fatal("client not identified by address:", cl.clients)
+	}
+}
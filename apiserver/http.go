@@ -1,10 +1,15 @@
 package apiserver
 
 import (
+	"crypto/rand"
+	"errors"
+	"fmt"
 	"image"
+	"io"
 	"net/http"
-	"os"
+	"net/url"
 	"path"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 
@@ -16,14 +21,121 @@ import (
 type Handler struct {
 	Prefix    string // default: "/"
 	ImageFile string // default: internal deface image
+	ImageDir  string // named overlays, selected with ?overlay=name
+	Overlay   string // default overlay name, "random" or "rotate"
 	Workers   uint   // default: 100
 	Client    *http.Client
+
+	// Resized overlays are cached up to CacheBytes, and evicted
+	// after being unused for CacheTTL. Negative values disable the
+	// limit and the TTL, see NewImageCache.
+	CacheBytes int64         // default: DefaultImageCacheBytes
+	CacheTTL   time.Duration // default: DefaultImageCacheTTL
+
+	// ResizeFilter is the interpolation function used to resize
+	// overlays, see ParseResizeFilter.
+	ResizeFilter string // default: DefaultResizeFilter
+
+	// MaxDetectSize is the max width or height of images scanned
+	// for faces, see DefaceOptions.
+	MaxDetectSize int // default: no limit
+
+	// Images larger than TileSize are scanned for faces in tiles
+	// that overlap by TileOverlap, see DefaceOptions.
+	TileSize    int // default: no tiling
+	TileOverlap int // default: TileSize/4
+
+	// Passthrough returns the upstream image bytes without
+	// re-encoding when no faces are found, unless disabled with
+	// ?passthrough=false. The metadata of JPEG images is still
+	// filtered according to Metadata.
+	Passthrough bool
+
+	// MaxImageBytes is the max size of upstream and uploaded images.
+	// Without it, upstream images have no limit, and uploads are
+	// limited to DefaultMaxUploadBytes.
+	MaxImageBytes int64
+
+	// Encode are the default options for encoding defaced images,
+	// which can be overridden per request.
+	Encode EncodeOptions
+
+	// Metadata is the policy for the metadata of JPEG images.
+	Metadata MetadataOptions
+
+	// Defaced images are cached up to ResultCacheBytes in memory,
+	// and up to ResultCacheDiskBytes in ResultCacheDir, see
+	// ResultCache. The result cache is disabled if both
+	// ResultCacheBytes and ResultCacheDir are unset.
+	ResultCacheBytes     int64
+	ResultCacheDir       string
+	ResultCacheDiskBytes int64 // default: DefaultResultCacheDiskBytes
+
+	// BatchSize is the max number of URLs of a batch, which are
+	// fetched and defaced up to BatchConcurrency at a time.
+	BatchSize        int // default: DefaultBatchSize
+	BatchConcurrency int // default: DefaultBatchConcurrency
+
+	// JobDir enables the asynchronous job API, and is where jobs
+	// and their results are stored. Jobs are run by JobWorkers and
+	// deleted JobTTL after they are done. Job callbacks are signed
+	// with JobSecret, and are disabled without it.
+	JobDir     string
+	JobWorkers int           // default: DefaultJobWorkers
+	JobTTL     time.Duration // default: DefaultJobTTL
+	JobSecret  string
+
+	// KeyFile is a JSON file of API keys, required by the API
+	// endpoints except metrics when set. The file is reloaded when it changes,
+	// see keyStore. The image URLs of pages are signed instead of
+	// carrying the key, with a random secret if SigningSecrets is
+	// unset. Batches and jobs count every URL for the daily quota
+	// of the key, and jobs can only be read with the key that
+	// created them.
+	KeyFile string
+
+	// SigningSecrets enable signed URLs for GET requests to the
+	// deface, detect and page endpoints, see SignURL. URLs signed
+	// with any of the secrets are valid, so they can be rotated, and
+	// the first one signs the image URLs of pages. Unsigned requests
+	// are rejected if RequireSignature is set. Uploads, batches and
+	// jobs, whose bodies are not signed, then require an API key, and
+	// are not available without KeyFile.
+	SigningSecrets   []string
+	RequireSignature bool
+
+	// Each client of the API endpoints except metrics, and of
+	// Upstream, is limited to ClientRate requests per second, in
+	// bursts of ClientBurst, and to ClientConcurrency requests at
+	// once, so that it can't take all the Workers. Pending jobs
+	// count separately, up to ClientConcurrency per client, and so
+	// do the calls of the gRPC service. Clients are identified by API
+	// key, or by IP address. The X-Forwarded-For header is only used
+	// for requests from TrustedProxies, which are IP addresses or
+	// CIDR networks.
+	ClientRate        float64 // 0 for no limit
+	ClientBurst       int     // default: ClientRate rounded up
+	ClientConcurrency int     // 0 for no limit
+	TrustedProxies    []string
+
+	// Upstream is the URL of an origin server. If set, all requests
+	// outside of Prefix are forwarded to it, and the images it
+	// serves are defaced. Responses are subject to Client's timeout.
+	Upstream string
+
+	proxy   *proxy         // shared with the gRPC service
+	keys    *keyStore      // nil without KeyFile
+	limiter *clientLimiter // nil without client limits
 }
 
 // Register registers the defacer API handlers to the given ServeMux.
+// If it fails, no handlers are registered, and the resources created
+// so far are released.
 //
-// Endpoints: {prefix}/v1/metrics end {prefix}/v1/deface.
-func (h *Handler) Register(mux *http.ServeMux) error {
+// Endpoints: {prefix}/v1/metrics, {prefix}/v1/deface, {prefix}/v1/detect,
+// {prefix}/v1/page and {prefix}/v1/batch, {prefix}/v1/jobs when JobDir
+// is set, and / when Upstream is set.
+func (h *Handler) Register(mux *http.ServeMux) (err error) {
 	if h.Prefix == "" {
 		h.Prefix = "/"
 	}
@@ -33,20 +145,175 @@ func (h *Handler) Register(mux *http.ServeMux) error {
 	if h.Client == nil {
 		h.Client = &http.Client{}
 	}
-	df, err := h.newDefacer()
+	if h.CacheBytes == 0 {
+		h.CacheBytes = DefaultImageCacheBytes
+	}
+	if h.CacheTTL == 0 {
+		h.CacheTTL = DefaultImageCacheTTL
+	}
+	if h.BatchSize == 0 {
+		h.BatchSize = DefaultBatchSize
+	}
+	if h.BatchConcurrency == 0 {
+		h.BatchConcurrency = DefaultBatchConcurrency
+	}
+	if h.JobWorkers == 0 {
+		h.JobWorkers = DefaultJobWorkers
+	}
+	if h.JobTTL == 0 {
+		h.JobTTL = DefaultJobTTL
+	}
+	var upstream *url.URL
+	if h.Upstream != "" {
+		u, err := url.Parse(h.Upstream)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("invalid upstream URL %q", h.Upstream)
+		}
+		upstream = u
+	}
+	filter, err := ParseResizeFilter(h.ResizeFilter)
+	if err != nil {
+		return err
+	}
+	// closers release what was created if a later step fails
+	var closers []io.Closer
+	defer func() {
+		if err != nil {
+			for i := len(closers) - 1; i >= 0; i-- {
+				closers[i].Close()
+			}
+		}
+	}()
+	if err = h.Encode.Validate(); err != nil {
+		return err
+	}
+	if err = h.Metadata.Validate(); err != nil {
+		return err
+	}
+	var results *ResultCache
+	if h.ResultCacheBytes > 0 || h.ResultCacheDir != "" {
+		results, err = NewResultCache(h.ResultCacheBytes, h.ResultCacheDir, h.ResultCacheDiskBytes)
+		if err != nil {
+			return err
+		}
+	}
+	auth := func(h http.Handler) http.Handler { return h }
+	items := auth
+	if h.KeyFile != "" {
+		keys, err := newKeyStore(h.KeyFile, nil)
+		if err != nil {
+			return err
+		}
+		closers = append(closers, keys)
+		auth, items = keys.Wrap, keys.WrapItems
+		h.keys = keys
+	}
+	signer := &urlSigner{Required: h.RequireSignature, KeyAuth: h.KeyFile != ""}
+	for _, secret := range h.SigningSecrets {
+		signer.Secrets = append(signer.Secrets, []byte(secret))
+	}
+	if h.KeyFile != "" && len(signer.Secrets) == 0 && !signer.Required {
+		// pages of API keys sign their image URLs
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		signer.Secrets = [][]byte{secret}
+	}
+	signed := func(h http.Handler) http.Handler { return h }
+	switch {
+	case len(signer.Secrets) > 0:
+		signed = signer.Wrap
+	case signer.Required:
+		return errors.New("signed URLs require a signing secret")
+	}
+	if signer.Required && h.KeyFile == "" {
+		items = signer.Deny
+	}
+	if h.ClientRate < 0 || h.ClientBurst < 0 || h.ClientConcurrency < 0 {
+		return errors.New("invalid client limits")
+	}
+	trusted, err := parseTrustedProxies(h.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	limit := func(h http.Handler) http.Handler { return h }
+	if h.ClientRate > 0 || h.ClientConcurrency > 0 {
+		h.limiter = newClientLimiter(h.ClientRate, h.ClientBurst, h.ClientConcurrency, trusted)
+		closers = append(closers, h.limiter)
+		limit = h.limiter.Wrap
+	}
+	opts := &ImageResizerOptions{
+		Cache:  NewImageCache(h.CacheBytes, h.CacheTTL),
+		Filter: filter,
+	}
+	closers = append(closers, opts.Cache)
+	df, err := h.newDefacer(opts)
+	if err != nil {
+		return err
+	}
+	if c, ok := df.(io.Closer); ok {
+		closers = append(closers, c)
+	}
+	overlays, err := h.newOverlaySet(opts)
 	if err != nil {
 		return err
 	}
+	if overlays != nil {
+		closers = append(closers, overlays)
+	}
 	p := path.Clean(path.Join(h.Prefix, "v1"))
+	proxy := &proxy{
+		Defacer:  df,
+		Client:   h.Client,
+		Overlays: overlays,
+		Overlay:  h.Overlay,
+		Options: DefaceOptions{
+			MaxDetectSize: h.MaxDetectSize,
+			TileSize:      h.TileSize,
+			TileOverlap:   h.TileOverlap,
+			KeepSource:    h.Passthrough,
+		},
+		MaxBytes: h.MaxImageBytes,
+		Encode:   h.Encode,
+		Metadata: h.Metadata,
+		Results:  results,
+	}
+	batch := &batch{
+		proxy:       proxy,
+		MaxSize:     h.BatchSize,
+		Concurrency: h.BatchConcurrency,
+	}
+	var jobs *jobs
+	if h.JobDir != "" {
+		jobs, err = newJobs(batch, p+"/jobs", h.JobDir, []byte(h.JobSecret), h.JobWorkers, h.JobTTL)
+		if err != nil {
+			return err
+		}
+	}
+	h.proxy = proxy
 	mux.Handle(p+"/metrics", prometheus.Handler())
-	proxy := DefacerProxy(df, h.Client, nil)
-	mux.Handle(p+"/deface", prometheus.InstrumentHandler("deface", proxy))
+	mux.Handle(p+"/deface", prometheus.InstrumentHandler("deface", signed(auth(limit(proxy)))))
+	mux.Handle(p+"/detect", prometheus.InstrumentHandler("detect", signed(auth(limit(&detector{proxy: proxy})))))
+	page := &page{proxy: proxy, Deface: p + "/deface", Signer: signer}
+	mux.Handle(p+"/page", prometheus.InstrumentHandler("page", signed(auth(limit(page)))))
+	mux.Handle(p+"/batch", prometheus.InstrumentHandler("batch", items(limit(batch))))
+	if jobs != nil {
+		mux.Handle(p+"/jobs", prometheus.InstrumentHandler("jobs", items(limit(jobs))))
+		mux.Handle(p+"/jobs/", prometheus.InstrumentHandler("jobs", items(limit(jobs))))
+	}
+	if upstream != nil {
+		mux.Handle("/", prometheus.InstrumentHandler("upstream", limit(newReverseProxy(proxy, upstream))))
+	}
 	return nil
 }
 
 // newDefacer creates a defacer pool based on the handler's configuration.
 // If ImageFile is empty, we load the default internal deface image.
-func (h *Handler) newDefacer() (Defacer, error) {
+func (h *Handler) newDefacer(opts *ImageResizerOptions) (Defacer, error) {
 	var err error
 	var overlay image.Image
 	switch h.ImageFile {
@@ -56,15 +323,29 @@ func (h *Handler) newDefacer() (Defacer, error) {
 			return nil, err
 		}
 	default:
-		f, err := os.Open(h.ImageFile)
+		overlay, err = loadImageFile(h.ImageFile)
 		if err != nil {
 			return nil, err
 		}
-		defer f.Close()
-		overlay, _, err = image.Decode(f)
-		if err != nil {
-			return nil, err
+	}
+	return NewDefacerPool(NewImageResizer(overlay, opts), h.Workers)
+}
+
+// newOverlaySet loads the named overlays from ImageDir, if set, and
+// checks that the default Overlay exists.
+func (h *Handler) newOverlaySet(opts *ImageResizerOptions) (*OverlaySet, error) {
+	if h.ImageDir == "" {
+		if h.Overlay != "" {
+			return nil, fmt.Errorf("overlay %q requires an overlay dir", h.Overlay)
 		}
+		return nil, nil
+	}
+	overlays, err := LoadOverlayDir(h.ImageDir, opts)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := overlays.Resizer(h.Overlay); h.Overlay != "" && !ok {
+		return nil, fmt.Errorf("overlay %q not found in %q", h.Overlay, h.ImageDir)
 	}
-	return NewDefacerPool(NewImageResizer(overlay), h.Workers)
+	return overlays, nil
 }
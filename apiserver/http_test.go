@@ -0,0 +1,34 @@
+package apiserver
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestRegisterCleanup(t *testing.T) {
+	_, dir := newTestKeyStore(t, `{"keys": [{"name": "a", "key": "ka"}]}`)
+	defer os.RemoveAll(dir)
+	before := runtime.NumGoroutine()
+	h := &Handler{
+		Workers:    2,
+		KeyFile:    filepath.Join(dir, "keys.json"),
+		ClientRate: 1,
+		// a file is not a job directory
+		JobDir: filepath.Join(dir, "keys.json", "jobs"),
+	}
+	if err := h.Register(http.NewServeMux()); err == nil {
+		t.Fatal("register didn't fail")
+	}
+	n := runtime.NumGoroutine()
+	for i := 0; i < 100 && n > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+		n = runtime.NumGoroutine()
+	}
+	if n > before {
+		t.Fatalf("goroutines leaked: %d before, %d after", before, n)
+	}
+}
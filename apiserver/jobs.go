@@ -0,0 +1,580 @@
+package apiserver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default job settings.
+const (
+	DefaultJobWorkers = 4
+	DefaultJobTTL     = 24 * time.Hour
+)
+
+// Job status.
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+)
+
+// callbackAttempts is the number of attempts to deliver a callback,
+// which are retried after callbackRetryDelay, doubled every time.
+var (
+	callbackAttempts   = 3
+	callbackRetryDelay = time.Second
+)
+
+// jobs is the asynchronous job API. Jobs are batches that are defaced
+// in the background, and persisted with their results in a jobStore
+// so they survive restarts. Finished jobs are deleted after the TTL.
+// The store is a directory of JSON and image files rather than an
+// embedded database, so it needs no dependencies, and can be inspected
+// and backed up with standard tools. Jobs must be closed to stop their
+// workers and sweeper.
+//
+// Jobs are created with POST {prefix}/v1/jobs, see jobRequest, and
+// polled with GET {prefix}/v1/jobs/{id}. The defaced images of a job
+// are served from GET {prefix}/v1/jobs/{id}/{file}.
+//
+// When a job is done its JSON is POSTed to the optional callback URL,
+// signed with HMAC-SHA256 of the Secret in the X-Defacer-Signature
+// header.
+type jobs struct {
+	*batch
+	Path   string // path of the jobs endpoint
+	Secret []byte
+	TTL    time.Duration
+	store  *jobStore
+	queue  chan string
+	stop   chan struct{}
+	once   sync.Once
+
+	mu    sync.Mutex
+	holds map[string]func() // ends the pending jobs of clients, by ID
+}
+
+// jobRequest is the JSON body of a job request.
+type jobRequest struct {
+	batchRequest
+	Callback string `json:"callback"`
+}
+
+// job is the persisted state of a job.
+type job struct {
+	ID             string            `json:"id"`
+	Status         string            `json:"status"`
+	Created        time.Time         `json:"created"`
+	Updated        time.Time         `json:"updated"`
+	URLs           []string          `json:"urls"`
+	Options        map[string]string `json:"options,omitempty"`
+	Key            string            `json:"key,omitempty"` // name of the API key that owns the job
+	Callback       string            `json:"callback,omitempty"`
+	CallbackStatus int               `json:"callback_status,omitempty"`
+	Notified       bool              `json:"notified,omitempty"`
+	Items          []*batchItem      `json:"items,omitempty"`
+}
+
+// newJobs creates the job API, and resumes the jobs found in dir.
+func newJobs(b *batch, p, dir string, secret []byte, workers int, ttl time.Duration) (*jobs, error) {
+	store, err := newJobStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	js := &jobs{
+		batch:  b,
+		Path:   p,
+		Secret: secret,
+		TTL:    ttl,
+		store:  store,
+		queue:  make(chan string, 1024),
+		stop:   make(chan struct{}),
+		holds:  map[string]func(){},
+	}
+	list, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < workers; i++ {
+		go js.worker()
+	}
+	go func() {
+		for _, j := range list {
+			if j.Status != JobDone || (j.Callback != "" && !j.Notified) {
+				select {
+				case js.queue <- j.ID:
+				case <-js.stop:
+					return
+				}
+			}
+		}
+	}()
+	go js.sweep()
+	return js, nil
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (js *jobs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, js.Path), "/"), "/")
+	var status int
+	var err error
+	switch {
+	case parts[0] == "" && r.Method == "POST":
+		status, err = js.create(w, r)
+	case parts[0] == "":
+		w.Header().Set("Allow", "POST")
+		status, err = http.StatusMethodNotAllowed, errors.New("Method not allowed")
+	case r.Method != "GET":
+		w.Header().Set("Allow", "GET")
+		status, err = http.StatusMethodNotAllowed, errors.New("Method not allowed")
+	case len(parts) == 1:
+		status, err = js.get(w, r, parts[0])
+	case len(parts) == 2:
+		status, err = js.result(w, r, parts[0], parts[1])
+	default:
+		status, err = http.StatusNotFound, errors.New("Not found")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), status)
+	}
+}
+
+func (js *jobs) create(w http.ResponseWriter, r *http.Request) (int, error) {
+	var req jobRequest
+	body := http.MaxBytesReader(w, r.Body, maxBatchRequestBytes)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("Invalid job: %v", err)
+	}
+	switch {
+	case len(req.URLs) == 0:
+		return http.StatusBadRequest, errors.New("Missing `urls`")
+	case len(req.URLs) > js.MaxSize:
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("Too many `urls`, max %d", js.MaxSize)
+	}
+	if req.Callback != "" {
+		u, err := url.Parse(req.Callback)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return http.StatusBadRequest, fmt.Errorf("Invalid `callback`: %q", req.Callback)
+		}
+		if len(js.Secret) == 0 {
+			return http.StatusBadRequest, errors.New("Callbacks are not available")
+		}
+	}
+	params, err := js.params(req.Options)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	end, ok := holdJob(r)
+	if !ok {
+		defacerClientRejectionsSum.WithLabelValues("jobs").Inc()
+		w.Header().Set("Retry-After", retryAfter(time.Second))
+		return http.StatusTooManyRequests, errors.New("Too many pending jobs of this client")
+	}
+	held := false
+	defer func() {
+		if !held {
+			end()
+		}
+	}()
+	if len(js.queue) == cap(js.queue) {
+		return http.StatusServiceUnavailable, errJobQueueFull
+	}
+	if status, err := keyParams(w, r, params, len(req.URLs)); err != nil {
+		return status, err
+	}
+	queued := false
+	defer func() {
+		// rejected jobs don't count for the quota
+		if k := requestKey(r); k != nil && !queued {
+			k.refundQuota(time.Now(), int64(len(req.URLs)))
+		}
+	}()
+	delete(params, "url")
+	id, err := newJobID()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	now := time.Now()
+	j := &job{
+		ID:       id,
+		Status:   JobPending,
+		Created:  now,
+		Updated:  now,
+		URLs:     req.URLs,
+		Options:  params,
+		Callback: req.Callback,
+	}
+	if k := requestKey(r); k != nil {
+		j.Key = k.Name
+	}
+	if err = js.store.Save(j); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	js.hold(id, end)
+	held = true
+	select {
+	case js.queue <- id:
+		queued = true
+	default:
+		js.release(id)
+		js.store.Delete(id)
+		return http.StatusServiceUnavailable, errJobQueueFull
+	}
+	defacerJobsSum.WithLabelValues(JobPending).Inc()
+	w.Header().Set("Location", path.Join(js.Path, id))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(j)
+	return 0, nil
+}
+
+// load returns the job id for r. Jobs created with an API key are
+// only found with the same key.
+func (js *jobs) load(r *http.Request, id string) (*job, error) {
+	j, err := js.store.Load(id)
+	if err != nil {
+		return nil, errors.New("Job not found")
+	}
+	if k := requestKey(r); k != nil && k.Name != j.Key {
+		return nil, errors.New("Job not found")
+	}
+	return j, nil
+}
+
+func (js *jobs) get(w http.ResponseWriter, r *http.Request, id string) (int, error) {
+	j, err := js.load(r, id)
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(j)
+	return 0, nil
+}
+
+func (js *jobs) result(w http.ResponseWriter, r *http.Request, id, file string) (int, error) {
+	j, err := js.load(r, id)
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+	for _, item := range j.Items {
+		if item.File == "" || item.File != file {
+			continue
+		}
+		f, err := js.store.Open(id, file)
+		if err != nil {
+			return http.StatusNotFound, errors.New("Result not found")
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", item.ContentType)
+		w.Header().Set("X-Defacer-Faces", strconv.Itoa(item.Faces))
+		io.Copy(w, f)
+		return 0, nil
+	}
+	return http.StatusNotFound, errors.New("Result not found")
+}
+
+// worker runs the queued jobs until the jobs are closed.
+func (js *jobs) worker() {
+	for {
+		select {
+		case id := <-js.queue:
+			if err := js.run(id); err != nil {
+				js.logf("job %s failed: %v", id, err)
+			}
+			js.release(id)
+		case <-js.stop:
+			return
+		}
+	}
+}
+
+// Close stops the workers and the sweeper. Running jobs are finished,
+// and pending jobs are resumed on restart.
+func (js *jobs) Close() error {
+	js.once.Do(func() { close(js.stop) })
+	return nil
+}
+
+// hold keeps end to be called when the job id is done.
+func (js *jobs) hold(id string, end func()) {
+	js.mu.Lock()
+	js.holds[id] = end
+	js.mu.Unlock()
+}
+
+// release ends the pending job id for its client, see holdJob. Jobs
+// resumed on restart are not held.
+func (js *jobs) release(id string) {
+	js.mu.Lock()
+	end := js.holds[id]
+	delete(js.holds, id)
+	js.mu.Unlock()
+	if end != nil {
+		end()
+	}
+}
+
+// run defaces the images of a job, stores the results, and notifies
+// the callback. Jobs that are done are only notified.
+func (js *jobs) run(id string) error {
+	j, err := js.store.Load(id)
+	if err != nil {
+		return err
+	}
+	if j.Status != JobDone {
+		j.Status, j.Updated = JobRunning, time.Now()
+		if err = js.store.Save(j); err != nil {
+			return err
+		}
+		r, _ := http.NewRequest("POST", js.Path, nil)
+		items, done := js.start(r, j.URLs, j.Options)
+		for i := range items {
+			<-done[i]
+			item := items[i]
+			if item.body == nil {
+				continue
+			}
+			item.File = batchFileName(i, item.ContentType)
+			if err = js.store.SaveResult(id, item.File, item.body); err != nil {
+				item.Status, item.Error, item.File = http.StatusInternalServerError, err.Error(), ""
+			}
+			item.body = nil
+		}
+		j.Status, j.Updated, j.Items = JobDone, time.Now(), items
+		if err = js.store.Save(j); err != nil {
+			return err
+		}
+		defacerJobsSum.WithLabelValues(JobDone).Inc()
+	}
+	if j.Callback == "" || j.Notified {
+		return nil
+	}
+	js.notify(j)
+	return js.store.Save(j)
+}
+
+// notify POSTs the job to its callback URL, signed with the secret.
+// Failed deliveries are retried with exponential backoff.
+func (js *jobs) notify(j *job) {
+	body, err := json.Marshal(j)
+	if err != nil {
+		return
+	}
+	sig := signPayload(js.Secret, body)
+	delay := callbackRetryDelay
+	for attempt := 1; attempt <= callbackAttempts; attempt++ {
+		req, err := http.NewRequest("POST", j.Callback, bytes.NewReader(body))
+		if err != nil {
+			break
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Defacer-Signature", sig)
+		resp, err := js.Client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			j.CallbackStatus = resp.StatusCode
+			if resp.StatusCode/100 == 2 {
+				j.Notified = true
+				defacerJobCallbacksSum.WithLabelValues("ok").Inc()
+				return
+			}
+		}
+		if attempt < callbackAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	// give up, but keep the job from being notified again on restart
+	j.Notified = true
+	defacerJobCallbacksSum.WithLabelValues("failed").Inc()
+	js.logf("failed to notify job %s to %q", j.ID, j.Callback)
+}
+
+// signPayload returns the X-Defacer-Signature of body: the hex encoded
+// HMAC-SHA256 of body with the given secret, prefixed with "sha256=".
+func signPayload(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sweep runs periodically to delete jobs that are done since before
+// the TTL.
+func (js *jobs) sweep() {
+	interval := time.Minute
+	if js.TTL < interval {
+		interval = js.TTL
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			js.expire(time.Now())
+		case <-js.stop:
+			return
+		}
+	}
+}
+
+// expire deletes the jobs that are done since before now minus the TTL.
+func (js *jobs) expire(now time.Time) {
+	list, err := js.store.List()
+	if err != nil {
+		return
+	}
+	for _, j := range list {
+		if j.Status == JobDone && now.Sub(j.Updated) > js.TTL {
+			js.store.Delete(j.ID)
+		}
+	}
+}
+
+// newJobID returns a random job ID.
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// jobIDRE matches valid job IDs, and jobFileRE valid result files.
+var (
+	jobIDRE   = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	jobFileRE = regexp.MustCompile(`^[0-9]{4,}\.[a-z]+$`)
+)
+
+// errJobQueueFull is returned when there are too many pending jobs.
+var errJobQueueFull = errors.New("Too many pending jobs")
+
+// errJobNotFound is returned for invalid or missing jobs.
+var errJobNotFound = errors.New("job not found")
+
+// jobStore persists jobs in a directory, with a job.json file and the
+// results of each job in a directory named after its ID. Files are
+// written to a temporary file first, and renamed into place.
+type jobStore struct {
+	dir string
+}
+
+func newJobStore(dir string) (*jobStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &jobStore{dir: dir}, nil
+}
+
+// Load returns the job of the given ID.
+func (s *jobStore) Load(id string) (*job, error) {
+	if !jobIDRE.MatchString(id) {
+		return nil, errJobNotFound
+	}
+	f, err := os.Open(path.Join(s.dir, id, "job.json"))
+	if err != nil {
+		return nil, errJobNotFound
+	}
+	defer f.Close()
+	var j job
+	if err = json.NewDecoder(f).Decode(&j); err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// Save writes the job.
+func (s *jobStore) Save(j *job) error {
+	b, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return s.write(j.ID, "job.json", b)
+}
+
+// SaveResult writes a result file of the job.
+func (s *jobStore) SaveResult(id, file string, b []byte) error {
+	if !jobFileRE.MatchString(file) {
+		return fmt.Errorf("invalid result file %q", file)
+	}
+	return s.write(id, file, b)
+}
+
+// Open opens a result file of the job.
+func (s *jobStore) Open(id, file string) (*os.File, error) {
+	if !jobIDRE.MatchString(id) || !jobFileRE.MatchString(file) {
+		return nil, errJobNotFound
+	}
+	return os.Open(path.Join(s.dir, id, file))
+}
+
+// List returns all jobs.
+func (s *jobStore) List() ([]*job, error) {
+	f, err := os.Open(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	var list []*job
+	for _, id := range names {
+		if j, err := s.Load(id); err == nil {
+			list = append(list, j)
+		}
+	}
+	return list, nil
+}
+
+// Delete removes the job and its results.
+func (s *jobStore) Delete(id string) error {
+	if !jobIDRE.MatchString(id) {
+		return errJobNotFound
+	}
+	return os.RemoveAll(path.Join(s.dir, id))
+}
+
+func (s *jobStore) write(id, name string, b []byte) error {
+	dir := path.Join(s.dir, id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp := path.Join(dir, ".tmp-"+name)
+	if err := writeFile(tmp, b); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path.Join(dir, name))
+}
+
+// writeFile writes b to the named file, and syncs it to disk.
+func writeFile(name string, b []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,205 @@
+package apiserver
+
+import (
+	"encoding/json"
+	"image"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestJobs(t *testing.T, dir string) (*jobs, *httptest.Server) {
+	b, upstream := newTestBatch(t)
+	js, err := newJobs(b, "/v1/jobs", dir, []byte("secret"), 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return js, upstream
+}
+
+func serveJobs(js *jobs, method, path, body string) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest(method, path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	js.ServeHTTP(w, r)
+	return w
+}
+
+// waitJob polls the job until it's done.
+func waitJob(t *testing.T, js *jobs, id string) *job {
+	for i := 0; i < 500; i++ {
+		w := serveJobs(js, "GET", "/v1/jobs/"+id, "")
+		if w.Code != http.StatusOK {
+			t.Fatal("unexpected status:", w.Code, w.Body.String())
+		}
+		var j job
+		if err := json.NewDecoder(w.Body).Decode(&j); err != nil {
+			t.Fatal(err)
+		}
+		if j.Status == JobDone && (j.Callback == "" || j.Notified) {
+			return &j
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("job not done:", id)
+	return nil
+}
+
+func TestJobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "defacer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	js, upstream := newTestJobs(t, dir)
+	defer upstream.Close()
+	callbacks := make(chan *job, 1)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Defacer-Signature") != signPayload([]byte("secret"), body) {
+			t.Error("invalid callback signature")
+		}
+		var j job
+		json.Unmarshal(body, &j)
+		callbacks <- &j
+	}))
+	defer callback.Close()
+	req := `{"urls": ["` + upstream.URL + `/image.png", "` + upstream.URL + `/missing.png"],
+		"options": {"format": "gif"}, "callback": "` + callback.URL + `"}`
+	w := serveJobs(js, "POST", "/v1/jobs", req)
+	if w.Code != http.StatusAccepted {
+		t.Fatal("unexpected status:", w.Code, w.Body.String())
+	}
+	var created job
+	json.NewDecoder(w.Body).Decode(&created)
+	if w.Header().Get("Location") != "/v1/jobs/"+created.ID || created.Status != JobPending {
+		t.Fatal("unexpected job:", created)
+	}
+	j := waitJob(t, js, created.ID)
+	if len(j.Items) != 2 || j.Items[0].File != "0000.gif" || j.Items[1].Status != http.StatusNotFound {
+		t.Fatal("unexpected items:", j.Items[0], j.Items[1])
+	}
+	if j.CallbackStatus != http.StatusOK {
+		t.Fatal("unexpected callback status:", j.CallbackStatus)
+	}
+	if cb := <-callbacks; cb.ID != j.ID || cb.Status != JobDone {
+		t.Fatal("unexpected callback:", cb)
+	}
+	w = serveJobs(js, "GET", "/v1/jobs/"+j.ID+"/0000.gif", "")
+	if _, format, err := image.Decode(w.Body); err != nil || format != "gif" {
+		t.Fatal("unexpected result:", format, err)
+	}
+	for path, status := range map[string]int{
+		"/v1/jobs/" + j.ID + "/0001.png":    http.StatusNotFound,
+		"/v1/jobs/" + j.ID + "/../job.json": http.StatusNotFound,
+		"/v1/jobs/0123":                     http.StatusNotFound,
+	} {
+		if w = serveJobs(js, "GET", path, ""); w.Code != status {
+			t.Errorf("%s: unexpected status: %d", path, w.Code)
+		}
+	}
+	js.expire(time.Now().Add(2 * time.Hour))
+	if w = serveJobs(js, "GET", "/v1/jobs/"+j.ID, ""); w.Code != http.StatusNotFound {
+		t.Fatal("job not expired:", w.Code)
+	}
+}
+
+func TestJobsResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "defacer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := newJobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, upstream := newTestBatch(t)
+	defer upstream.Close()
+	id, _ := newJobID()
+	store.Save(&job{ID: id, Status: JobRunning, URLs: []string{upstream.URL + "/image.png"}})
+	js, err := newJobs(b, "/v1/jobs", dir, nil, 1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer js.Close()
+	if j := waitJob(t, js, id); j.Items[0].Status != http.StatusOK {
+		t.Fatal("unexpected item:", j.Items[0])
+	}
+}
+
+func TestJobsInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "defacer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	js, upstream := newTestJobs(t, dir)
+	defer upstream.Close()
+	for req, status := range map[string]int{
+		`{"urls": []}`: http.StatusBadRequest,
+		`{"urls": ["a"], "callback": "ftp://example.com"}`: http.StatusBadRequest,
+		`{"urls": ["a"], "options": {"quality": "x"}}`:     http.StatusBadRequest,
+	} {
+		if w := serveJobs(js, "POST", "/v1/jobs", req); w.Code != status {
+			t.Errorf("%s: unexpected status: %d", req, w.Code)
+		}
+	}
+	js.Secret = nil
+	req := `{"urls": ["a"], "callback": "http://example.com"}`
+	if w := serveJobs(js, "POST", "/v1/jobs/", req); w.Code != http.StatusBadRequest {
+		t.Error("callback without secret: unexpected status:", w.Code)
+	}
+	if w := serveJobs(js, "DELETE", "/v1/jobs/0123", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Error("unexpected status:", w.Code)
+	}
+}
+
+func TestJobsClientLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "defacer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b, upstream := newTestBatch(t)
+	defer upstream.Close()
+	// no workers yet, so jobs stay pending
+	js, err := newJobs(b, "/v1/jobs", dir, nil, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := (&clientLimiter{Concurrency: 1, clients: map[string]*clientState{}}).Wrap(js)
+	create := func(addr string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("POST", "/v1/jobs", strings.NewReader(`{"urls": ["`+upstream.URL+`/image.png"]}`))
+		r.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	w := create("10.0.0.1:1234")
+	if w.Code != http.StatusAccepted {
+		t.Fatal("unexpected status:", w.Code, w.Body.String())
+	}
+	var j job
+	if err = json.NewDecoder(w.Body).Decode(&j); err != nil {
+		t.Fatal(err)
+	}
+	if w = create("10.0.0.1:1234"); w.Code != http.StatusTooManyRequests {
+		t.Fatal("pending jobs not limited:", w.Code)
+	}
+	if w = create("10.0.0.2:1234"); w.Code != http.StatusAccepted {
+		t.Fatal("other client limited:", w.Code)
+	}
+	go js.worker()
+	waitJob(t, js, j.ID)
+	if w = create("10.0.0.1:1234"); w.Code != http.StatusAccepted {
+		t.Fatal("done job still counted:", w.Code)
+	}
+	// closed jobs stop their workers and sweeper
+	js.Close()
+	js.worker()
+	js.sweep()
+}
@@ -0,0 +1,110 @@
+package apiserver
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a rate limiter that allows Rate requests per second,
+// in bursts of up to Burst requests.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full token bucket. The burst defaults to
+// the rate rounded up, and at least 1.
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	b := float64(burst)
+	if b <= 0 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b}
+}
+
+// Take takes a token at now, and reports whether there was one. If
+// not, it returns how long until there is.
+func (tb *tokenBucket) Take(now time.Time) (bool, time.Duration) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if !tb.last.IsZero() {
+		tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+		if tb.tokens > tb.burst {
+			tb.tokens = tb.burst
+		}
+	}
+	tb.last = now
+	if tb.tokens >= 1 {
+		tb.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+	return false, wait
+}
+
+// dailyQuota counts requests per UTC day, up to a limit.
+type dailyQuota struct {
+	mu    sync.Mutex
+	limit int64
+	day   time.Time
+	used  int64
+}
+
+func newDailyQuota(limit int64) *dailyQuota {
+	return &dailyQuota{limit: limit}
+}
+
+// SetLimit changes the limit, keeping the count of the day.
+func (q *dailyQuota) SetLimit(limit int64) {
+	q.mu.Lock()
+	q.limit = limit
+	q.mu.Unlock()
+}
+
+// Take counts n requests at now, and reports whether they are within
+// the quota. If not, none are counted, and it returns how long until
+// the quota is reset.
+func (q *dailyQuota) Take(now time.Time, n int64) (bool, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if !day.Equal(q.day) {
+		q.day, q.used = day, 0
+	}
+	if q.used+n > q.limit {
+		return false, day.AddDate(0, 0, 1).Sub(now)
+	}
+	q.used += n
+	return true, 0
+}
+
+// Refund gives back n requests counted at now, if the quota was not
+// reset since.
+func (q *dailyQuota) Refund(now time.Time, n int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if !day.Equal(q.day) {
+		return
+	}
+	if q.used -= n; q.used < 0 {
+		q.used = 0
+	}
+}
+
+// retryAfter returns the value of a Retry-After header for d, in
+// seconds rounded up.
+func retryAfter(d time.Duration) string {
+	s := int64(math.Ceil(d.Seconds()))
+	if s < 1 {
+		s = 1
+	}
+	return strconv.FormatInt(s, 10)
+}
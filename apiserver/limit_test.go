@@ -0,0 +1,80 @@
+package apiserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tb := newTokenBucket(2, 0)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if ok, _ := tb.Take(now); !ok {
+			t.Fatal("burst not allowed:", i)
+		}
+	}
+	ok, wait := tb.Take(now)
+	if ok || wait != 500*time.Millisecond {
+		t.Fatal("unexpected take:", ok, wait)
+	}
+	if ok, _ = tb.Take(now.Add(wait)); !ok {
+		t.Fatal("token not refilled")
+	}
+	// tokens don't accumulate past the burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		ok, _ = tb.Take(now)
+	}
+	if ok {
+		t.Fatal("burst exceeded")
+	}
+}
+
+func TestDailyQuota(t *testing.T) {
+	q := newDailyQuota(2)
+	now := time.Date(2016, 1, 1, 23, 0, 0, 0, time.UTC)
+	for i := 0; i < 2; i++ {
+		if ok, _ := q.Take(now, 1); !ok {
+			t.Fatal("quota exceeded early:", i)
+		}
+	}
+	ok, wait := q.Take(now, 1)
+	if ok || wait != time.Hour {
+		t.Fatal("unexpected take:", ok, wait)
+	}
+	q.SetLimit(3)
+	if ok, _ = q.Take(now, 1); !ok {
+		t.Fatal("raised quota not applied")
+	}
+	if ok, _ = q.Take(now.Add(wait), 1); !ok {
+		t.Fatal("quota not reset")
+	}
+	if ok, _ = q.Take(now.Add(wait), 3); ok {
+		t.Fatal("quota exceeded")
+	}
+	if ok, _ = q.Take(now.Add(wait), 2); !ok {
+		t.Fatal("rejected requests were counted")
+	}
+	// refunds of the previous day are ignored
+	q.Refund(now, 3)
+	if ok, _ = q.Take(now.Add(wait), 1); ok {
+		t.Fatal("refund of the previous day applied")
+	}
+	q.Refund(now.Add(wait), 2)
+	if ok, _ = q.Take(now.Add(wait), 2); !ok {
+		t.Fatal("refund not applied")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		0:                       "1",
+		time.Millisecond:        "1",
+		1500 * time.Millisecond: "2",
+		time.Hour:               "3600",
+	} {
+		if v := retryAfter(d); v != want {
+			t.Errorf("%v: unexpected value: %q", d, v)
+		}
+	}
+}
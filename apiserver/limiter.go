@@ -0,0 +1,306 @@
+package apiserver
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// clientLimiter limits the rate and concurrency of the requests of
+// each client, so that a single client can't take all the workers.
+// Clients are identified by API key, or by IP address otherwise.
+//
+// Jobs outlive the requests that create them, so the pending jobs of
+// each client are limited to Concurrency as well, see holdJob.
+//
+// The address of clients behind trusted proxies is the last untrusted
+// address of their X-Forwarded-For header.
+type clientLimiter struct {
+	Rate        float64      // requests per second, 0 for no limit
+	Burst       int          // default: rate rounded up
+	Concurrency int          // requests at once, 0 for no limit
+	Trusted     []*net.IPNet // trusted proxies
+
+	mu      sync.Mutex
+	clients map[string]*clientState
+	idle    time.Duration // clients idle for this long are forgotten
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// clientState is the state of a client of a clientLimiter.
+type clientState struct {
+	bucket *tokenBucket
+	active int
+	jobs   int // pending jobs
+	last   time.Time
+}
+
+// newClientLimiter returns a client limiter that forgets idle clients
+// periodically.
+func newClientLimiter(rate float64, burst, concurrency int, trusted []*net.IPNet) *clientLimiter {
+	cl := &clientLimiter{
+		Rate:        rate,
+		Burst:       burst,
+		Concurrency: concurrency,
+		Trusted:     trusted,
+		clients:     map[string]*clientState{},
+		idle:        time.Minute,
+		stop:        make(chan struct{}),
+	}
+	if rate > 0 {
+		// forgotten clients get a full bucket, as they would by now
+		if refill := time.Duration(newTokenBucket(rate, burst).burst / rate * float64(time.Second)); refill > cl.idle {
+			cl.idle = refill
+		}
+	}
+	go cl.sweep()
+	return cl
+}
+
+// parseTrustedProxies parses a list of IP addresses and CIDR networks.
+func parseTrustedProxies(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", s)
+			}
+			bits := 8 * len(ip)
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Wrap returns a handler that limits the requests of each client to
+// next. Limited requests are rejected with 429 and Retry-After.
+func (cl *clientLimiter) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st, wait, reason := cl.acquire(cl.identity(r), time.Now())
+		if st == nil {
+			defacerClientRejectionsSum.WithLabelValues(reason).Inc()
+			w.Header().Set("Retry-After", retryAfter(wait))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		defer cl.release(st)
+		ctx := context.WithValue(r.Context(), clientContext{}, &clientRef{cl, st})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// unaryInterceptor limits the unary calls of each client, like Wrap.
+// It must run after the API key interceptor, which identifies clients.
+func (cl *clientLimiter) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	st, wait, reason := cl.acquire(rpcIdentity(ctx), time.Now())
+	if st == nil {
+		defacerClientRejectionsSum.WithLabelValues(reason).Inc()
+		grpc.SetTrailer(ctx, metadata.Pairs("retry-after", retryAfter(wait)))
+		return nil, errRPCLimited
+	}
+	defer cl.release(st)
+	return handler(ctx, req)
+}
+
+// streamInterceptor limits the streams of each client, like Wrap.
+func (cl *clientLimiter) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	st, wait, reason := cl.acquire(rpcIdentity(ss.Context()), time.Now())
+	if st == nil {
+		defacerClientRejectionsSum.WithLabelValues(reason).Inc()
+		ss.SetTrailer(metadata.Pairs("retry-after", retryAfter(wait)))
+		return errRPCLimited
+	}
+	defer cl.release(st)
+	return handler(srv, ss)
+}
+
+// errRPCLimited is returned for limited gRPC calls.
+var errRPCLimited = grpc.Errorf(codes.ResourceExhausted, "Too many requests")
+
+// acquire starts a request of the client id at now. It returns nil if
+// the request is limited, with how long to wait and the reason.
+func (cl *clientLimiter) acquire(id string, now time.Time) (*clientState, time.Duration, string) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	st := cl.clients[id]
+	if st == nil {
+		st = &clientState{}
+		if cl.Rate > 0 {
+			st.bucket = newTokenBucket(cl.Rate, cl.Burst)
+		}
+		cl.clients[id] = st
+	}
+	st.last = now
+	if cl.Concurrency > 0 && st.active >= cl.Concurrency {
+		return nil, time.Second, "concurrency"
+	}
+	if st.bucket != nil {
+		if ok, wait := st.bucket.Take(now); !ok {
+			return nil, wait, "rate"
+		}
+	}
+	st.active++
+	return st, 0, ""
+}
+
+// release ends a request of a client.
+func (cl *clientLimiter) release(st *clientState) {
+	cl.mu.Lock()
+	st.active--
+	cl.mu.Unlock()
+}
+
+// clientContext is the context key of the client of requests limited
+// by a clientLimiter.
+type clientContext struct{}
+
+// clientRef is a client of a clientLimiter.
+type clientRef struct {
+	cl *clientLimiter
+	st *clientState
+}
+
+// holdJob counts a pending job for the client of r. It returns false if
+// the client has Concurrency pending jobs already, and otherwise the
+// function that ends the job.
+func holdJob(r *http.Request) (func(), bool) {
+	ref, _ := r.Context().Value(clientContext{}).(*clientRef)
+	if ref == nil {
+		return func() {}, true
+	}
+	cl, st := ref.cl, ref.st
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.Concurrency > 0 && st.jobs >= cl.Concurrency {
+		return nil, false
+	}
+	st.jobs++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cl.mu.Lock()
+			st.jobs--
+			st.last = time.Now()
+			cl.mu.Unlock()
+		})
+	}, true
+}
+
+// sweep runs periodically to forget idle clients.
+func (cl *clientLimiter) sweep() {
+	t := time.NewTicker(cl.idle)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			cl.forget(time.Now())
+		case <-cl.stop:
+			return
+		}
+	}
+}
+
+// Close stops forgetting idle clients.
+func (cl *clientLimiter) Close() error {
+	cl.once.Do(func() { close(cl.stop) })
+	return nil
+}
+
+// forget forgets the clients idle at now.
+func (cl *clientLimiter) forget(now time.Time) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	for id, st := range cl.clients {
+		if st.active == 0 && st.jobs == 0 && now.Sub(st.last) > cl.idle {
+			delete(cl.clients, id)
+		}
+	}
+}
+
+// identity returns the client identity of r: the name of its API key,
+// or its IP address.
+func (cl *clientLimiter) identity(r *http.Request) string {
+	if k := requestKey(r); k != nil {
+		return "key:" + k.Name
+	}
+	return "ip:" + clientIP(r, cl.Trusted)
+}
+
+// rpcIdentity returns the client identity of a gRPC call, like
+// identity. The address of the peer is used as is.
+func rpcIdentity(ctx context.Context) string {
+	if k, ok := ctx.Value(keyContext{}).(*apiKey); ok {
+		return "key:" + k.Name
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		host, _, err := net.SplitHostPort(p.Addr.String())
+		if err != nil {
+			host = p.Addr.String()
+		}
+		return "ip:" + host
+	}
+	return "ip:"
+}
+
+// clientIP returns the IP address of the client of r. If the peer is
+// a trusted proxy, the X-Forwarded-For header is read from right to
+// left up to the first untrusted address.
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrusted(net.ParseIP(host), trusted) {
+		return host
+	}
+	var hops []string
+	for _, v := range r.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		ip := net.ParseIP(hop)
+		if ip == nil {
+			// can't trust anything to the left
+			break
+		}
+		host = hop
+		if !isTrusted(ip, trusted) {
+			break
+		}
+	}
+	return host
+}
+
+func isTrusted(ip net.IP, trusted []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package apiserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientLimiterRate(t *testing.T) {
+	cl := &clientLimiter{Rate: 1, Burst: 2, clients: map[string]*clientState{}}
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		st, _, _ := cl.acquire("a", now)
+		if st == nil {
+			t.Fatal("burst not allowed:", i)
+		}
+		cl.release(st)
+	}
+	st, wait, reason := cl.acquire("a", now)
+	if st != nil || wait != time.Second || reason != "rate" {
+		t.Fatal("unexpected acquire:", st, wait, reason)
+	}
+	// clients are limited separately
+	if st, _, _ = cl.acquire("b", now); st == nil {
+		t.Fatal("other client limited")
+	}
+}
+
+func TestClientLimiterConcurrency(t *testing.T) {
+	cl := &clientLimiter{Concurrency: 1, clients: map[string]*clientState{}}
+	now := time.Now()
+	st, _, _ := cl.acquire("a", now)
+	if st == nil {
+		t.Fatal("first request limited")
+	}
+	if st2, _, reason := cl.acquire("a", now); st2 != nil || reason != "concurrency" {
+		t.Fatal("unexpected acquire:", st2, reason)
+	}
+	cl.release(st)
+	if st, _, _ = cl.acquire("a", now); st == nil {
+		t.Fatal("released request still counted")
+	}
+	cl.release(st)
+
+	cl.idle = time.Minute
+	cl.forget(now.Add(time.Second))
+	if len(cl.clients) != 1 {
+		t.Fatal("recent client forgotten")
+	}
+	cl.forget(now.Add(2 * time.Minute))
+	if len(cl.clients) != 0 {
+		t.Fatal("idle client not forgotten")
+	}
+}
+
+func TestClientLimiterWrap(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	cl := &clientLimiter{Concurrency: 1, clients: map[string]*clientState{}}
+	h := cl.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		close(done)
+	}()
+	<-started
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Fatal("unexpected response:", w.Code, w.Header())
+	}
+	// requests of API keys are limited by key, not by address
+	k := &apiKey{Name: "app"}
+	w = httptest.NewRecorder()
+	keyDone := make(chan struct{})
+	go func() {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), keyContext{}, k)))
+		close(keyDone)
+	}()
+	select {
+	case <-started:
+	case <-keyDone:
+		t.Fatal("key request limited:", w.Code)
+	}
+	close(release)
+	<-done
+	<-keyDone
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"1.2.3.4:80", nil, "1.2.3.4"},
+		{"1.2.3.4:80", []string{"5.6.7.8"}, "1.2.3.4"},
+		{"10.0.0.1:80", nil, "10.0.0.1"},
+		{"10.0.0.1:80", []string{"5.6.7.8"}, "5.6.7.8"},
+		{"10.0.0.1:80", []string{"9.9.9.9, 5.6.7.8, 192.168.1.1"}, "5.6.7.8"},
+		{"10.0.0.1:80", []string{"9.9.9.9", "5.6.7.8"}, "5.6.7.8"},
+		{"10.0.0.1:80", []string{"10.0.0.2, 10.0.0.3"}, "10.0.0.2"},
+		{"10.0.0.1:80", []string{"5.6.7.8, junk, 10.0.0.2"}, "10.0.0.2"},
+		{"192.168.1.2:80", []string{"5.6.7.8"}, "192.168.1.2"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		r.Header["X-Forwarded-For"] = tt.xff
+		if ip := clientIP(r, trusted); ip != tt.want {
+			t.Errorf("clientIP(%s, %q) = %s, want %s", tt.remote, tt.xff, ip, tt.want)
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	if _, err := parseTrustedProxies([]string{"::1", "fd00::/8", " 127.0.0.1 "}); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"", "localhost", "10.0.0.0/33"} {
+		if _, err := parseTrustedProxies([]string{s}); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
@@ -1,5 +1,10 @@
 package apiserver
 
+import (
+	"image"
+	"math"
+)
+
 func roundUp(v int) int {
 	return 10 * ((v + 9) / 10)
 }
@@ -7,3 +12,28 @@ func roundUp(v int) int {
 func roundDown(v int) int {
 	return 10 * (v / 10)
 }
+
+// scale multiplies v by f, rounding to the nearest integer.
+func scale(v int, f float64) int {
+	return int(math.Floor(float64(v)*f + 0.5))
+}
+
+// fitSize returns size scaled down, keeping the aspect ratio, so that
+// neither width nor height exceed max. If max is 0 or size already
+// fits, size is returned unchanged.
+func fitSize(size image.Point, max int) image.Point {
+	if max <= 0 || (size.X <= max && size.Y <= max) {
+		return size
+	}
+	if size.X >= size.Y {
+		return image.Point{max, maxInt(1, size.Y*max/size.X)}
+	}
+	return image.Point{maxInt(1, size.X*max/size.Y), max}
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
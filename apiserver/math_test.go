@@ -0,0 +1,34 @@
+package apiserver
+
+import (
+	"image"
+	"testing"
+)
+
+func TestFitSize(t *testing.T) {
+	tests := []struct {
+		Size image.Point
+		Max  int
+		Want image.Point
+	}{
+		{image.Point{6000, 4000}, 0, image.Point{6000, 4000}},
+		{image.Point{600, 400}, 1000, image.Point{600, 400}},
+		{image.Point{6000, 4000}, 1500, image.Point{1500, 1000}},
+		{image.Point{4000, 6000}, 1500, image.Point{1000, 1500}},
+		{image.Point{10000, 1}, 100, image.Point{100, 1}},
+	}
+	for _, tc := range tests {
+		if size := fitSize(tc.Size, tc.Max); size != tc.Want {
+			t.Errorf("fitSize(%v, %d): want %v, have %v", tc.Size, tc.Max, tc.Want, size)
+		}
+	}
+}
+
+func TestScale(t *testing.T) {
+	if v := scale(10, 2.5); v != 25 {
+		t.Fatal("unexpected value:", v)
+	}
+	if v := scale(3, 1.5); v != 5 {
+		t.Fatal("unexpected value:", v)
+	}
+}
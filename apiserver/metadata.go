@@ -0,0 +1,527 @@
+package apiserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// MetadataPolicy is the policy for the metadata of defaced images.
+type MetadataPolicy string
+
+// Metadata policies.
+const (
+	// MetadataStrip removes all metadata.
+	MetadataStrip MetadataPolicy = "strip"
+
+	// MetadataStripSensitive removes GPS data, serial numbers
+	// and maker notes from EXIF, and removes XMP and IPTC, which
+	// may have location data.
+	MetadataStripSensitive MetadataPolicy = "sensitive"
+
+	// MetadataAllowlist removes all metadata except for the EXIF
+	// tags and segments in MetadataOptions.Keep.
+	MetadataAllowlist MetadataPolicy = "allowlist"
+)
+
+// MetadataOptions configure the metadata kept in defaced JPEG images.
+// ICC profiles are kept unless StripICC is set, and EXIF thumbnails
+// are always removed since they show the faces.
+type MetadataOptions struct {
+	Policy   MetadataPolicy // default: MetadataStrip
+	Keep     []string       // EXIF tag names, or "xmp" and "iptc"
+	StripICC bool
+}
+
+// maxMetadataBytes is the max size of the head of JPEG images that is
+// kept for reading metadata.
+const maxMetadataBytes = 2 << 20
+
+// Validate checks the policy and the names in the allowlist.
+func (o *MetadataOptions) Validate() error {
+	switch o.Policy {
+	case "", MetadataStrip, MetadataStripSensitive:
+	case MetadataAllowlist:
+		for _, name := range o.Keep {
+			if _, ok := exifTags[name]; !ok && name != "xmp" && name != "iptc" {
+				return fmt.Errorf("unknown metadata tag %q", name)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown metadata policy %q", o.Policy)
+	}
+	return nil
+}
+
+// keeps reports whether the allowlist has the given name.
+func (o *MetadataOptions) keeps(name string) bool {
+	for _, v := range o.Keep {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Signatures of JPEG metadata segments.
+const (
+	sigExif    = "Exif\x00\x00"
+	sigXMP     = "http://ns.adobe.com/xap/1.0/\x00"
+	sigXMPExt  = "http://ns.adobe.com/xmp/extension/\x00"
+	sigICC     = "ICC_PROFILE\x00"
+	sigIPTC    = "Photoshop 3.0\x00"
+	markerAPP1 = 0xe1
+	markerAPP2 = 0xe2
+	markerAPPD = 0xed
+)
+
+// jpegSegment is a marker segment of a JPEG image.
+type jpegSegment struct {
+	Marker byte
+	Data   []byte // payload, without the marker and length
+}
+
+// Bytes returns the encoded segment.
+func (s *jpegSegment) Bytes() []byte {
+	b := make([]byte, 4, 4+len(s.Data))
+	b[0], b[1] = 0xff, s.Marker
+	binary.BigEndian.PutUint16(b[2:], uint16(2+len(s.Data)))
+	return append(b, s.Data...)
+}
+
+// readJPEGSegments returns the marker segments of the head of a JPEG
+// image, up to the start of the image data. Segments cut short by the
+// end of b are ignored.
+func readJPEGSegments(b []byte) []jpegSegment {
+	if len(b) < 2 || b[0] != 0xff || b[1] != 0xd8 {
+		return nil
+	}
+	var segs []jpegSegment
+	for i := 2; i+4 <= len(b); {
+		if b[i] != 0xff {
+			return segs
+		}
+		marker := b[i+1]
+		switch {
+		case marker == 0xff: // fill byte
+			i++
+			continue
+		case marker == 0xda || marker == 0xd9: // SOS, EOI
+			return segs
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7):
+			i += 2
+			continue
+		}
+		n := int(binary.BigEndian.Uint16(b[i+2:]))
+		if n < 2 || i+2+n > len(b) {
+			return segs
+		}
+		segs = append(segs, jpegSegment{marker, b[i+4 : i+2+n]})
+		i += 2 + n
+	}
+	return segs
+}
+
+// filter returns the segments that are kept by the options, with EXIF
+// data scrubbed according to the policy.
+func (o *MetadataOptions) filter(segs []jpegSegment) []jpegSegment {
+	var out []jpegSegment
+	for _, s := range segs {
+		data := string(s.Data)
+		switch {
+		case s.Marker == markerAPP2 && strings.HasPrefix(data, sigICC):
+			if o.StripICC {
+				continue
+			}
+		case s.Marker == markerAPP1 && strings.HasPrefix(data, sigExif):
+			keep := o.keepExifTag()
+			if keep == nil {
+				continue
+			}
+			exif, err := scrubExif(s.Data[len(sigExif):], keep)
+			if err != nil {
+				continue
+			}
+			s.Data = append([]byte(sigExif), exif...)
+		case s.Marker == markerAPP1 && (strings.HasPrefix(data, sigXMP) || strings.HasPrefix(data, sigXMPExt)):
+			if o.Policy != MetadataAllowlist || !o.keeps("xmp") {
+				continue
+			}
+		case s.Marker == markerAPPD && strings.HasPrefix(data, sigIPTC):
+			if o.Policy != MetadataAllowlist || !o.keeps("iptc") {
+				continue
+			}
+		default:
+			continue
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// scrubJPEG returns the JPEG image b with its metadata filtered by the
+// options, without re-encoding the image data. The JFIF and Adobe
+// segments, which affect decoding, are kept along with the tables. It
+// returns nil if the head of b can't be parsed.
+func (o *MetadataOptions) scrubJPEG(b []byte) []byte {
+	if len(b) < 2 || b[0] != 0xff || b[1] != 0xd8 {
+		return nil
+	}
+	var jfif, tables bytes.Buffer
+	for i := 2; i+4 <= len(b); {
+		if b[i] != 0xff {
+			return nil
+		}
+		marker := b[i+1]
+		switch {
+		case marker == 0xff: // fill byte
+			i++
+			continue
+		case marker == 0xda: // SOS
+			out := bytes.NewBuffer(make([]byte, 0, len(b)))
+			out.Write(b[:2])
+			out.Write(jfif.Bytes())
+			for _, s := range o.filter(readJPEGSegments(b[:i])) {
+				out.Write(s.Bytes())
+			}
+			out.Write(tables.Bytes())
+			out.Write(b[i:])
+			return out.Bytes()
+		case marker == 0xd9: // EOI
+			return nil
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7):
+			tables.Write(b[i : i+2])
+			i += 2
+			continue
+		}
+		n := int(binary.BigEndian.Uint16(b[i+2:]))
+		if n < 2 || i+2+n > len(b) {
+			return nil
+		}
+		seg := b[i : i+2+n]
+		switch {
+		case marker == 0xe0 && jfif.Len() == 0 && tables.Len() == 0: // JFIF
+			jfif.Write(seg)
+		case marker == 0xee: // Adobe
+			tables.Write(seg)
+		case marker >= 0xe0 && marker <= 0xef, marker == 0xfe: // APPn, COM
+			// metadata, see filter
+		default:
+			tables.Write(seg)
+		}
+		i += 2 + n
+	}
+	return nil
+}
+
+// EXIF IFDs, and the tags that point to them.
+const (
+	ifd0       = "ifd0"
+	ifdExif    = "exif"
+	ifdGPS     = "gps"
+	ifdInterop = "interop"
+
+	tagExifIFD    = 0x8769
+	tagGPSIFD     = 0x8825
+	tagInteropIFD = 0xa005
+)
+
+var subIFDs = map[uint16]string{
+	tagExifIFD:    ifdExif,
+	tagGPSIFD:     ifdGPS,
+	tagInteropIFD: ifdInterop,
+}
+
+type exifTag struct {
+	IFD string
+	Tag uint16
+}
+
+// exifTags are the EXIF tags that can be kept by an allowlist.
+var exifTags = map[string]exifTag{
+	"ImageDescription":  {ifd0, 0x010e},
+	"Make":              {ifd0, 0x010f},
+	"Model":             {ifd0, 0x0110},
+	"Orientation":       {ifd0, 0x0112},
+	"XResolution":       {ifd0, 0x011a},
+	"YResolution":       {ifd0, 0x011b},
+	"ResolutionUnit":    {ifd0, 0x0128},
+	"Software":          {ifd0, 0x0131},
+	"DateTime":          {ifd0, 0x0132},
+	"Artist":            {ifd0, 0x013b},
+	"YCbCrPositioning":  {ifd0, 0x0213},
+	"Copyright":         {ifd0, 0x8298},
+	"ExposureTime":      {ifdExif, 0x829a},
+	"FNumber":           {ifdExif, 0x829d},
+	"ISOSpeedRatings":   {ifdExif, 0x8827},
+	"ExifVersion":       {ifdExif, 0x9000},
+	"DateTimeOriginal":  {ifdExif, 0x9003},
+	"DateTimeDigitized": {ifdExif, 0x9004},
+	"Flash":             {ifdExif, 0x9209},
+	"FocalLength":       {ifdExif, 0x920a},
+	"ColorSpace":        {ifdExif, 0xa001},
+	"LensModel":         {ifdExif, 0xa434},
+}
+
+// sensitiveExifTags are removed by MetadataStripSensitive.
+var sensitiveExifTags = map[exifTag]bool{
+	{ifd0, 0xc62f}:    true, // CameraSerialNumber
+	{ifdExif, 0x927c}: true, // MakerNote
+	{ifdExif, 0xa431}: true, // BodySerialNumber
+	{ifdExif, 0xa435}: true, // LensSerialNumber
+	{ifd0, tagGPSIFD}: true,
+}
+
+// keepExifTag returns a function that reports whether a tag is kept,
+// or nil if EXIF data is removed altogether.
+func (o *MetadataOptions) keepExifTag() func(exifTag) bool {
+	switch o.Policy {
+	case MetadataStripSensitive:
+		return func(t exifTag) bool {
+			return !sensitiveExifTags[t]
+		}
+	case MetadataAllowlist:
+		keep := make(map[exifTag]bool)
+		for _, name := range o.Keep {
+			if t, ok := exifTags[name]; ok {
+				keep[t] = true
+				if t.IFD == ifdExif {
+					keep[exifTag{ifd0, tagExifIFD}] = true
+				}
+			}
+		}
+		if len(keep) == 0 {
+			return nil
+		}
+		return func(t exifTag) bool {
+			return keep[t]
+		}
+	}
+	return nil
+}
+
+var errBadExif = errors.New("invalid exif data")
+
+// exifTypeSizes are the sizes of the EXIF value types.
+var exifTypeSizes = map[uint16]int{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4,
+}
+
+// scrubExif returns a copy of the given TIFF-encoded EXIF data without
+// the tags that are not kept, and without the thumbnail image. Removed
+// entries and their data are zeroed, and offsets are left unchanged.
+func scrubExif(b []byte, keep func(exifTag) bool) ([]byte, error) {
+	if len(b) < 8 {
+		return nil, errBadExif
+	}
+	x := &exifScrubber{b: append([]byte(nil), b...), keep: keep}
+	switch string(b[:4]) {
+	case "II*\x00":
+		x.bo = binary.LittleEndian
+	case "MM\x00*":
+		x.bo = binary.BigEndian
+	default:
+		return nil, errBadExif
+	}
+	off := int(x.bo.Uint32(x.b[4:]))
+	next, err := x.scrub(ifd0, off, 0)
+	if err != nil {
+		return nil, err
+	}
+	// IFD1 is the thumbnail of the original image
+	if next != 0 {
+		x.zeroIFD(next, 0)
+		x.bo.PutUint32(x.b[x.ifdEnd(off)-4:], 0)
+	}
+	return x.b, nil
+}
+
+type exifScrubber struct {
+	b    []byte
+	bo   binary.ByteOrder
+	keep func(exifTag) bool
+}
+
+// entry returns the tag, type and value size of the IFD entry at off,
+// and the offset of its value.
+func (x *exifScrubber) entry(off int) (tag uint16, size, valueOff int, err error) {
+	tag = x.bo.Uint16(x.b[off:])
+	typ := x.bo.Uint16(x.b[off+2:])
+	count := int(x.bo.Uint32(x.b[off+4:]))
+	ts, ok := exifTypeSizes[typ]
+	if !ok || count < 0 || count > len(x.b) {
+		return 0, 0, 0, errBadExif
+	}
+	size = ts * count
+	valueOff = off + 8
+	if size > 4 {
+		valueOff = int(x.bo.Uint32(x.b[off+8:]))
+	}
+	if valueOff < 0 || valueOff+size > len(x.b) {
+		return 0, 0, 0, errBadExif
+	}
+	return tag, size, valueOff, nil
+}
+
+// ifdEnd returns the offset after the IFD at off, past its next IFD
+// offset. The IFD must have been validated.
+func (x *exifScrubber) ifdEnd(off int) int {
+	return off + 2 + 12*int(x.bo.Uint16(x.b[off:])) + 4
+}
+
+// validIFD reports whether an IFD fits at off.
+func (x *exifScrubber) validIFD(off int) bool {
+	if off < 8 || off+2 > len(x.b) {
+		return false
+	}
+	return x.ifdEnd(off) <= len(x.b)
+}
+
+// scrub removes the entries of the IFD at off that are not kept, and
+// returns the offset of the next IFD.
+func (x *exifScrubber) scrub(ifd string, off, depth int) (int, error) {
+	if depth > 4 || !x.validIFD(off) {
+		return 0, errBadExif
+	}
+	n := int(x.bo.Uint16(x.b[off:]))
+	next := int(x.bo.Uint32(x.b[off+2+12*n:]))
+	var kept [][]byte
+	for i := 0; i < n; i++ {
+		e := off + 2 + 12*i
+		tag, size, valueOff, err := x.entry(e)
+		if err != nil {
+			return 0, err
+		}
+		sub, isSub := subIFDs[tag]
+		if x.keep(exifTag{ifd, tag}) {
+			if isSub {
+				if _, err = x.scrub(sub, int(x.bo.Uint32(x.b[valueOff:])), depth+1); err != nil {
+					return 0, err
+				}
+			}
+			kept = append(kept, append([]byte(nil), x.b[e:e+12]...))
+			continue
+		}
+		if isSub {
+			x.zeroIFD(int(x.bo.Uint32(x.b[valueOff:])), depth+1)
+		}
+		zero(x.b[valueOff : valueOff+size])
+	}
+	// rewrite the IFD with the entries that are kept
+	end := x.ifdEnd(off)
+	zero(x.b[off:end])
+	x.bo.PutUint16(x.b[off:], uint16(len(kept)))
+	for i, e := range kept {
+		copy(x.b[off+2+12*i:], e)
+	}
+	x.bo.PutUint32(x.b[off+2+12*len(kept):], uint32(next))
+	return next, nil
+}
+
+// zeroIFD zeroes the IFD at off, its sub-IFDs and all their data.
+func (x *exifScrubber) zeroIFD(off, depth int) {
+	if depth > 4 || !x.validIFD(off) {
+		return
+	}
+	n := int(x.bo.Uint16(x.b[off:]))
+	// zero what the entries point to before zeroing the entries
+	for _, pass := range []int{0, 1} {
+		for i := 0; i < n; i++ {
+			e := off + 2 + 12*i
+			tag, size, valueOff, err := x.entry(e)
+			if err != nil {
+				continue
+			}
+			if pass == 1 {
+				zero(x.b[valueOff : valueOff+size])
+				continue
+			}
+			if _, ok := subIFDs[tag]; ok {
+				x.zeroIFD(int(x.bo.Uint32(x.b[valueOff:])), depth+1)
+			}
+			if tag == 0x0201 { // JPEGInterchangeFormat
+				x.zeroThumbnail(off, valueOff)
+			}
+		}
+	}
+	zero(x.b[off:x.ifdEnd(off)])
+}
+
+// zeroThumbnail zeroes the JPEG thumbnail pointed to by the value at
+// valueOff, in the IFD at off.
+func (x *exifScrubber) zeroThumbnail(off, valueOff int) {
+	start := int(x.bo.Uint32(x.b[valueOff:]))
+	n := int(x.bo.Uint16(x.b[off:]))
+	for i := 0; i < n; i++ {
+		e := off + 2 + 12*i
+		if x.bo.Uint16(x.b[e:]) != 0x0202 { // JPEGInterchangeFormatLength
+			continue
+		}
+		_, _, lenOff, err := x.entry(e)
+		if err != nil {
+			return
+		}
+		end := start + int(x.bo.Uint32(x.b[lenOff:]))
+		if start >= 8 && start <= end && end <= len(x.b) {
+			zero(x.b[start:end])
+		}
+	}
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// jpegSegmentWriter writes a JPEG image to W, inserting Segments after
+// the start of image marker.
+type jpegSegmentWriter struct {
+	W        io.Writer
+	Segments []jpegSegment
+	n        int // bytes of the start of image marker written
+}
+
+func (w *jpegSegmentWriter) Write(p []byte) (int, error) {
+	if w.n >= 2 {
+		return w.W.Write(p)
+	}
+	k := 2 - w.n
+	if len(p) < k {
+		k = len(p)
+	}
+	if _, err := w.W.Write(p[:k]); err != nil {
+		return 0, err
+	}
+	w.n += k
+	if w.n == 2 {
+		var b bytes.Buffer
+		for _, s := range w.Segments {
+			b.Write(s.Bytes())
+		}
+		if _, err := w.W.Write(b.Bytes()); err != nil {
+			return k, err
+		}
+	}
+	n, err := w.W.Write(p[k:])
+	return k + n, err
+}
+
+// headBuffer keeps up to max bytes written to it, and discards the rest.
+type headBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *headBuffer) Write(p []byte) (int, error) {
+	if n := b.max - b.Len(); n < len(p) {
+		if n > 0 {
+			b.Buffer.Write(p[:n])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
@@ -0,0 +1,179 @@
+package apiserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+// testExif returns little endian TIFF data with IFD0, EXIF and GPS IFDs
+// and a thumbnail in IFD1.
+func testExif() []byte {
+	le := binary.LittleEndian
+	b := make([]byte, 512)
+	copy(b, "II*\x00")
+	le.PutUint32(b[4:], 8)
+	entry := func(off int, tag, typ uint16, count, value uint32) {
+		le.PutUint16(b[off:], tag)
+		le.PutUint16(b[off+2:], typ)
+		le.PutUint32(b[off+4:], count)
+		le.PutUint32(b[off+8:], value)
+	}
+	// IFD0 at 8: Orientation, Make, ExifIFD, GPSIFD
+	le.PutUint16(b[8:], 4)
+	entry(10, 0x0112, 3, 1, 6)
+	entry(22, 0x010f, 2, 12, 300)
+	entry(34, tagExifIFD, 4, 1, 100)
+	entry(46, tagGPSIFD, 4, 1, 200)
+	le.PutUint32(b[58:], 400) // IFD1
+	copy(b[300:], "SecretMake!\x00")
+	// EXIF IFD at 100: DateTimeOriginal, BodySerialNumber
+	le.PutUint16(b[100:], 2)
+	entry(102, 0x9003, 2, 20, 320)
+	entry(114, 0xa431, 2, 12, 340)
+	copy(b[320:], "2015:10:21 16:29:00\x00")
+	copy(b[340:], "SERIAL12345\x00")
+	// GPS IFD at 200: GPSLatitude
+	le.PutUint16(b[200:], 1)
+	entry(202, 0x0002, 5, 3, 360)
+	copy(b[360:], "LATITUDELATITUDELATITUDE")
+	// IFD1 at 400: thumbnail
+	le.PutUint16(b[400:], 2)
+	entry(402, 0x0201, 4, 1, 440)
+	entry(414, 0x0202, 4, 1, 16)
+	copy(b[440:], "THUMBNAILTHUMBNA")
+	return b
+}
+
+func TestScrubExifSensitive(t *testing.T) {
+	o := &MetadataOptions{Policy: MetadataStripSensitive}
+	b, err := scrubExif(testExif(), o.keepExifTag())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"SecretMake", "2015:10:21"} {
+		if !bytes.Contains(b, []byte(v)) {
+			t.Errorf("%q was removed", v)
+		}
+	}
+	for _, v := range []string{"SERIAL", "LATITUDE", "THUMBNAIL"} {
+		if bytes.Contains(b, []byte(v)) {
+			t.Errorf("%q was not removed", v)
+		}
+	}
+	if n := binary.LittleEndian.Uint16(b[8:]); n != 3 {
+		t.Fatal("unexpected number of IFD0 entries:", n)
+	}
+	if next := binary.LittleEndian.Uint32(b[10+12*3:]); next != 0 {
+		t.Fatal("IFD1 was not removed")
+	}
+}
+
+func TestScrubExifAllowlist(t *testing.T) {
+	o := &MetadataOptions{
+		Policy: MetadataAllowlist,
+		Keep:   []string{"Orientation"},
+	}
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := scrubExif(testExif(), o.keepExifTag())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"SecretMake", "2015:10:21", "SERIAL", "LATITUDE", "THUMBNAIL"} {
+		if bytes.Contains(b, []byte(v)) {
+			t.Errorf("%q was not removed", v)
+		}
+	}
+	if n := binary.LittleEndian.Uint16(b[8:]); n != 1 {
+		t.Fatal("unexpected number of IFD0 entries:", n)
+	}
+	if tag := binary.LittleEndian.Uint16(b[10:]); tag != 0x0112 {
+		t.Fatalf("unexpected tag: %#x", tag)
+	}
+	o.Keep = []string{"GPSLatitude"}
+	if err = o.Validate(); err == nil {
+		t.Fatal("unknown tag accepted")
+	}
+}
+
+func TestMetadataFilter(t *testing.T) {
+	segs := []jpegSegment{
+		{markerAPP1, append([]byte(sigExif), testExif()...)},
+		{markerAPP1, []byte(sigXMP + "<x:xmpmeta/>")},
+		{markerAPP2, []byte(sigICC + "\x01\x01profile")},
+		{markerAPPD, []byte(sigIPTC + "8BIM")},
+		{0xfe, []byte("comment")},
+	}
+	markers := func(segs []jpegSegment) string {
+		var b []byte
+		for _, s := range segs {
+			b = append(b, s.Marker)
+		}
+		return string(b)
+	}
+	tests := []struct {
+		Options MetadataOptions
+		Want    []byte
+	}{
+		{MetadataOptions{}, []byte{markerAPP2}},
+		{MetadataOptions{StripICC: true}, nil},
+		{MetadataOptions{Policy: MetadataStripSensitive}, []byte{markerAPP1, markerAPP2}},
+		{MetadataOptions{Policy: MetadataAllowlist, Keep: []string{"xmp", "iptc"}}, []byte{markerAPP1, markerAPP2, markerAPPD}},
+	}
+	for i, tc := range tests {
+		if have := markers(tc.Options.filter(segs)); have != string(tc.Want) {
+			t.Errorf("test %d: want segments %x, have %x", i, tc.Want, have)
+		}
+	}
+}
+
+func TestJPEGSegmentWriter(t *testing.T) {
+	segs := []jpegSegment{
+		{markerAPP1, append([]byte(sigExif), testExif()...)},
+		{markerAPP2, []byte(sigICC + "\x01\x01profile")},
+	}
+	var b bytes.Buffer
+	w := &jpegSegmentWriter{W: &b, Segments: segs}
+	m := image.NewGray(image.Rect(0, 0, 16, 16))
+	if err := jpeg.Encode(w, m, nil); err != nil {
+		t.Fatal(err)
+	}
+	have := readJPEGSegments(b.Bytes())
+	if len(have) < len(segs) {
+		t.Fatal("missing segments:", len(have))
+	}
+	for i, s := range segs {
+		if have[i].Marker != s.Marker || !bytes.Equal(have[i].Data, s.Data) {
+			t.Fatalf("unexpected segment %d: %x", i, have[i].Marker)
+		}
+	}
+	if _, err := jpeg.Decode(&b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScrubJPEG(t *testing.T) {
+	src := exifJPEG(t)
+	o := &MetadataOptions{}
+	b := o.scrubJPEG(src)
+	if b == nil {
+		t.Fatal("failed to scrub")
+	}
+	if segs := readJPEGSegments(b); len(segs) == 0 || segs[0].Marker == markerAPP1 || segs[0].Marker == 0xfe {
+		t.Fatal("metadata was not removed")
+	}
+	// the image data is unchanged
+	if sos := bytes.Index(src, []byte{0xff, 0xda}); !bytes.HasSuffix(b, src[sos:]) {
+		t.Fatal("image data was modified")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	if o.scrubJPEG(src[:20]) != nil {
+		t.Fatal("truncated image scrubbed")
+	}
+}
@@ -1,6 +1,11 @@
 package apiserver
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"image"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
 
 var defacerImageDefaceSum = prometheus.NewCounter(
 	prometheus.CounterOpts{
@@ -30,6 +35,21 @@ var defacerImageCacheItemsCount = prometheus.NewGauge(
 	},
 )
 
+var defacerImageCacheBytes = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "defacer_image_cache_bytes",
+		Help: "Total bytes cached",
+	},
+)
+
+var defacerImageCacheEvictionsSum = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "defacer_image_cache_evictions_sum",
+		Help: "Total cache evictions",
+	},
+	[]string{"reason"},
+)
+
 var defacerImageResizeCoalesceSum = prometheus.NewCounter(
 	prometheus.CounterOpts{
 		Name: "defacer_image_resize_coalesce_sum",
@@ -37,10 +57,169 @@ var defacerImageResizeCoalesceSum = prometheus.NewCounter(
 	},
 )
 
+var defacerImageDetectSeconds = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name: "defacer_image_detect_seconds",
+		Help: "Face detection latency by original image size",
+	},
+	[]string{"size"},
+)
+
+var defacerImageDefaceSeconds = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name: "defacer_image_deface_seconds",
+		Help: "Deface latency by original image size",
+	},
+	[]string{"size"},
+)
+
+var defacerImageDetectTilesSum = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "defacer_image_detect_tiles_sum",
+		Help: "Total image tiles scanned, by the pool or locally",
+	},
+	[]string{"worker"},
+)
+
+var defacerImageFormatSum = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "defacer_image_format_sum",
+		Help: "Total images served, by source and output format",
+	},
+	[]string{"source", "output"},
+)
+
+var defacerResultCacheHitsSum = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "defacer_result_cache_hits_sum",
+		Help: "Total result cache hits, by tier",
+	},
+	[]string{"tier"},
+)
+
+var defacerResultCacheMissSum = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "defacer_result_cache_miss_sum",
+		Help: "Total result cache miss",
+	},
+)
+
+var defacerResultCacheBytes = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "defacer_result_cache_bytes",
+		Help: "Total bytes of results cached, by tier",
+	},
+	[]string{"tier"},
+)
+
+var defacerResultCacheRevalidationsSum = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "defacer_result_cache_revalidations_sum",
+		Help: "Total stale results revalidated upstream, by outcome",
+	},
+	[]string{"outcome"},
+)
+
+var defacerBatchItemsSum = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "defacer_batch_items_sum",
+		Help: "Total batch items, by status code",
+	},
+	[]string{"status"},
+)
+
+var defacerJobsSum = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "defacer_jobs_sum",
+		Help: "Total jobs created and done",
+	},
+	[]string{"status"},
+)
+
+var defacerJobCallbacksSum = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "defacer_job_callbacks_sum",
+		Help: "Total job callbacks, by result",
+	},
+	[]string{"result"},
+)
+
+var defacerGRPCRequestsSum = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "defacer_grpc_requests_sum",
+		Help: "Total gRPC requests, by method and status code",
+	},
+	[]string{"method", "code"},
+)
+
+var defacerAPIKeyRequestsSum = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "defacer_api_key_requests_sum",
+		Help: "Total API requests, by key name and result",
+	},
+	[]string{"key", "result"},
+)
+
+var defacerSignedRequestsSum = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "defacer_signed_requests_sum",
+		Help: "Total requests checked for signatures, by result",
+	},
+	[]string{"result"},
+)
+
+var defacerClientRejectionsSum = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "defacer_client_rejections_sum",
+		Help: "Total requests rejected by the per-client limits, by reason",
+	},
+	[]string{"reason"},
+)
+
+// imageSizeLabel returns the label of the size class of m, in megapixels.
+func imageSizeLabel(m image.Image) string {
+	b := m.Bounds()
+	switch px := b.Dx() * b.Dy(); {
+	case px <= 1000000:
+		return "1MP"
+	case px <= 4000000:
+		return "4MP"
+	case px <= 12000000:
+		return "12MP"
+	case px <= 24000000:
+		return "24MP"
+	default:
+		return "+Inf"
+	}
+}
+
+// observeImageSeconds observes the time since start in the given
+// histogram, labelled by the size class of m.
+func observeImageSeconds(h *prometheus.HistogramVec, m image.Image, start time.Time) {
+	h.WithLabelValues(imageSizeLabel(m)).Observe(time.Since(start).Seconds())
+}
+
 func init() {
 	prometheus.MustRegister(defacerImageDefaceSum)
 	prometheus.MustRegister(defacerImageCacheHitsSum)
 	prometheus.MustRegister(defacerImageCacheMissSum)
 	prometheus.MustRegister(defacerImageCacheItemsCount)
+	prometheus.MustRegister(defacerImageCacheBytes)
+	prometheus.MustRegister(defacerImageCacheEvictionsSum)
 	prometheus.MustRegister(defacerImageResizeCoalesceSum)
+	prometheus.MustRegister(defacerImageDetectSeconds)
+	prometheus.MustRegister(defacerImageDefaceSeconds)
+	prometheus.MustRegister(defacerImageDetectTilesSum)
+	prometheus.MustRegister(defacerImageFormatSum)
+	prometheus.MustRegister(defacerResultCacheHitsSum)
+	prometheus.MustRegister(defacerResultCacheMissSum)
+	prometheus.MustRegister(defacerResultCacheBytes)
+	prometheus.MustRegister(defacerResultCacheRevalidationsSum)
+	prometheus.MustRegister(defacerBatchItemsSum)
+	prometheus.MustRegister(defacerJobsSum)
+	prometheus.MustRegister(defacerJobCallbacksSum)
+	prometheus.MustRegister(defacerGRPCRequestsSum)
+	prometheus.MustRegister(defacerAPIKeyRequestsSum)
+	prometheus.MustRegister(defacerSignedRequestsSum)
+	prometheus.MustRegister(defacerClientRejectionsSum)
 }
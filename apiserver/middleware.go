@@ -0,0 +1,257 @@
+package apiserver
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// DefaceMiddleware returns a handler that defaces the images served by
+// next. Responses with an image content type, set by next or sniffed
+// from the first write, are buffered and defaced, and re-encoded in
+// the same format when possible. Other responses are streamed, and
+// can be flushed and hijacked.
+//
+// Range requests are served in full, so that partial images are
+// never served unredacted. Defaced images have a weak ETag derived
+// from the one of next, and no Last-Modified, and their tags in
+// If-None-Match are replaced by the ones of next. If opts is nil the
+// default options are used.
+func DefaceMiddleware(df Defacer, opts *MiddlewareOptions, next http.Handler) http.Handler {
+	if opts == nil {
+		opts = &MiddlewareOptions{}
+	}
+	prefix := opts.etagPrefix()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inm := r.Header.Get("If-None-Match")
+		if r.Header.Get("Range") != "" || inm != "" {
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.Header = cloneHeader(r.Header)
+			r2.Header.Del("Range")
+			r2.Header.Del("If-Range")
+			r2.Header.Del("If-None-Match")
+			if v := upstreamConditions(r, prefix).Get("If-None-Match"); v != "" {
+				r2.Header.Set("If-None-Match", v)
+			}
+			r = r2
+		}
+		dw := &defaceWriter{
+			ResponseWriter: w,
+			Request:        r,
+			Options:        opts,
+			prefix:         prefix,
+			inm:            inm,
+		}
+		next.ServeHTTP(dw, r)
+		dw.finish(df)
+	})
+}
+
+// MiddlewareOptions are the options of DefaceMiddleware. Encode and
+// Metadata must be valid, see their Validate methods.
+type MiddlewareOptions struct {
+	Deface   DefaceOptions // KeepSource passes images without faces through
+	Encode   EncodeOptions
+	Metadata MetadataOptions // of JPEG images, passed through or not
+
+	// MaxBytes is the max size of the images served by next, which
+	// are buffered to be defaced. Larger images are replaced by an
+	// error. Default: no limit.
+	MaxBytes int64
+}
+
+// etagPrefix returns the prefix of the ETags of defaced images, see
+// proxy.etagPrefix. The resizer is not part of it, as it can't be
+// compared across processes.
+func (o *MiddlewareOptions) etagPrefix() string {
+	d := o.Deface
+	h := fnv.New64a()
+	fmt.Fprintf(h, "middleware\n%t %d %d %d\n%+v\n%+v",
+		d.KeepSource, d.MaxDetectSize, d.TileSize, d.TileOverlap, o.Encode, o.Metadata,
+	)
+	return fmt.Sprintf("df-%016x-", h.Sum64())
+}
+
+// defaceWriter is the http.ResponseWriter of DefaceMiddleware. It
+// decides whether to buffer the response once the status code and
+// content type are known.
+type defaceWriter struct {
+	http.ResponseWriter
+	Request *http.Request
+	Options *MiddlewareOptions
+	prefix  string // of defaced ETags
+	inm     string // If-None-Match of the client
+	status  int
+	decided bool
+	format  *imageFormat // format of buffered images
+	buf     bytes.Buffer
+	large   bool // the image exceeds MaxBytes
+}
+
+// WriteHeader implements the http.ResponseWriter interface. Without a
+// content type the decision is deferred until the first write.
+func (dw *defaceWriter) WriteHeader(code int) {
+	if dw.decided || dw.status != 0 {
+		return
+	}
+	dw.status = code
+	if dw.Header().Get("Content-Type") != "" {
+		dw.decide(nil)
+	}
+}
+
+// Write implements the http.ResponseWriter interface.
+func (dw *defaceWriter) Write(p []byte) (int, error) {
+	if !dw.decided {
+		dw.decide(p)
+	}
+	if dw.format == nil {
+		return dw.ResponseWriter.Write(p)
+	}
+	if max := dw.Options.MaxBytes; dw.large || max > 0 && int64(dw.buf.Len()+len(p)) > max {
+		dw.large = true
+		dw.buf.Reset()
+		return 0, errImageTooLarge
+	}
+	return dw.buf.Write(p)
+}
+
+// Flush implements the http.Flusher interface. Images are only sent
+// when the handler returns.
+func (dw *defaceWriter) Flush() {
+	if !dw.decided {
+		dw.decide(nil)
+	}
+	if dw.format != nil {
+		return
+	}
+	if f, ok := dw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements the http.Hijacker interface.
+func (dw *defaceWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if dw.format != nil {
+		return nil, nil, errors.New("Can't hijack an image response")
+	}
+	h, ok := dw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Hijacking not supported")
+	}
+	dw.decided = true
+	return h.Hijack()
+}
+
+// decide buffers the response if it's an image with a body, sniffing
+// the content type from p if it's not set. Other responses have their
+// header written.
+func (dw *defaceWriter) decide(p []byte) {
+	dw.decided = true
+	if dw.status == 0 {
+		dw.status = http.StatusOK
+	}
+	h := dw.Header()
+	f := formatByContentType(h.Get("Content-Type"))
+	if f == nil && h.Get("Content-Type") == "" {
+		if f = sniffFormat(p); f != nil {
+			h.Set("Content-Type", f.ContentType)
+		}
+	}
+	if dw.status == http.StatusNotModified {
+		dw.notModified()
+	}
+	switch {
+	case f == nil,
+		dw.Request.Method == "HEAD",
+		dw.status == http.StatusNoContent,
+		dw.status == http.StatusNotModified:
+		dw.ResponseWriter.WriteHeader(dw.status)
+		return
+	}
+	dw.format = f
+}
+
+// notModified replaces the ETag of a 304 response of next by the one
+// of the defaced image when that is the tag the client has.
+func (dw *defaceWriter) notModified() {
+	h := dw.Header()
+	etag := h.Get("ETag")
+	if etag == "" {
+		return
+	}
+	if defaced := defacedETag(dw.prefix, etag); etagMatch(dw.inm, defaced) {
+		h.Set("ETag", defaced)
+		h.Del("Last-Modified")
+	}
+}
+
+// finish defaces the buffered image, if any, and writes it. The
+// metadata of JPEG images is filtered, and sources without faces are
+// passed through unless that fails.
+func (dw *defaceWriter) finish(df Defacer) {
+	if !dw.decided {
+		dw.decide(nil)
+	}
+	if dw.format == nil {
+		return
+	}
+	if dw.large {
+		dw.error(http.StatusBadGateway, errImageTooLarge)
+		return
+	}
+	h := dw.Header()
+	src := dw.buf.Bytes()
+	opts := dw.Options.Deface
+	res, err := df.Deface(bytes.NewReader(src), &opts)
+	if err != nil {
+		dw.error(http.StatusInternalServerError, err)
+		return
+	}
+	format := dw.format
+	body := res.Source
+	if body != nil && format.Name == "jpeg" {
+		body = dw.Options.Metadata.scrubJPEG(body)
+	}
+	if body != nil {
+		h.Set("X-Defacer-Passthrough", "true")
+	} else {
+		if format.Encode == nil {
+			format = defaultOutputFormat
+		}
+		var b bytes.Buffer
+		var out io.Writer = &b
+		if dw.format.Name == "jpeg" && format.Name == "jpeg" {
+			segs := dw.Options.Metadata.filter(readJPEGSegments(src))
+			out = &jpegSegmentWriter{W: &b, Segments: segs}
+		}
+		if err = format.Encode(out, res.Image, &dw.Options.Encode); err != nil {
+			dw.error(http.StatusInternalServerError, err)
+			return
+		}
+		body = b.Bytes()
+	}
+	defacerImageFormatSum.WithLabelValues(dw.format.Name, format.Name).Inc()
+	if etag := h.Get("ETag"); etag != "" {
+		h.Set("ETag", defacedETag(dw.prefix, etag))
+	}
+	h.Del("Last-Modified")
+	h.Set("Content-Type", format.ContentType)
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	h.Set("X-Defacer-Faces", strconv.Itoa(len(res.Faces)))
+	dw.ResponseWriter.WriteHeader(dw.status)
+	dw.ResponseWriter.Write(body)
+}
+
+// error replies with err, without the validators and length of next.
+func (dw *defaceWriter) error(status int, err error) {
+	errorHeader(dw.Header())
+	http.Error(dw.ResponseWriter, err.Error(), status)
+}
@@ -0,0 +1,244 @@
+package apiserver
+
+import (
+	"bufio"
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/fiorix/defacer/apiserver/internal"
+)
+
+func newTestMiddleware(t *testing.T, opts *MiddlewareOptions, next http.Handler) http.Handler {
+	overlay, err := internal.DefaultDefaceImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	df, err := NewDefacer(NewImageResizer(overlay, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return DefaceMiddleware(df, opts, next)
+}
+
+func TestDefaceMiddleware(t *testing.T) {
+	src := blankPNG(t)
+	h := newTestMiddleware(t, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			t.Error("range request was forwarded")
+		}
+		switch r.URL.Path {
+		case "/typed.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Header().Set("Content-Length", strconv.Itoa(len(src)))
+			w.Write(src[:10])
+			w.Write(src[10:])
+		case "/sniffed":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write(src)
+		case "/invalid.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("not an image"))
+		default:
+			w.Write([]byte("hello"))
+		}
+	}))
+	for _, path := range []string{"/typed.png", "/sniffed"} {
+		r, _ := http.NewRequest("GET", path, nil)
+		r.Header.Set("Range", "bytes=0-10")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Header().Get("X-Defacer-Faces") != "0" {
+			t.Fatalf("%s: image was not defaced", path)
+		}
+		if v := w.Header().Get("Content-Length"); v != strconv.Itoa(w.Body.Len()) {
+			t.Fatalf("%s: unexpected content length: %s", path, v)
+		}
+		if _, f, err := image.Decode(w.Body); err != nil || f != "png" {
+			t.Fatalf("%s: unexpected image: %q %v", path, f, err)
+		}
+	}
+	r, _ := http.NewRequest("GET", "/sniffed", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Fatal("unexpected status:", w.Code)
+	}
+	r, _ = http.NewRequest("GET", "/invalid.png", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatal("unexpected status:", w.Code)
+	}
+	r, _ = http.NewRequest("GET", "/hello", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Body.String() != "hello" || w.Header().Get("X-Defacer-Faces") != "" {
+		t.Fatal("unexpected response:", w.Body.String())
+	}
+}
+
+func TestDefaceMiddlewareOptions(t *testing.T) {
+	src := blankPNG(t)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(src)
+	})
+	serve := func(h http.Handler, inm string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", "/image.png", nil)
+		if inm != "" {
+			r.Header.Set("If-None-Match", inm)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	fast := &MiddlewareOptions{Encode: EncodeOptions{PNGCompression: png.NoCompression}}
+	h := newTestMiddleware(t, fast, next)
+	w := serve(h, "")
+	etag := w.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `W/"df-`) || w.Header().Get("Last-Modified") != "" {
+		t.Fatal("unexpected validators:", w.Header())
+	}
+	if w.Body.Len() <= len(src) {
+		t.Fatal("encode options not used:", w.Body.Len(), len(src))
+	}
+	w = serve(h, etag)
+	if w.Code != http.StatusNotModified || w.Header().Get("ETag") != etag || w.Header().Get("Last-Modified") != "" {
+		t.Fatal("unexpected response:", w.Code, w.Header())
+	}
+	// tags of images defaced with other options don't match
+	if w = serve(newTestMiddleware(t, nil, next), etag); w.Code != http.StatusOK {
+		t.Fatal("unexpected status:", w.Code)
+	}
+	// the source of images without faces is passed through
+	keep := &MiddlewareOptions{Deface: DefaceOptions{KeepSource: true}}
+	w = serve(newTestMiddleware(t, keep, next), "")
+	if !bytes.Equal(w.Body.Bytes(), src) || w.Header().Get("X-Defacer-Passthrough") != "true" {
+		t.Fatal("image not passed through:", w.Header())
+	}
+	if v := w.Header().Get("ETag"); v == etag || !strings.HasPrefix(v, `W/"df-`) {
+		t.Fatal("unexpected etag:", v)
+	}
+}
+
+func TestDefaceMiddlewareMetadata(t *testing.T) {
+	m := image.NewGray(image.Rect(0, 0, 64, 64))
+	for i := range m.Pix {
+		m.Pix[i] = 0xff
+	}
+	var b bytes.Buffer
+	w := &jpegSegmentWriter{W: &b, Segments: []jpegSegment{
+		{markerAPP1, append([]byte(sigExif), testExif()...)},
+		{markerAPP2, []byte(sigICC + "\x01\x01PROFILE")},
+	}}
+	if err := jpeg.Encode(w, m, nil); err != nil {
+		t.Fatal(err)
+	}
+	src := b.Bytes()
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(src)
+	})
+	for _, keep := range []bool{true, false} {
+		h := newTestMiddleware(t, &MiddlewareOptions{
+			Deface:   DefaceOptions{KeepSource: keep},
+			Metadata: MetadataOptions{Policy: MetadataStripSensitive},
+		}, next)
+		r, _ := http.NewRequest("GET", "/image.jpg", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if have := w.Header().Get("X-Defacer-Passthrough") == "true"; have != keep {
+			t.Fatalf("keep=%t: unexpected passthrough header", keep)
+		}
+		out := w.Body.Bytes()
+		if bytes.Contains(out, []byte("LATITUDE")) || bytes.Contains(out, []byte("SERIAL")) {
+			t.Errorf("keep=%t: sensitive metadata was not removed", keep)
+		}
+		if !bytes.Contains(out, []byte("SecretMake")) || !bytes.Contains(out, []byte("PROFILE")) {
+			t.Errorf("keep=%t: metadata was removed", keep)
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+			t.Fatalf("keep=%t: %v", keep, err)
+		}
+	}
+}
+
+func TestDefaceMiddlewareMaxBytes(t *testing.T) {
+	src := blankPNG(t)
+	h := newTestMiddleware(t, &MiddlewareOptions{MaxBytes: int64(len(src) - 1)}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(src[:10])
+		if _, err := w.Write(src[10:]); err != errImageTooLarge {
+			t.Error("unexpected error:", err)
+		}
+	}))
+	r, _ := http.NewRequest("GET", "/image.png", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusBadGateway || w.Header().Get("ETag") != "" {
+		t.Fatal("unexpected response:", w.Code, w.Header())
+	}
+}
+
+func TestDefaceMiddlewareStream(t *testing.T) {
+	flushed := make(chan bool)
+	h := newTestMiddleware(t, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hijack" {
+			conn, rw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\n\r\nhijacked")
+			rw.Flush()
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("first\n"))
+		w.(http.Flusher).Flush()
+		<-flushed
+		w.Write([]byte("second\n"))
+	}))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	br := bufio.NewReader(resp.Body)
+	line, err := br.ReadString('\n')
+	if err != nil || line != "first\n" {
+		t.Fatal("unexpected line:", line, err)
+	}
+	close(flushed)
+	rest, _ := ioutil.ReadAll(br)
+	if string(rest) != "second\n" {
+		t.Fatal("unexpected line:", string(rest))
+	}
+	resp, err = http.Get(srv.URL + "/hijack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	if !bytes.Equal(b, []byte("hijacked")) {
+		t.Fatal("unexpected body:", string(b))
+	}
+}
@@ -0,0 +1,151 @@
+package apiserver
+
+import (
+	"fmt"
+	"image"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Reserved overlay names that select one of the named overlays per face.
+const (
+	OverlayRandom = "random"
+	OverlayRotate = "rotate"
+)
+
+// overlayExts are the file extensions loaded by LoadOverlayDir.
+var overlayExts = map[string]bool{
+	".gif":  true,
+	".jpeg": true,
+	".jpg":  true,
+	".png":  true,
+}
+
+// OverlaySet is a set of named overlay images.
+type OverlaySet struct {
+	names    []string
+	resizers map[string]ImageResizer
+	next     uint32
+	cache    *ImageCache // closed with the set, if created by it
+}
+
+// NewOverlaySet creates an OverlaySet from the given named images.
+// The overlays are resized with the given options, see NewImageResizer.
+// Without a Cache, the overlays share a new one that is closed with the
+// set.
+func NewOverlaySet(images map[string]image.Image, opts *ImageResizerOptions) (*OverlaySet, error) {
+	s := &OverlaySet{resizers: make(map[string]ImageResizer)}
+	if opts == nil || opts.Cache == nil {
+		o := ImageResizerOptions{}
+		if opts != nil {
+			o = *opts
+		}
+		s.cache = NewImageCache(DefaultImageCacheBytes, DefaultImageCacheTTL)
+		o.Cache = s.cache
+		opts = &o
+	}
+	for name, m := range images {
+		if name == OverlayRandom || name == OverlayRotate {
+			s.Close()
+			return nil, fmt.Errorf("overlay name %q is reserved", name)
+		}
+		s.names = append(s.names, name)
+		s.resizers[name] = NewImageResizer(m, opts)
+	}
+	sort.Strings(s.names)
+	return s, nil
+}
+
+// LoadOverlayDir loads all images in dir into an OverlaySet. Overlays
+// are named after their file name, without the extension.
+func LoadOverlayDir(dir string, opts *ImageResizerOptions) (*OverlaySet, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	images := make(map[string]image.Image)
+	for _, fi := range files {
+		ext := strings.ToLower(filepath.Ext(fi.Name()))
+		if fi.IsDir() || !overlayExts[ext] {
+			continue
+		}
+		m, err := loadImageFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("overlay %q: %v", fi.Name(), err)
+		}
+		images[strings.TrimSuffix(fi.Name(), filepath.Ext(fi.Name()))] = m
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("no overlay images in %q", dir)
+	}
+	return NewOverlaySet(images, opts)
+}
+
+// loadImageFile decodes the image stored in the given file.
+func loadImageFile(name string) (image.Image, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, _, err := image.Decode(f)
+	return m, err
+}
+
+// Close closes the resizers of the set, and its cache if it was
+// created by it.
+func (s *OverlaySet) Close() error {
+	for _, ir := range s.resizers {
+		ir.Close()
+	}
+	if s.cache != nil {
+		return s.cache.Close()
+	}
+	return nil
+}
+
+// Names returns the sorted names of the overlays in the set.
+func (s *OverlaySet) Names() []string {
+	return s.names
+}
+
+// Resizer returns the ImageResizer of the named overlay. The reserved
+// names OverlayRandom and OverlayRotate return a resizer that picks a
+// random overlay, or the next one in name order, for each face.
+func (s *OverlaySet) Resizer(name string) (ImageResizer, bool) {
+	if len(s.names) == 0 {
+		return nil, false
+	}
+	switch name {
+	case OverlayRandom:
+		return overlayPicker(func() ImageResizer {
+			return s.resizers[s.names[rand.Intn(len(s.names))]]
+		}), true
+	case OverlayRotate:
+		return overlayPicker(func() ImageResizer {
+			n := atomic.AddUint32(&s.next, 1) - 1
+			return s.resizers[s.names[int(n)%len(s.names)]]
+		}), true
+	}
+	ir, ok := s.resizers[name]
+	return ir, ok
+}
+
+// overlayPicker is an ImageResizer that picks a resizer on every call.
+type overlayPicker func() ImageResizer
+
+// Resize implements the ImageResizer interface.
+func (f overlayPicker) Resize(size image.Point) image.Image {
+	return f().Resize(size)
+}
+
+// Close implements the ImageResizer interface. The resizers it picks
+// belong to the OverlaySet, and are closed with it.
+func (f overlayPicker) Close() error {
+	return nil
+}
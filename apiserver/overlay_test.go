@@ -0,0 +1,65 @@
+package apiserver
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func TestOverlaySet(t *testing.T) {
+	red := color.RGBA{R: 0xff, A: 0xff}
+	blue := color.RGBA{B: 0xff, A: 0xff}
+	set, err := NewOverlaySet(map[string]image.Image{
+		"red":  solidImage(red),
+		"blue": solidImage(blue),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := image.Point{5, 5}
+	ir, _ := set.Resizer("red")
+	if c := ir.Resize(size).At(2, 2); !sameColor(c, red) {
+		t.Fatal("unexpected color for red overlay:", c)
+	}
+	ir, _ = set.Resizer("blue")
+	if c := ir.Resize(size).At(2, 2); !sameColor(c, blue) {
+		t.Fatal("unexpected color for blue overlay:", c)
+	}
+	ir, _ = set.Resizer(OverlayRotate)
+	want := []color.Color{blue, red, blue}
+	for i, w := range want {
+		if c := ir.Resize(size).At(2, 2); !sameColor(c, w) {
+			t.Fatalf("unexpected color for rotation %d: %v", i, c)
+		}
+	}
+	if _, ok := set.Resizer("green"); ok {
+		t.Fatal("unexpected overlay")
+	}
+	// the overlays share the cache of the set
+	if set.cache.Len() != 2 {
+		t.Fatal("unexpected cache length:", set.cache.Len())
+	}
+	set.Close()
+	if set.cache.Len() != 0 {
+		t.Fatal("cache not closed")
+	}
+	_, err = NewOverlaySet(map[string]image.Image{
+		OverlayRandom: solidImage(red),
+	}, nil)
+	if err == nil {
+		t.Fatal("reserved overlay name accepted")
+	}
+}
+
+func solidImage(c color.Color) image.Image {
+	m := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	draw.Draw(m, m.Bounds(), image.NewUniform(c), image.ZP, draw.Src)
+	return m
+}
+
+func sameColor(a, b color.Color) bool {
+	r1, g1, b1, a1 := a.RGBA()
+	r2, g2, b2, a2 := b.RGBA()
+	return r1 == r2 && g1 == g2 && b1 == b2 && a1 == a2
+}
@@ -0,0 +1,371 @@
+package apiserver
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// errNotHTML is returned when the upstream of a page is not HTML.
+var errNotHTML = errors.New("Upstream is not an HTML page")
+
+// pageImageTTL is how long the signed image URLs of pages requested
+// with an API key are valid, if the page request is not signed.
+var pageImageTTL = time.Hour
+
+// page is the HTML rewriting proxy. It fetches HTML pages and rewrites
+// the URLs of their images to go through the deface endpoint, and all
+// other URLs to be absolute, so the page can be served from the
+// defacer. Inline images with data: URLs are not rewritten.
+//
+// Images are found in the attributes of elements, and in the url()
+// references of <style> elements and style attributes. External
+// stylesheets are not rewritten, so their images are not defaced.
+//
+// Pages are served from the origin of the API, so they are sandboxed
+// with a Content-Security-Policy, their scripts and event handlers are
+// removed, and their cookies are dropped.
+//
+// The API key of a page is never copied to its image URLs. They are
+// signed instead, and name the key in the key_name param.
+type page struct {
+	*proxy
+	Deface string     // path of the deface endpoint
+	Signer *urlSigner // optional, signs image URLs of signed pages
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (p *page) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status, err := p.handler(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+}
+
+func (p *page) handler(w http.ResponseWriter, r *http.Request) (int, error) {
+	u := r.URL.Query().Get("url")
+	if u == "" {
+		return http.StatusBadRequest, errors.New("Missing `url` param")
+	}
+	resp, err := p.req(u, r, nil)
+	if err != nil {
+		return http.StatusServiceUnavailable, err
+	}
+	defer resp.Body.Close()
+	mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mt != "text/html" && mt != "application/xhtml+xml" {
+		return http.StatusBadGateway, errNotHTML
+	}
+	copyHeader(w.Header(), resp.Header)
+	for _, hdr := range []string{
+		"Content-Security-Policy",
+		"Content-Security-Policy-Report-Only",
+		"ETag",
+		"Set-Cookie",
+	} {
+		w.Header().Del(hdr)
+	}
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	params := r.URL.Query()
+	for _, k := range []string{"url", "expires", "sig", "key", "key_name"} {
+		params.Del(k)
+	}
+	rw := &pageRewriter{
+		Base:   resp.Request.URL,
+		Deface: p.Deface,
+		Params: params,
+	}
+	if p.Signer != nil && len(p.Signer.Secrets) > 0 {
+		// images expire with the page
+		expires, signed := p.Signer.expires(r.URL)
+		if k := requestKey(r); k != nil {
+			params.Set("key_name", k.Name)
+			if !signed {
+				expires, signed = time.Now().Add(pageImageTTL), true
+			}
+		}
+		if signed {
+			rw.Sign = func(q url.Values) {
+				signURL(p.Signer.Secrets[0], p.Deface, q, expires)
+			}
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if err = rw.Rewrite(w, resp.Body); err != nil {
+		p.logf("failed to rewrite page %q: %v", u, err)
+	}
+	return 0, nil
+}
+
+// pageRewriter rewrites the URLs of an HTML page.
+type pageRewriter struct {
+	Base   *url.URL   // URL of the page, updated by <base href>
+	Deface string     // path of the deface endpoint
+	Params url.Values // additional deface params
+
+	// Sign signs the query of image URLs, if set.
+	Sign func(url.Values)
+}
+
+// imageAttrs are the attributes that hold image URLs, by element.
+// Elements that hold images depending on their other attributes are
+// handled by rewriteTag.
+var imageAttrs = map[atom.Atom][]string{
+	atom.Body:  {"background"},
+	atom.Image: {"href", "xlink:href"}, // <svg><image>
+	atom.Img:   {"src", "srcset"},
+	atom.Input: {"src"},
+	atom.Table: {"background"},
+	atom.Td:    {"background"},
+	atom.Video: {"poster"},
+}
+
+// imageRels are the <link> relations of images.
+var imageRels = map[string]bool{
+	"apple-touch-icon":             true,
+	"apple-touch-icon-precomposed": true,
+	"icon":                         true,
+	"mask-icon":                    true,
+}
+
+// linkAttrs are the attributes that hold other URLs.
+var linkAttrs = map[string]bool{
+	"action":     true,
+	"cite":       true,
+	"data":       true,
+	"formaction": true,
+	"href":       true,
+	"src":        true,
+}
+
+// Rewrite copies the HTML page from r to w, rewriting image URLs to
+// go through the deface endpoint and other URLs to be absolute. The
+// <base> element is removed, and so are CSP <meta> elements which
+// could block the deface endpoint, <script> elements and event handler
+// attributes.
+func (rw *pageRewriter) Rewrite(w io.Writer, r io.Reader) error {
+	z := html.NewTokenizer(r)
+	inStyle, inScript := false, false
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				return nil
+			}
+			return z.Err()
+		case html.TextToken:
+			if inScript {
+				continue
+			}
+			if inStyle {
+				io.WriteString(w, rw.rewriteCSS(string(z.Raw())))
+				continue
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			inStyle = tok.DataAtom == atom.Style && tt == html.StartTagToken
+			// scripts are raw text up to </script>, even <script/>
+			inScript = tok.DataAtom == atom.Script
+			if rw.rewriteTag(&tok) {
+				io.WriteString(w, tok.String())
+			}
+			continue
+		case html.EndTagToken:
+			inStyle = false
+			if name, _ := z.TagName(); atom.Lookup(name) == atom.Script {
+				inScript = false
+				continue
+			}
+		}
+		w.Write(z.Raw())
+	}
+}
+
+// rewriteTag rewrites the URLs of an element, and reports whether it
+// should be written at all.
+func (rw *pageRewriter) rewriteTag(tok *html.Token) bool {
+	switch tok.DataAtom {
+	case atom.Base:
+		if href, ok := tokenAttr(tok, "href"); ok {
+			if u, err := rw.Base.Parse(strings.TrimSpace(href)); err == nil {
+				rw.Base = u
+			}
+		}
+		return false
+	case atom.Script:
+		return false
+	case atom.Meta:
+		if v, _ := tokenAttr(tok, "http-equiv"); strings.EqualFold(v, "Content-Security-Policy") {
+			return false
+		}
+	}
+	images := imageAttrs[tok.DataAtom]
+	switch tok.DataAtom {
+	case atom.Source:
+		// <source> holds images in <picture>, and media otherwise
+		if _, ok := tokenAttr(tok, "srcset"); ok {
+			images = []string{"srcset"}
+		}
+	case atom.Link:
+		if linkImage(tok) {
+			images = []string{"href", "imagesrcset"}
+		}
+	case atom.Object, atom.Embed:
+		// without a type, non-images are passed through by the
+		// deface endpoint
+		if v, ok := tokenAttr(tok, "type"); !ok || strings.HasPrefix(strings.ToLower(strings.TrimSpace(v)), "image/") {
+			images = []string{"data", "src"}
+		}
+	}
+	attrs := tok.Attr[:0]
+	for _, a := range tok.Attr {
+		if strings.HasPrefix(strings.ToLower(a.Key), "on") {
+			// event handlers
+			continue
+		}
+		switch {
+		case (a.Key == "srcset" || a.Key == "imagesrcset") && hasString(images, a.Key):
+			a.Val = rw.rewriteSrcset(a.Val)
+		case hasString(images, a.Key):
+			a.Val = rw.imageURL(a.Val)
+		case linkAttrs[a.Key]:
+			a.Val = rw.absURL(a.Val)
+		case a.Key == "style":
+			a.Val = rw.rewriteCSS(a.Val)
+		}
+		attrs = append(attrs, a)
+	}
+	tok.Attr = attrs
+	return true
+}
+
+// linkImage reports whether the <link> element tok is an icon, or the
+// preload of an image.
+func linkImage(tok *html.Token) bool {
+	rel, _ := tokenAttr(tok, "rel")
+	as, _ := tokenAttr(tok, "as")
+	for _, v := range strings.Fields(strings.ToLower(rel)) {
+		if imageRels[v] || (v == "preload" && strings.EqualFold(strings.TrimSpace(as), "image")) {
+			return true
+		}
+	}
+	return false
+}
+
+// absURL returns ref resolved against the page URL. References that
+// can't be parsed, fragments and non-HTTP URLs are returned unchanged.
+func (rw *pageRewriter) absURL(ref string) string {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(ref, "#") {
+		return ref
+	}
+	u, err := rw.Base.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return u.String()
+}
+
+// imageURL returns the deface URL of the image at ref.
+func (rw *pageRewriter) imageURL(ref string) string {
+	abs := rw.absURL(ref)
+	if !strings.HasPrefix(abs, "http://") && !strings.HasPrefix(abs, "https://") {
+		return ref
+	}
+	params := url.Values{}
+	for k, v := range rw.Params {
+		params[k] = v
+	}
+	params.Set("url", abs)
+	if rw.Sign != nil {
+		rw.Sign(params)
+	}
+	return rw.Deface + "?" + params.Encode()
+}
+
+// rewriteSrcset rewrites the image URLs of a srcset attribute, which
+// is a comma separated list of URLs followed by optional descriptors.
+func (rw *pageRewriter) rewriteSrcset(srcset string) string {
+	var out []string
+	s := srcset
+	for {
+		s = strings.TrimLeft(s, " \t\n\r\f,")
+		if s == "" {
+			break
+		}
+		end := strings.IndexAny(s, " \t\n\r\f")
+		if end < 0 {
+			end = len(s)
+		}
+		ref := s[:end]
+		s = s[end:]
+		descriptor := ""
+		if strings.HasSuffix(ref, ",") {
+			ref = strings.TrimRight(ref, ",")
+		} else {
+			end = strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			descriptor = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+		candidate := rw.imageURL(ref)
+		if descriptor != "" {
+			candidate += " " + descriptor
+		}
+		out = append(out, candidate)
+	}
+	return strings.Join(out, ", ")
+}
+
+// cssURL matches the url() references of CSS.
+var cssURL = regexp.MustCompile(`url\(\s*(?:"([^"]*)"|'([^']*)'|([^'")\s][^)\s]*))\s*\)`)
+
+// rewriteCSS rewrites the url() references of CSS to go through the
+// deface endpoint. Non-image references such as fonts are passed
+// through unchanged by it.
+func (rw *pageRewriter) rewriteCSS(css string) string {
+	return cssURL.ReplaceAllStringFunc(css, func(m string) string {
+		sm := cssURL.FindStringSubmatch(m)
+		ref := sm[1] + sm[2] + sm[3]
+		if strings.HasPrefix(ref, "data:") {
+			return m
+		}
+		return `url("` + rw.imageURL(ref) + `")`
+	})
+}
+
+// tokenAttr returns the value of the named attribute of tok.
+func tokenAttr(tok *html.Token, name string) (string, bool) {
+	for _, a := range tok.Attr {
+		if a.Key == name {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+func hasString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
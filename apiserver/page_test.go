@@ -0,0 +1,148 @@
+package apiserver
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newTestRewriter(base string) *pageRewriter {
+	u, _ := url.Parse(base)
+	return &pageRewriter{Base: u, Deface: "/v1/deface", Params: url.Values{}}
+}
+
+func TestPageRewrite(t *testing.T) {
+	rw := newTestRewriter("http://example.com/blog/post.html")
+	rw.Params.Set("overlay", "cat")
+	page := `<!DOCTYPE html>
+<html><head>
+<meta http-equiv="Content-Security-Policy" content="img-src 'self'">
+<style>body { background: url('/bg.png') } a > b { color: red }</style>
+<link rel="stylesheet" href="style.css">
+<link rel="shortcut icon" href="/favicon.ico">
+<link rel="preload" as="image" href="hero.jpg" imagesrcset="hero.jpg 1x, hero2.jpg 2x">
+<link rel="preload" as="font" href="font.woff">
+</head><body>
+<a href="../about.html#team">About</a> <a href="#top">Top</a>
+<img src="a.jpg" alt="A &amp; B">
+<img srcset="small.jpg 1x, /large.jpg 2x" src="data:image/png;base64,AAAA">
+<picture><source srcset="b.webp"><img src="b.jpg" srcset="b2.jpg 2x"></picture>
+<div style="background-image: url(c.png)"></div>
+<svg><image href="d.png"/><image xlink:href="/e.png"/></svg>
+<object data="f.png"></object> <object data="g.swf" type="application/x-shockwave-flash"></object>
+<embed src="h.gif" type="image/gif">
+<script>fetch("/v1/batch?key=" + location.search)</script><script src="x.js"></script>
+<button onclick="steal()" ONMOUSEOVER="steal()" type="button">Go</button>
+</body></html>`
+	var b bytes.Buffer
+	if err := rw.Rewrite(&b, strings.NewReader(page)); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	for _, want := range []string{
+		`<style>body { background: url("/v1/deface?overlay=cat&url=http%3A%2F%2Fexample.com%2Fbg.png") } a > b { color: red }</style>`,
+		`<link rel="stylesheet" href="http://example.com/blog/style.css">`,
+		`<a href="http://example.com/about.html#team">`,
+		`<a href="#top">`,
+		`<img src="/v1/deface?overlay=cat&amp;url=http%3A%2F%2Fexample.com%2Fblog%2Fa.jpg" alt="A &amp; B">`,
+		`srcset="/v1/deface?overlay=cat&amp;url=http%3A%2F%2Fexample.com%2Fblog%2Fsmall.jpg 1x, /v1/deface?overlay=cat&amp;url=http%3A%2F%2Fexample.com%2Flarge.jpg 2x"`,
+		`src="data:image/png;base64,AAAA"`,
+		`<source srcset="/v1/deface?overlay=cat&amp;url=http%3A%2F%2Fexample.com%2Fblog%2Fb.webp">`,
+		`style="background-image: url(&#34;/v1/deface?overlay=cat&amp;url=http%3A%2F%2Fexample.com%2Fblog%2Fc.png&#34;)"`,
+		`<link rel="shortcut icon" href="/v1/deface?overlay=cat&amp;url=http%3A%2F%2Fexample.com%2Ffavicon.ico">`,
+		`<link rel="preload" as="image" href="/v1/deface?overlay=cat&amp;url=http%3A%2F%2Fexample.com%2Fblog%2Fhero.jpg" imagesrcset="/v1/deface?overlay=cat&amp;url=http%3A%2F%2Fexample.com%2Fblog%2Fhero.jpg 1x, /v1/deface?overlay=cat&amp;url=http%3A%2F%2Fexample.com%2Fblog%2Fhero2.jpg 2x">`,
+		`<link rel="preload" as="font" href="http://example.com/blog/font.woff">`,
+		`<img src="/v1/deface?overlay=cat&amp;url=http%3A%2F%2Fexample.com%2Fblog%2Fb.jpg" srcset="/v1/deface?overlay=cat&amp;url=http%3A%2F%2Fexample.com%2Fblog%2Fb2.jpg 2x">`,
+		`<image href="/v1/deface?overlay=cat&amp;url=http%3A%2F%2Fexample.com%2Fblog%2Fd.png"/>`,
+		`<image xlink:href="/v1/deface?overlay=cat&amp;url=http%3A%2F%2Fexample.com%2Fe.png"/>`,
+		`<object data="/v1/deface?overlay=cat&amp;url=http%3A%2F%2Fexample.com%2Fblog%2Ff.png">`,
+		`<object data="http://example.com/blog/g.swf" type="application/x-shockwave-flash">`,
+		`<embed src="/v1/deface?overlay=cat&amp;url=http%3A%2F%2Fexample.com%2Fblog%2Fh.gif" type="image/gif">`,
+		`<button type="button">Go</button>`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %s in:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "Content-Security-Policy") {
+		t.Error("CSP meta element was not removed")
+	}
+	for _, script := range []string{"<script", "fetch", "x.js", "steal"} {
+		if strings.Contains(out, script) {
+			t.Errorf("script %s was not removed", script)
+		}
+	}
+}
+
+func TestPageRewriteBase(t *testing.T) {
+	rw := newTestRewriter("http://example.com/")
+	var b bytes.Buffer
+	page := `<base href="http://cdn.example.com/img/"><img src="a.jpg">`
+	if err := rw.Rewrite(&b, strings.NewReader(page)); err != nil {
+		t.Fatal(err)
+	}
+	want := `<img src="/v1/deface?url=http%3A%2F%2Fcdn.example.com%2Fimg%2Fa.jpg">`
+	if b.String() != want {
+		t.Fatal("unexpected page:", b.String())
+	}
+}
+
+func TestRewriteSrcset(t *testing.T) {
+	rw := newTestRewriter("http://example.com/")
+	rw.Deface = "d"
+	for srcset, want := range map[string]string{
+		"a.jpg":                   "d?url=http%3A%2F%2Fexample.com%2Fa.jpg",
+		" a.jpg 1x,b.jpg  2x ":    "d?url=http%3A%2F%2Fexample.com%2Fa.jpg 1x, d?url=http%3A%2F%2Fexample.com%2Fb.jpg 2x",
+		"a.jpg, b.jpg 640w":       "d?url=http%3A%2F%2Fexample.com%2Fa.jpg, d?url=http%3A%2F%2Fexample.com%2Fb.jpg 640w",
+		"a.jpg 100w 50h, , b.jpg": "d?url=http%3A%2F%2Fexample.com%2Fa.jpg 100w 50h, d?url=http%3A%2F%2Fexample.com%2Fb.jpg",
+		"data:image/png;base64,AAAA 1x, b.jpg 2x":        "data:image/png;base64,AAAA 1x, d?url=http%3A%2F%2Fexample.com%2Fb.jpg 2x",
+		"data:image/svg+xml,%3Csvg%3E,%3C/svg%3E, b.jpg": "data:image/svg+xml,%3Csvg%3E,%3C/svg%3E, d?url=http%3A%2F%2Fexample.com%2Fb.jpg",
+		"a.jpg,b.jpg 2x": "d?url=http%3A%2F%2Fexample.com%2Fa.jpg%2Cb.jpg 2x",
+	} {
+		if v := rw.rewriteSrcset(srcset); v != want {
+			t.Errorf("%q: want %q, have %q", srcset, want, v)
+		}
+	}
+}
+
+func TestPageProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/image.png" {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(blankPNG(t))
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Security-Policy", "img-src 'self'")
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Set-Cookie", "session=upstream")
+		w.Write([]byte(`<script>alert(1)</script><img src="/image.png">`))
+	}))
+	defer upstream.Close()
+	p := &page{proxy: newTestProxy(t), Deface: "/v1/deface"}
+	serve := func(u string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("GET", "/v1/page?"+url.Values{"url": {u}, "format": {"jpeg"}}.Encode(), nil)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w
+	}
+	w := serve(upstream.URL + "/index.html")
+	if w.Code != http.StatusOK {
+		t.Fatal("unexpected status:", w.Code, w.Body.String())
+	}
+	want := `<img src="/v1/deface?format=jpeg&amp;url=` + url.QueryEscape(upstream.URL+"/image.png") + `">`
+	if w.Body.String() != want {
+		t.Fatal("unexpected page:", w.Body.String())
+	}
+	h := w.Header()
+	if h.Get("Content-Security-Policy") != "sandbox" || h.Get("Connection") != "" || h.Get("Set-Cookie") != "" {
+		t.Fatal("unexpected headers:", w.Header())
+	}
+	w = serve(upstream.URL + "/image.png")
+	if w.Code != http.StatusBadGateway {
+		t.Fatal("unexpected status:", w.Code)
+	}
+}
@@ -1,24 +1,45 @@
 package apiserver
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"errors"
-	"image"
-	"image/gif"
-	"image/jpeg"
-	"image/png"
+	"fmt"
+	_ "image/gif"  // register decoder
+	_ "image/jpeg" // register decoder
+	_ "image/png"  // register decoder
 	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "golang.org/x/image/bmp"  // register decoder
+	_ "golang.org/x/image/tiff" // register decoder
+	_ "golang.org/x/image/webp" // register decoder
 )
 
-// encoderFunc is an adapter function for image encoders.
-type encoderFunc func(w io.Writer, m image.Image) error
+// errNotAcceptable is returned when the Accept header of a request
+// refuses all the output formats.
+var errNotAcceptable = errors.New("No acceptable image format")
+
+// errImageTooLarge is returned when upstream images exceed MaxBytes.
+var errImageTooLarge = errors.New("Image too large")
 
 // proxy is the defacer http proxy.
 type proxy struct {
 	Defacer  Defacer
 	Client   *http.Client
 	ErrorLog *log.Logger
+	Overlays *OverlaySet   // optional named overlays
+	Overlay  string        // default overlay name
+	Options  DefaceOptions // default deface options
+	MaxBytes int64         // max size of upstream images, if > 0
+	Encode   EncodeOptions // default encoding options
+	Metadata MetadataOptions
+	Results  *ResultCache // optional cache of defaced images
 }
 
 // DefacerProxy does magic.
@@ -32,12 +53,18 @@ func DefacerProxy(df Defacer, cli *http.Client, logger *log.Logger) http.Handler
 
 // ServeHTTP implements the http.Handler interface.
 func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		w.Header().Set("Allow", "GET")
+	var status int
+	var err error
+	switch r.Method {
+	case "GET":
+		status, err = p.handler(w, r)
+	case "POST":
+		status, err = p.upload(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	status, err := p.handler(w, r)
 	if err != nil {
 		http.Error(w, err.Error(), status)
 		return
@@ -59,56 +86,443 @@ var hopHeaders = []string{
 	"Upgrade",
 }
 
+// defaceRequest is a request to deface an upstream image.
+type defaceRequest struct {
+	URL     string
+	Overlay string // overlay name
+	Options *DefaceOptions
+	Encode  *EncodeOptions
+	Format  *imageFormat // nil to negotiate with the Accept header
+	Header  http.Header  // additional headers sent upstream
+	Status  bool         // reply with the upstream status code
+	NoCache bool         // bypass the result cache
+
+	// Timeout limits the time to fetch and deface images. Other
+	// upstream responses are copied without a time limit, so the
+	// client that fetches them must not have a timeout either.
+	Timeout time.Duration
+}
+
 func (p *proxy) handler(w http.ResponseWriter, r *http.Request) (int, error) {
-	url := r.FormValue("url")
-	if url == "" {
-		return http.StatusBadRequest, errors.New("Missing `url` param")
+	dr, err := p.parseRequest(r.URL.Query().Get)
+	if err != nil {
+		return http.StatusBadRequest, err
 	}
-	resp, err := p.req(url, r)
+	return p.deface(w, r, dr)
+}
+
+// parseRequest returns the deface request of the given params, such
+// as the query params of an HTTP request.
+func (p *proxy) parseRequest(get func(string) string) (*defaceRequest, error) {
+	dr := &defaceRequest{URL: get("url")}
+	if dr.URL == "" {
+		return nil, errors.New("Missing `url` param")
+	}
+	if err := p.parseOptions(dr, get); err != nil {
+		return nil, err
+	}
+	return dr, nil
+}
+
+// parseOptions sets the deface, encoding and format options of dr from
+// the given params.
+func (p *proxy) parseOptions(dr *defaceRequest, get func(string) string) error {
+	var err error
+	if dr.Options, dr.Overlay, err = p.options(get); err != nil {
+		return err
+	}
+	if dr.Encode, err = parseEncodeOptions(p.Encode, get); err != nil {
+		return err
+	}
+	if v := get("format"); v != "" {
+		if dr.Format = outputFormat(v); dr.Format == nil {
+			return fmt.Errorf("Unsupported `format` param: %q", v)
+		}
+	}
+	return nil
+}
+
+// deface fetches the upstream image of dr and replies to r with the
+// defaced image. Other upstream responses are copied unchanged.
+func (p *proxy) deface(w http.ResponseWriter, r *http.Request, dr *defaceRequest) (int, error) {
+	url, opts, format := dr.URL, dr.Options, dr.Format
+	prefix := p.etagPrefix(dr, r.Header.Get("Accept"))
+	cond := upstreamConditions(r, prefix)
+	var key string
+	var cached *cachedResult
+	if p.Results != nil && !dr.NoCache {
+		key = resultKey(url, prefix)
+		if cached = p.Results.Get(key); cached != nil {
+			if time.Now().Before(cached.Expires) {
+				serveResult(w, r, cached, "hit")
+				return 0, nil
+			}
+			cond = cached.conditions()
+		}
+		w.Header().Set("X-Defacer-Cache", "miss")
+	}
+	for k, v := range dr.Header {
+		cond[k] = v
+	}
+	var timer *time.Timer
+	if dr.Timeout > 0 {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		timer = time.AfterFunc(dr.Timeout, cancel)
+		defer timer.Stop()
+		r = r.WithContext(ctx)
+	}
+	resp, err := p.req(url, r, cond)
 	if err != nil {
 		return http.StatusServiceUnavailable, err
 	}
 	defer resp.Body.Close()
-	// clear response headers
-	resp.Header.Del("Content-Length")
-	for _, hdr := range hopHeaders {
-		resp.Header.Del(hdr)
+	if resp.StatusCode == http.StatusNotModified {
+		if cached != nil {
+			defacerResultCacheRevalidationsSum.WithLabelValues("not_modified").Inc()
+			cached = cached.revalidated(resp.Header)
+			if _, ok := resultLifetime(resp.Header); ok {
+				p.Results.Set(key, cached)
+			}
+			serveResult(w, r, cached, "revalidated")
+			return 0, nil
+		}
+		p.notModified(w, r, resp, dr, prefix)
+		return 0, nil
 	}
-	// copy response headers
-	for k, v := range resp.Header {
-		w.Header()[k] = v
+	if cached != nil {
+		defacerResultCacheRevalidationsSum.WithLabelValues("modified").Inc()
 	}
-	var enc encoderFunc
-	switch resp.Header.Get("Content-Type") {
-	case "image/gif":
-		enc = func(w io.Writer, m image.Image) error {
-			return gif.Encode(w, m, nil)
+	status := http.StatusOK
+	if dr.Status {
+		status = resp.StatusCode
+	}
+	if status != http.StatusOK {
+		key = ""
+	}
+	copyHeader(w.Header(), resp.Header)
+	body := bufio.NewReader(resp.Body)
+	src := formatByContentType(resp.Header.Get("Content-Type"))
+	if src == nil {
+		// missing or generic content type
+		// streams may be slow to start
+		if timer != nil {
+			timer.Stop()
 		}
-	case "image/jpeg":
-		enc = func(w io.Writer, m image.Image) error {
-			return jpeg.Encode(w, m, nil)
+		head, _ := body.Peek(sniffLen)
+		if src = sniffFormat(head); src == nil {
+			w.WriteHeader(status)
+			io.Copy(w, body)
+			return 0, nil
 		}
-	case "image/png":
-		enc = png.Encode
-	default:
-		io.Copy(w, resp.Body)
-		return 0, nil
+		if timer != nil {
+			timer.Reset(dr.Timeout)
+		}
+		w.Header().Set("Content-Type", src.ContentType)
 	}
-	img, err := p.Defacer.Deface(resp.Body)
-	if err != nil {
+	if p.MaxBytes > 0 && resp.ContentLength > p.MaxBytes {
+		errorHeader(w.Header())
+		return http.StatusBadGateway, errImageTooLarge
+	}
+	if format == nil {
+		format = negotiateFormat(r.Header.Get("Accept"), src)
+		w.Header().Add("Vary", "Accept")
+		if format == nil {
+			errorHeader(w.Header())
+			return http.StatusNotAcceptable, errNotAcceptable
+		}
+	}
+	// the upstream validators don't apply to the defaced image
+	w.Header().Del("ETag")
+	w.Header().Del("Last-Modified")
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		etag = defacedETag(prefix, etag)
+		w.Header().Set("ETag", etag)
+		if etagMatch(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return 0, nil
+		}
+	}
+	if format != src {
+		// the source can't be passed through
+		opts.KeepSource = false
+	}
+	var in io.Reader = body
+	var limit *maxBytesReader
+	if p.MaxBytes > 0 {
+		limit = &maxBytesReader{R: body, N: p.MaxBytes}
+		in = limit
+	}
+	var head *headBuffer
+	if src.Name == "jpeg" && format.Name == "jpeg" {
+		head = &headBuffer{max: maxMetadataBytes}
+		in = io.TeeReader(in, head)
+	}
+	res, err := p.Defacer.Deface(in, opts)
+	switch {
+	case limit != nil && limit.Exceeded:
+		errorHeader(w.Header())
+		return http.StatusBadGateway, errImageTooLarge
+	case err != nil:
+		errorHeader(w.Header())
 		return http.StatusInternalServerError, err
 	}
-	enc(w, img)
+	w.Header().Set("X-Defacer-Faces", strconv.Itoa(len(res.Faces)))
+	if source := p.passthrough(res, src); source != nil {
+		defacerImageFormatSum.WithLabelValues(src.Name, src.Name).Inc()
+		w.Header().Set("X-Defacer-Passthrough", "true")
+		w.Header().Set("Content-Length", strconv.Itoa(len(source)))
+		w.WriteHeader(status)
+		w.Write(source)
+		if key != "" {
+			p.storeResult(key, resp.Header, w.Header(), source)
+		}
+		return 0, nil
+	}
+	defacerImageFormatSum.WithLabelValues(src.Name, format.Name).Inc()
+	w.Header().Set("Content-Type", format.ContentType)
+	var buf bytes.Buffer
+	var dst io.Writer = w
+	if key != "" {
+		dst = io.MultiWriter(w, &buf)
+	}
+	out := dst
+	if head != nil {
+		segs := p.Metadata.filter(readJPEGSegments(head.Bytes()))
+		out = &jpegSegmentWriter{W: dst, Segments: segs}
+	}
+	w.WriteHeader(status)
+	if err = format.Encode(out, res.Image, dr.Encode); err == nil && key != "" {
+		p.storeResult(key, resp.Header, w.Header(), buf.Bytes())
+	}
 	return 0, nil
 }
 
-func (p *proxy) req(url string, r *http.Request) (*http.Response, error) {
-	req, err := http.NewRequest(r.Method, url, nil)
+// passthrough returns the source of res to pass through, or nil if
+// there is none. The metadata of JPEG images is filtered, and they are
+// re-encoded instead if that fails.
+func (p *proxy) passthrough(res *DefaceResult, src *imageFormat) []byte {
+	if res.Source == nil || src.Name != "jpeg" {
+		return res.Source
+	}
+	return p.Metadata.scrubJPEG(res.Source)
+}
+
+// storeResult adds a defaced image to the result cache, unless the
+// upstream response can't be stored or has no lifetime or validators.
+// Responses that vary by request headers other than Accept aren't
+// stored, as the cache key doesn't include them, and cookies are never
+// stored.
+func (p *proxy) storeResult(key string, upstream, header http.Header, body []byte) {
+	ttl, ok := resultLifetime(upstream)
+	etag, lastModified := upstream.Get("ETag"), upstream.Get("Last-Modified")
+	if !ok || (ttl == 0 && etag == "" && lastModified == "") || !varyAccept(upstream) {
+		return
+	}
+	header = cloneHeader(header)
+	header.Del("Set-Cookie")
+	now := time.Now()
+	p.Results.Set(key, &cachedResult{
+		Header:       header,
+		Body:         body,
+		Time:         now,
+		Expires:      now.Add(ttl),
+		ETag:         etag,
+		LastModified: lastModified,
+	})
+}
+
+// varyAccept reports whether the response with the given headers
+// varies by no request header other than Accept.
+func varyAccept(h http.Header) bool {
+	for _, v := range h["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name != "" && !strings.EqualFold(name, "Accept") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// serveResult replies to r with a cached result, or 304 if the client
+// has it already.
+func serveResult(w http.ResponseWriter, r *http.Request, res *cachedResult, status string) {
+	h := w.Header()
+	for k, v := range res.Header {
+		h[k] = append([]string(nil), v...)
+	}
+	h.Set("Age", strconv.Itoa(int(time.Since(res.Time)/time.Second)))
+	h.Set("X-Defacer-Cache", status)
+	if etag := h.Get("ETag"); etag != "" && etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Length", strconv.Itoa(len(res.Body)))
+	w.Write(res.Body)
+}
+
+// conditions returns the headers to revalidate res upstream.
+func (res *cachedResult) conditions() http.Header {
+	h := http.Header{}
+	if res.ETag != "" {
+		h.Set("If-None-Match", res.ETag)
+	}
+	if res.LastModified != "" {
+		h.Set("If-Modified-Since", res.LastModified)
+	}
+	return h
+}
+
+// revalidated returns a copy of res that is fresh for the lifetime of
+// the upstream 304 response with the given headers.
+func (res *cachedResult) revalidated(upstream http.Header) *cachedResult {
+	c := *res
+	c.Time = time.Now()
+	ttl, _ := resultLifetime(upstream)
+	c.Expires = c.Time.Add(ttl)
+	return &c
+}
+
+// cloneHeader returns a deep copy of h.
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
+
+// maxBytesReader reads up to N bytes from R, and fails with
+// errImageTooLarge if R has more. Decoders may wrap or replace the
+// error, so callers check Exceeded instead.
+type maxBytesReader struct {
+	R        io.Reader
+	N        int64
+	Exceeded bool // R has more than N bytes
+}
+
+func (r *maxBytesReader) Read(p []byte) (int, error) {
+	if r.N < 0 {
+		return 0, errImageTooLarge
+	}
+	if int64(len(p)) > r.N+1 {
+		p = p[:r.N+1]
+	}
+	n, err := r.R.Read(p)
+	r.N -= int64(n)
+	if r.N < 0 {
+		r.Exceeded = true
+		return n + int(r.N), errImageTooLarge
+	}
+	return n, err
+}
+
+// options returns the deface options for the given params, and the
+// name of the overlay.
+func (p *proxy) options(get func(string) string) (*DefaceOptions, string, error) {
+	opts := p.Options
+	if v := get("passthrough"); v != "" {
+		keep, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, "", fmt.Errorf("Invalid `passthrough` param: %q", v)
+		}
+		opts.KeepSource = keep
+	}
+	if v := get("max_detect_size"); v != "" {
+		// clients can only lower the configured limit
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, "", fmt.Errorf("Invalid `max_detect_size` param: %q", v)
+		}
+		if opts.MaxDetectSize == 0 || n < opts.MaxDetectSize {
+			opts.MaxDetectSize = n
+		}
+	}
+	name := get("overlay")
+	if name == "" {
+		name = p.Overlay
+	}
+	if err := p.setOverlay(&opts, name); err != nil {
+		return nil, "", err
+	}
+	return &opts, name, nil
+}
+
+// setOverlay sets the resizer of the named overlay in opts. The
+// default resizer of the defacer is used if name is empty.
+func (p *proxy) setOverlay(opts *DefaceOptions, name string) error {
+	if name == "" {
+		return nil
+	}
+	if p.Overlays == nil {
+		return errors.New("Named overlays are not available")
+	}
+	ir, ok := p.Overlays.Resizer(name)
+	if !ok {
+		return fmt.Errorf("Unknown overlay %q", name)
+	}
+	opts.Resizer = ir
+	return nil
+}
+
+// notModified replies to r with the headers of an upstream 304
+// response, except Last-Modified. The upstream ETag is replaced by the one of the defaced
+// image when that is the tag the client has.
+func (p *proxy) notModified(w http.ResponseWriter, r *http.Request, resp *http.Response, dr *defaceRequest, prefix string) {
+	copyHeader(w.Header(), resp.Header)
+	w.Header().Del("Last-Modified")
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		defaced := defacedETag(prefix, etag)
+		if etagMatch(r.Header.Get("If-None-Match"), defaced) {
+			w.Header().Set("ETag", defaced)
+			if dr.Format == nil {
+				w.Header().Add("Vary", "Accept")
+			}
+		}
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// copyHeader copies the upstream response headers to dst, except for
+// hop-by-hop headers and Content-Length.
+func copyHeader(dst, src http.Header) {
+	for k, v := range src {
+		dst[k] = v
+	}
+	dst.Del("Content-Length")
+	for _, hdr := range hopHeaders {
+		dst.Del(hdr)
+	}
+}
+
+// errorHeader removes the headers of an upstream response that don't
+// apply to an error reply, so that caches don't store the error as
+// the image.
+func errorHeader(h http.Header) {
+	for _, k := range []string{
+		"Cache-Control",
+		"Content-Length",
+		"ETag",
+		"Expires",
+		"Last-Modified",
+	} {
+		h.Del(k)
+	}
+}
+
+func (p *proxy) req(url string, r *http.Request, cond http.Header) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		p.logf("failed to create request to %q: %v", url, err)
 		return nil, err
 	}
+	req = req.WithContext(r.Context())
 	req.Header.Set("User-Agent", r.Header.Get("User-Agent"))
+	for k, v := range cond {
+		req.Header[k] = v
+	}
 	resp, err := p.Client.Do(req)
 	if err != nil {
 		p.logf("failed to exec request to %q: %v", url, err)
@@ -0,0 +1,436 @@
+package apiserver
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/fiorix/defacer/apiserver/internal"
+)
+
+// newTestProxy returns a proxy backed by a single defacer.
+func newTestProxy(t *testing.T) *proxy {
+	overlay, err := internal.DefaultDefaceImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	df, err := NewDefacer(NewImageResizer(overlay, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &proxy{Defacer: df, Client: &http.Client{}}
+}
+
+// newTestUpstream returns a server that serves b with the given
+// content type.
+func newTestUpstream(contentType string, b []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Write(b)
+	}))
+}
+
+// blankPNG returns an encoded PNG image without faces.
+func blankPNG(t *testing.T) []byte {
+	m := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for i := range m.Pix {
+		m.Pix[i] = 0xff
+	}
+	m.Set(1, 1, color.Black)
+	var b bytes.Buffer
+	if err := png.Encode(&b, m); err != nil {
+		t.Fatal(err)
+	}
+	b.WriteString("trailing bytes")
+	return b.Bytes()
+}
+
+func serveProxy(p *proxy, upstream string, params url.Values) *httptest.ResponseRecorder {
+	return serveProxyHeader(p, upstream, params, nil)
+}
+
+func serveProxyHeader(p *proxy, upstream string, params url.Values, header http.Header) *httptest.ResponseRecorder {
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("url", upstream)
+	r, _ := http.NewRequest("GET", "/v1/deface?"+params.Encode(), nil)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	return w
+}
+
+func TestProxyPassthrough(t *testing.T) {
+	src := blankPNG(t)
+	upstream := newTestUpstream("image/png", src)
+	defer upstream.Close()
+	p := newTestProxy(t)
+	w := serveProxy(p, upstream.URL, url.Values{"passthrough": {"true"}})
+	if w.Code != http.StatusOK {
+		t.Fatal("unexpected status:", w.Code, w.Body.String())
+	}
+	if w.Header().Get("X-Defacer-Passthrough") != "true" {
+		t.Fatal("missing passthrough header")
+	}
+	if !bytes.Equal(w.Body.Bytes(), src) {
+		t.Fatal("upstream image was modified")
+	}
+	w = serveProxy(p, upstream.URL, nil)
+	if w.Header().Get("X-Defacer-Passthrough") != "" {
+		t.Fatal("unexpected passthrough header")
+	}
+	if bytes.Equal(w.Body.Bytes(), src) {
+		t.Fatal("upstream image was not re-encoded")
+	}
+}
+
+// exifJPEG returns an encoded JPEG image without faces, with the EXIF
+// data of testExif.
+func exifJPEG(t *testing.T) []byte {
+	m := image.NewGray(image.Rect(0, 0, 64, 64))
+	for i := range m.Pix {
+		m.Pix[i] = 0xff
+	}
+	var b bytes.Buffer
+	w := &jpegSegmentWriter{W: &b, Segments: []jpegSegment{
+		{markerAPP1, append([]byte(sigExif), testExif()...)},
+		{0xfe, []byte("comment")},
+	}}
+	if err := jpeg.Encode(w, m, nil); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestProxyPassthroughMetadata(t *testing.T) {
+	upstream := newTestUpstream("image/jpeg", exifJPEG(t))
+	defer upstream.Close()
+	p := newTestProxy(t)
+	p.Metadata = MetadataOptions{Policy: MetadataStripSensitive}
+	for _, passthrough := range []string{"true", "false"} {
+		w := serveProxy(p, upstream.URL, url.Values{"passthrough": {passthrough}})
+		if w.Code != http.StatusOK {
+			t.Fatal("unexpected status:", w.Code, w.Body.String())
+		}
+		if have := w.Header().Get("X-Defacer-Passthrough") == "true"; have != (passthrough == "true") {
+			t.Fatalf("passthrough=%s: unexpected passthrough header", passthrough)
+		}
+		b := w.Body.Bytes()
+		for _, v := range []string{"LATITUDE", "SERIAL", "comment"} {
+			if bytes.Contains(b, []byte(v)) {
+				t.Errorf("passthrough=%s: %q was not removed", passthrough, v)
+			}
+		}
+		if !bytes.Contains(b, []byte("SecretMake")) {
+			t.Errorf("passthrough=%s: EXIF was removed", passthrough)
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(b)); err != nil {
+			t.Fatalf("passthrough=%s: %v", passthrough, err)
+		}
+	}
+}
+
+func TestProxyMaxBytes(t *testing.T) {
+	png := blankPNG(t)
+	var gifBuf bytes.Buffer
+	if err := gif.Encode(&gifBuf, image.NewPaletted(image.Rect(0, 0, 50, 50), palette.Plan9), nil); err != nil {
+		t.Fatal(err)
+	}
+	// the gif decoder wraps read errors
+	for _, src := range [][]byte{png, gifBuf.Bytes()} {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", http.DetectContentType(src))
+			w.(http.Flusher).Flush() // no Content-Length
+			w.Write(src)
+		}))
+		defer upstream.Close()
+		p := newTestProxy(t)
+		for _, max := range []int{len(src) - 1, len(src) / 2} {
+			p.MaxBytes = int64(max)
+			w := serveProxy(p, upstream.URL, url.Values{"passthrough": {"true"}})
+			if w.Code != http.StatusBadGateway {
+				t.Fatal("unexpected status:", max, w.Code, w.Body.String())
+			}
+		}
+		p.MaxBytes = int64(len(src))
+		w := serveProxy(p, upstream.URL, url.Values{"passthrough": {"true"}})
+		b, _ := ioutil.ReadAll(w.Body)
+		if w.Code != http.StatusOK || !bytes.Equal(b, src) {
+			t.Fatal("unexpected response:", w.Code)
+		}
+	}
+}
+
+func TestProxyErrorHeaders(t *testing.T) {
+	src := blankPNG(t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Content-Type", "image/png")
+		h.Set("Cache-Control", "max-age=60")
+		h.Set("Expires", "Mon, 02 Jan 2006 15:04:05 GMT")
+		h.Set("ETag", `"v1"`)
+		h.Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		switch r.URL.Path {
+		case "/invalid.png":
+			w.Write([]byte("not an image"))
+		case "/stream.png":
+			w.(http.Flusher).Flush() // no Content-Length
+			w.Write(src)
+		default:
+			w.Write(src)
+		}
+	}))
+	defer upstream.Close()
+	p := newTestProxy(t)
+	for path, max := range map[string]int64{
+		"/invalid.png": 0,
+		"/stream.png":  int64(len(src) - 1),
+		"/image.png":   int64(len(src) - 1),
+	} {
+		p.MaxBytes = max
+		w := serveProxy(p, upstream.URL+path, nil)
+		if w.Code < 500 {
+			t.Fatalf("%s: unexpected status: %d", path, w.Code)
+		}
+		for _, k := range []string{"Cache-Control", "Expires", "ETag", "Last-Modified"} {
+			if v := w.Header().Get(k); v != "" {
+				t.Errorf("%s: unexpected %s: %s", path, k, v)
+			}
+		}
+	}
+}
+
+func TestProxyFormat(t *testing.T) {
+	upstream := newTestUpstream("image/png", blankPNG(t))
+	defer upstream.Close()
+	p := newTestProxy(t)
+	for format, contentType := range map[string]string{
+		"":     "image/png",
+		"bmp":  "image/bmp",
+		"gif":  "image/gif",
+		"jpeg": "image/jpeg",
+		"tiff": "image/tiff",
+	} {
+		params := url.Values{"format": {format}, "passthrough": {"true"}}
+		w := serveProxy(p, upstream.URL, params)
+		if w.Code != http.StatusOK {
+			t.Fatal("unexpected status:", w.Code, w.Body.String())
+		}
+		if v := w.Header().Get("Content-Type"); v != contentType {
+			t.Fatalf("format %q: unexpected content type: %q", format, v)
+		}
+		_, f, err := image.Decode(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if "image/"+f != contentType {
+			t.Fatalf("format %q: unexpected image format: %q", format, f)
+		}
+	}
+	w := serveProxy(p, upstream.URL, url.Values{"format": {"webp"}})
+	if w.Code != http.StatusBadRequest {
+		t.Fatal("unexpected status:", w.Code)
+	}
+}
+
+func TestProxySniff(t *testing.T) {
+	src := blankPNG(t)
+	upstream := newTestUpstream("application/octet-stream", src)
+	defer upstream.Close()
+	p := newTestProxy(t)
+	w := serveProxy(p, upstream.URL, url.Values{"passthrough": {"true"}})
+	if v := w.Header().Get("Content-Type"); v != "image/png" {
+		t.Fatal("unexpected content type:", v)
+	}
+	if !bytes.Equal(w.Body.Bytes(), src) {
+		t.Fatal("upstream image was modified")
+	}
+	text := []byte("not an image")
+	upstream = newTestUpstream("application/octet-stream", text)
+	defer upstream.Close()
+	w = serveProxy(p, upstream.URL, nil)
+	if w.Header().Get("X-Defacer-Faces") != "" || !bytes.Equal(w.Body.Bytes(), text) {
+		t.Fatal("unexpected response:", w.Body.String())
+	}
+}
+
+func TestProxyAccept(t *testing.T) {
+	upstream := newTestUpstream("image/png", blankPNG(t))
+	defer upstream.Close()
+	p := newTestProxy(t)
+	header := http.Header{"Accept": {"image/jpeg, image/*;q=0.5"}}
+	w := serveProxyHeader(p, upstream.URL, nil, header)
+	if v := w.Header().Get("Content-Type"); v != "image/jpeg" {
+		t.Fatal("unexpected content type:", v)
+	}
+	if v := w.Header().Get("Vary"); v != "Accept" {
+		t.Fatal("unexpected vary header:", v)
+	}
+	w = serveProxyHeader(p, upstream.URL, url.Values{"format": {"gif"}}, header)
+	if v := w.Header().Get("Content-Type"); v != "image/gif" {
+		t.Fatal("unexpected content type:", v)
+	}
+	header = http.Header{"Accept": {"image/png;q=0, image/jpeg;q=0"}}
+	w = serveProxyHeader(p, upstream.URL, nil, header)
+	if w.Code != http.StatusNotAcceptable || w.Header().Get("Vary") != "Accept" {
+		t.Fatal("unexpected response:", w.Code, w.Header())
+	}
+	r, _ := http.NewRequest("POST", "/v1/deface", bytes.NewReader(blankPNG(t)))
+	r.Header = header
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, r)
+	if rec.Code != http.StatusNotAcceptable {
+		t.Fatal("unexpected upload status:", rec.Code)
+	}
+}
+
+func TestProxyConditional(t *testing.T) {
+	src := blankPNG(t)
+	var full int
+	lastModified := "Mon, 02 Jan 2006 15:04:05 GMT"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", lastModified)
+		if r.Header.Get("If-None-Match") == `"v1"` || r.Header.Get("If-Modified-Since") != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full++
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(src)
+	}))
+	defer upstream.Close()
+	p := newTestProxy(t)
+	w := serveProxy(p, upstream.URL, nil)
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" || etag == `"v1"` || w.Header().Get("Last-Modified") != "" {
+		t.Fatal("unexpected response:", w.Code, w.Header())
+	}
+	header := http.Header{"If-None-Match": {etag}}
+	w = serveProxyHeader(p, upstream.URL, nil, header)
+	if w.Code != http.StatusNotModified || w.Header().Get("ETag") != etag || w.Header().Get("Last-Modified") != "" {
+		t.Fatal("unexpected response:", w.Code, w.Header())
+	}
+	// dates are not checked upstream
+	w = serveProxyHeader(p, upstream.URL, nil, http.Header{"If-Modified-Since": {lastModified}})
+	if w.Code != http.StatusOK {
+		t.Fatal("unexpected response:", w.Code)
+	}
+	if full != 2 {
+		t.Fatal("unexpected upstream downloads:", full)
+	}
+	// other options don't match the cached image
+	params := url.Values{"format": {"jpeg"}}
+	w = serveProxyHeader(p, upstream.URL, params, header)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Fatal("unexpected response:", w.Code, w.Header())
+	}
+	// upstreams that ignore conditional requests
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(src)
+	}))
+	defer upstream.Close()
+	w = serveProxyHeader(p, upstream.URL, nil, header)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatal("unexpected response:", w.Code)
+	}
+}
+
+func TestProxyResultCache(t *testing.T) {
+	src := blankPNG(t)
+	var full, revalidated int
+	cacheControl := "max-age=60"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", cacheControl)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			revalidated++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full++
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(src)
+	}))
+	defer upstream.Close()
+	p := newTestProxy(t)
+	var err error
+	if p.Results, err = NewResultCache(1<<20, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	w := serveProxy(p, upstream.URL, nil)
+	if w.Code != http.StatusOK || w.Header().Get("X-Defacer-Cache") != "miss" {
+		t.Fatal("unexpected response:", w.Code, w.Header())
+	}
+	first := w.Body.Bytes()
+	w = serveProxy(p, upstream.URL, nil)
+	if w.Header().Get("X-Defacer-Cache") != "hit" || !bytes.Equal(w.Body.Bytes(), first) {
+		t.Fatal("unexpected response:", w.Header())
+	}
+	if full != 1 || revalidated != 0 {
+		t.Fatal("unexpected upstream requests:", full, revalidated)
+	}
+	// other options are cached separately
+	w = serveProxy(p, upstream.URL, url.Values{"format": {"gif"}})
+	if w.Header().Get("X-Defacer-Cache") != "miss" || full != 2 {
+		t.Fatal("unexpected response:", w.Header())
+	}
+	// stale results are revalidated
+	cacheControl = "no-cache"
+	params := url.Values{"format": {"jpeg"}}
+	first = serveProxy(p, upstream.URL, params).Body.Bytes()
+	w = serveProxy(p, upstream.URL, params)
+	if w.Header().Get("X-Defacer-Cache") != "revalidated" || !bytes.Equal(w.Body.Bytes(), first) {
+		t.Fatal("unexpected response:", w.Header())
+	}
+	if full != 3 || revalidated != 1 {
+		t.Fatal("unexpected upstream requests:", full, revalidated)
+	}
+}
+
+func TestProxyResultCacheHeaders(t *testing.T) {
+	src := blankPNG(t)
+	vary := ""
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Header().Set("Vary", vary)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(src)
+	}))
+	defer upstream.Close()
+	p := newTestProxy(t)
+	var err error
+	if p.Results, err = NewResultCache(1<<20, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	serveProxy(p, upstream.URL, nil)
+	w := serveProxy(p, upstream.URL, nil)
+	if w.Header().Get("X-Defacer-Cache") != "hit" || w.Header().Get("Set-Cookie") != "" {
+		t.Fatal("unexpected response:", w.Header())
+	}
+	// responses that vary by other headers are not cached
+	for i, v := range []string{"Accept-Language", "accept, Cookie", "*"} {
+		vary = v
+		u := upstream.URL + "/" + strconv.Itoa(i)
+		serveProxy(p, u, nil)
+		if w = serveProxy(p, u, nil); w.Header().Get("X-Defacer-Cache") != "miss" {
+			t.Errorf("Vary %q: unexpected response: %v", v, w.Header())
+		}
+	}
+}
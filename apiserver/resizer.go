@@ -1,91 +1,188 @@
 package apiserver
 
 import (
+	"fmt"
 	"image"
-	"time"
+	"sync"
+	"sync/atomic"
 
 	"github.com/nfnt/resize"
 )
 
 // ImageResizer is an object that can resize images to a given size.
+// Close releases the resources of the resizer, which must not be used
+// afterwards.
 type ImageResizer interface {
 	Resize(size image.Point) image.Image
+	Close() error
 }
 
+// ResizeFilter is the interpolation function used to resize images.
+type ResizeFilter string
+
+// Resize filters, from fastest to best quality.
+const (
+	FilterNearest  ResizeFilter = "nearest"
+	FilterBilinear ResizeFilter = "bilinear"
+	FilterBicubic  ResizeFilter = "bicubic"
+	FilterMitchell ResizeFilter = "mitchell"
+	FilterLanczos2 ResizeFilter = "lanczos2"
+	FilterLanczos3 ResizeFilter = "lanczos3"
+)
+
+// DefaultResizeFilter is the ResizeFilter used when none is set.
+const DefaultResizeFilter = FilterBicubic
+
+var resizeFilters = map[ResizeFilter]resize.InterpolationFunction{
+	FilterNearest:  resize.NearestNeighbor,
+	FilterBilinear: resize.Bilinear,
+	FilterBicubic:  resize.Bicubic,
+	FilterMitchell: resize.MitchellNetravali,
+	FilterLanczos2: resize.Lanczos2,
+	FilterLanczos3: resize.Lanczos3,
+}
+
+// ParseResizeFilter returns the ResizeFilter of the given name.
+func ParseResizeFilter(name string) (ResizeFilter, error) {
+	if name == "" {
+		return DefaultResizeFilter, nil
+	}
+	if _, ok := resizeFilters[ResizeFilter(name)]; !ok {
+		return "", fmt.Errorf("unknown resize filter %q", name)
+	}
+	return ResizeFilter(name), nil
+}
+
+// ImageResizerOptions configure an ImageResizer.
+type ImageResizerOptions struct {
+	// Cache stores resized images, and is not closed with the
+	// resizer. Default: a new cache with DefaultImageCacheBytes and
+	// DefaultImageCacheTTL, which is closed with the resizer.
+	Cache *ImageCache
+
+	// Filter is the interpolation function. Unknown filters
+	// are replaced by the default. Default: DefaultResizeFilter.
+	Filter ResizeFilter
+}
+
+// minPyramidLevel is the minimum width or height of the smallest level
+// of the overlay pyramid.
+const minPyramidLevel = 16
+
 // NewImageResizer stores the given image and returns an ImageResizer
-// that can return different sizes of the stored image.
-func NewImageResizer(m image.Image) ImageResizer {
+// that can return different sizes of the stored image. If opts is nil
+// the default options are used.
+//
+// The image is pre-scaled into a pyramid of levels, each half the size
+// of the previous one, and every resize starts from the smallest level
+// that is larger than the requested size.
+func NewImageResizer(m image.Image, opts *ImageResizerOptions) ImageResizer {
+	if opts == nil {
+		opts = &ImageResizerOptions{}
+	}
+	cache, own := opts.Cache, false
+	if cache == nil {
+		cache, own = NewImageCache(DefaultImageCacheBytes, DefaultImageCacheTTL), true
+	}
+	interp, ok := resizeFilters[opts.Filter]
+	if !ok {
+		interp = resizeFilters[DefaultResizeFilter]
+	}
 	ir := &imageResizer{
-		Image: m,
-		Inbox: make(chan *imageResizerReq, 1000),
+		ID:     atomic.AddUint64(&imageResizerID, 1),
+		Levels: imagePyramid(m, interp),
+		Interp: interp,
+		Cache:  cache,
+		own:    own,
+		calls:  make(map[image.Point]*imageResizerCall),
 	}
-	go ir.coalesce()
+	ir.resizeFunc = ir.resize
 	return ir
 }
 
-type imageResizerReq struct {
-	Size image.Point
-	Resp chan image.Image
+// imagePyramid returns m followed by successive half-size copies of it.
+func imagePyramid(m image.Image, interp resize.InterpolationFunction) []image.Image {
+	levels := []image.Image{m}
+	size := m.Bounds().Size()
+	for size.X/2 >= minPyramidLevel && size.Y/2 >= minPyramidLevel {
+		size = size.Div(2)
+		m = resize.Resize(uint(size.X), uint(size.Y), m, interp)
+		levels = append(levels, m)
+	}
+	return levels
 }
 
+// imageResizerID is the last ID assigned to an imageResizer.
+var imageResizerID uint64
+
 type imageResizer struct {
+	ID     uint64
+	Levels []image.Image // overlay pyramid, largest first
+	Interp resize.InterpolationFunction
+	Cache  *ImageCache
+	own    bool // Cache was created by the resizer
+
+	mu    sync.Mutex
+	calls map[image.Point]*imageResizerCall
+
+	resizeFunc func(image.Point) image.Image // resize, or a test stub
+}
+
+// imageResizerCall is an in-flight resize, shared by concurrent
+// callers that request the same size.
+type imageResizerCall struct {
+	wg    sync.WaitGroup
 	Image image.Image
-	Inbox chan *imageResizerReq
 }
 
+// Resize implements the ImageResizer interface. Cached images are
+// returned immediately, and concurrent cache misses for the same size
+// wait for a single resize.
 func (ir *imageResizer) Resize(size image.Point) image.Image {
-	req := &imageResizerReq{
-		Size: size,
-		Resp: make(chan image.Image),
+	key := imageCacheKey{ID: ir.ID, Size: size}
+	if img := ir.Cache.Get(&key); img != nil {
+		return img
 	}
-	defer close(req.Resp)
-	ir.Inbox <- req
-	return <-req.Resp
-}
-
-type imageResizerBatch map[image.Point][]chan image.Image
-
-func (ir *imageResizer) coalesce() {
-	backoff := 10 * time.Millisecond
-	batch := make(imageResizerBatch)
-	for {
-		select {
-		case req := <-ir.Inbox:
-			batch[req.Size] = append(batch[req.Size], req.Resp)
-			backoff = 10 * time.Millisecond
-		case <-time.After(backoff):
-			if len(batch) == 0 {
-				backoff *= backoff
-				break
-			}
-			ir.dispatch(batch)
-			batch = make(imageResizerBatch)
-		}
+	ir.mu.Lock()
+	if c, ok := ir.calls[size]; ok {
+		ir.mu.Unlock()
+		c.wg.Wait()
+		defacerImageResizeCoalesceSum.Inc()
+		return c.Image
 	}
+	c := &imageResizerCall{}
+	c.wg.Add(1)
+	ir.calls[size] = c
+	ir.mu.Unlock()
+
+	c.Image = ir.resizeFunc(size)
+	ir.Cache.Set(&key, c.Image)
+	c.wg.Done()
+
+	ir.mu.Lock()
+	delete(ir.calls, size)
+	ir.mu.Unlock()
+	return c.Image
 }
 
-func (ir *imageResizer) dispatch(batch imageResizerBatch) {
-	for size, resp := range batch {
-		go ir.resize(size, resp)
+// Close implements the ImageResizer interface. It closes the cache of
+// the resizer if it was created by it.
+func (ir *imageResizer) Close() error {
+	if ir.own {
+		return ir.Cache.Close()
 	}
-	batch = nil
+	return nil
 }
 
-func (ir *imageResizer) resize(size image.Point, callers []chan image.Image) {
-	img := defaultImageCache.Get(&size)
-	if img == nil {
-		img = resize.Resize(
-			uint(size.X),
-			uint(size.Y),
-			ir.Image,
-			resize.Bicubic,
-		)
-		defaultImageCache.Set(&size, img)
-	}
-	for n, resp := range callers {
-		resp <- img
-		if n > 0 {
-			defacerImageResizeCoalesceSum.Inc()
+// resize resizes the closest larger level of the pyramid to size.
+func (ir *imageResizer) resize(size image.Point) image.Image {
+	src := ir.Levels[0]
+	for _, m := range ir.Levels[1:] {
+		b := m.Bounds()
+		if b.Dx() < size.X || b.Dy() < size.Y {
+			break
 		}
+		src = m
 	}
+	return resize.Resize(uint(size.X), uint(size.Y), src, ir.Interp)
 }
@@ -2,7 +2,10 @@ package apiserver
 
 import (
 	"image"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/fiorix/defacer/apiserver/internal"
 )
@@ -12,10 +15,128 @@ func TestImageResizer(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	ir := NewImageResizer(overlay)
+	ir := NewImageResizer(overlay, nil)
 	im := ir.Resize(image.Point{101, 102})
 	size := im.Bounds().Max
 	if size.X != 101 || size.Y != 102 {
 		t.Fatal("unexpected size:", size)
 	}
+	// the default cache is closed with the resizer
+	cache := ir.(*imageResizer).Cache
+	ir.Close()
+	if cache.Len() != 0 {
+		t.Fatal("cache not closed")
+	}
+}
+
+func TestImageResizerConcurrent(t *testing.T) {
+	overlay, err := internal.DefaultDefaceImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewImageCache(0, 0)
+	defer cache.Close()
+	ir := NewImageResizer(overlay, &ImageResizerOptions{Cache: cache})
+	// slow resizes, so that all calls miss the cache
+	var resizes int32
+	resize := ir.(*imageResizer).resize
+	ir.(*imageResizer).resizeFunc = func(size image.Point) image.Image {
+		atomic.AddInt32(&resizes, 1)
+		time.Sleep(100 * time.Millisecond)
+		return resize(size)
+	}
+	start := make(chan bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			size := ir.Resize(image.Point{51, 52}).Bounds().Max
+			if size.X != 51 || size.Y != 52 {
+				t.Error("unexpected size:", size)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if n := atomic.LoadInt32(&resizes); n != 1 {
+		t.Fatal("unexpected number of resizes:", n)
+	}
+	if cache.Len() != 1 {
+		t.Fatal("unexpected cache length:", cache.Len())
+	}
+	// caches of the options are not closed with the resizer
+	ir.Close()
+	if cache.Len() != 1 {
+		t.Fatal("cache closed with the resizer")
+	}
+}
+
+func TestImagePyramid(t *testing.T) {
+	m := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	levels := imagePyramid(m, resizeFilters[DefaultResizeFilter])
+	want := []image.Point{{200, 100}, {100, 50}, {50, 25}}
+	if len(levels) != len(want) {
+		t.Fatal("unexpected number of levels:", len(levels))
+	}
+	for i, size := range want {
+		if levels[i].Bounds().Size() != size {
+			t.Fatalf("unexpected size of level %d: %v", i, levels[i].Bounds().Size())
+		}
+	}
+}
+
+func TestParseResizeFilter(t *testing.T) {
+	f, err := ParseResizeFilter("")
+	if err != nil || f != DefaultResizeFilter {
+		t.Fatal("unexpected default filter:", f, err)
+	}
+	f, err = ParseResizeFilter("lanczos3")
+	if err != nil || f != FilterLanczos3 {
+		t.Fatal("unexpected filter:", f, err)
+	}
+	if _, err = ParseResizeFilter("sinc"); err == nil {
+		t.Fatal("unknown filter accepted")
+	}
+}
+
+func benchmarkImageResize(b *testing.B, filter ResizeFilter, pyramid bool) {
+	overlay, err := internal.DefaultDefaceImage()
+	if err != nil {
+		b.Fatal(err)
+	}
+	ir := NewImageResizer(overlay, &ImageResizerOptions{Filter: filter}).(*imageResizer)
+	defer ir.Cache.Close()
+	if !pyramid {
+		ir.Levels = ir.Levels[:1]
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ir.resize(image.Point{20, 20})
+	}
+}
+
+func BenchmarkImageResizeNearest(b *testing.B) {
+	benchmarkImageResize(b, FilterNearest, false)
+}
+
+func BenchmarkImageResizeNearestPyramid(b *testing.B) {
+	benchmarkImageResize(b, FilterNearest, true)
+}
+
+func BenchmarkImageResizeBicubic(b *testing.B) {
+	benchmarkImageResize(b, FilterBicubic, false)
+}
+
+func BenchmarkImageResizeBicubicPyramid(b *testing.B) {
+	benchmarkImageResize(b, FilterBicubic, true)
+}
+
+func BenchmarkImageResizeLanczos3(b *testing.B) {
+	benchmarkImageResize(b, FilterLanczos3, false)
+}
+
+func BenchmarkImageResizeLanczos3Pyramid(b *testing.B) {
+	benchmarkImageResize(b, FilterLanczos3, true)
 }
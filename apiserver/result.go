@@ -0,0 +1,367 @@
+package apiserver
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/gob"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultResultCacheDiskBytes is the default size budget of the disk
+// tier of a ResultCache.
+const DefaultResultCacheDiskBytes = 1 << 30
+
+// ResultCache holds defaced images indexed by upstream URL and
+// redaction options, with the validators of the upstream image they
+// were defaced from. Results are held in memory up to a byte budget,
+// and optionally on disk up to another budget. Least recently used
+// results are evicted from each tier independently.
+//
+// Results are fresh for the max-age of the upstream response, and
+// revalidated upstream with their validators once stale.
+type ResultCache struct {
+	mem  *resultLRU
+	disk *resultDisk
+}
+
+// cachedResult is a defaced image response, and the validators of
+// the upstream image.
+type cachedResult struct {
+	Header       http.Header
+	Body         []byte
+	Time         time.Time // stored or last revalidated
+	Expires      time.Time
+	ETag         string
+	LastModified string
+}
+
+// NewResultCache creates and initializes a new ResultCache that holds
+// up to memBytes of results in memory, and up to diskBytes in dir.
+// Results already in dir are loaded. If memBytes is 0 results are
+// only cached on disk, and if dir is empty only in memory.
+func NewResultCache(memBytes int64, dir string, diskBytes int64) (*ResultCache, error) {
+	rc := &ResultCache{}
+	if memBytes > 0 {
+		rc.mem = newResultLRU(memBytes)
+	}
+	if dir != "" {
+		if diskBytes == 0 {
+			diskBytes = DefaultResultCacheDiskBytes
+		}
+		disk, err := newResultDisk(dir, diskBytes)
+		if err != nil {
+			return nil, err
+		}
+		rc.disk = disk
+	}
+	return rc, nil
+}
+
+// resultKey returns the cache key of the image at url, defaced with
+// the options that produce ETags with the given prefix.
+func resultKey(url, prefix string) string {
+	h := sha1.New()
+	h.Write([]byte(url + "\n" + prefix))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Get returns the result of the given key, or nil if it's not cached.
+// Results found on disk are promoted to memory.
+func (rc *ResultCache) Get(key string) *cachedResult {
+	if rc.mem != nil {
+		if res := rc.mem.Get(key); res != nil {
+			defacerResultCacheHitsSum.WithLabelValues("memory").Inc()
+			return res
+		}
+	}
+	if rc.disk != nil {
+		if res := rc.disk.Get(key); res != nil {
+			defacerResultCacheHitsSum.WithLabelValues("disk").Inc()
+			if rc.mem != nil {
+				rc.mem.Set(key, res)
+			}
+			return res
+		}
+	}
+	defacerResultCacheMissSum.Inc()
+	return nil
+}
+
+// Set adds the result to all cache tiers. Cached results must not be
+// modified.
+func (rc *ResultCache) Set(key string, res *cachedResult) {
+	if rc.mem != nil {
+		rc.mem.Set(key, res)
+	}
+	if rc.disk != nil {
+		rc.disk.Set(key, res)
+	}
+}
+
+// resultLifetime returns for how long the upstream response with the
+// given headers is fresh, and whether results defaced from it can be
+// stored at all, according to its Cache-Control header.
+func resultLifetime(h http.Header) (time.Duration, bool) {
+	var maxAge, sMaxAge time.Duration = -1, -1
+	for _, v := range h["Cache-Control"] {
+		for _, directive := range strings.Split(v, ",") {
+			kv := strings.SplitN(strings.TrimSpace(directive), "=", 2)
+			name := strings.ToLower(kv[0])
+			switch name {
+			case "no-store", "private":
+				return 0, false
+			case "no-cache":
+				sMaxAge = 0
+			case "max-age", "s-maxage":
+				if len(kv) != 2 {
+					continue
+				}
+				n, err := strconv.Atoi(strings.Trim(kv[1], `"`))
+				if err != nil || n < 0 {
+					continue
+				}
+				if name == "max-age" {
+					maxAge = time.Duration(n) * time.Second
+				} else if sMaxAge != 0 {
+					sMaxAge = time.Duration(n) * time.Second
+				}
+			}
+		}
+	}
+	switch {
+	case sMaxAge >= 0:
+		return sMaxAge, true
+	case maxAge >= 0:
+		return maxAge, true
+	}
+	return 0, true
+}
+
+// resultBytes returns the approximate memory used by res.
+func resultBytes(res *cachedResult) int64 {
+	n := int64(len(res.Body) + len(res.ETag) + len(res.LastModified))
+	for k, v := range res.Header {
+		n += int64(len(k))
+		for _, s := range v {
+			n += int64(len(s))
+		}
+	}
+	return n
+}
+
+// resultLRU is the memory tier of the ResultCache.
+type resultLRU struct {
+	sync.Mutex
+	maxBytes int64
+	bytes    int64
+	ll       *list.List // front is most recently used
+	m        map[string]*list.Element
+}
+
+type resultLRUItem struct {
+	Key    string
+	Result *cachedResult
+	Bytes  int64
+}
+
+func newResultLRU(maxBytes int64) *resultLRU {
+	return &resultLRU{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		m:        make(map[string]*list.Element),
+	}
+}
+
+func (c *resultLRU) Get(key string) *cachedResult {
+	c.Lock()
+	defer c.Unlock()
+	e := c.m[key]
+	if e == nil {
+		return nil
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*resultLRUItem).Result
+}
+
+func (c *resultLRU) Set(key string, res *cachedResult) {
+	n := resultBytes(res)
+	if n > c.maxBytes {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if e := c.m[key]; e != nil {
+		c.remove(e)
+	}
+	c.m[key] = c.ll.PushFront(&resultLRUItem{Key: key, Result: res, Bytes: n})
+	c.bytes += n
+	defacerResultCacheBytes.WithLabelValues("memory").Add(float64(n))
+	for c.bytes > c.maxBytes {
+		c.remove(c.ll.Back())
+	}
+}
+
+// remove removes the given element from the cache. The caller must
+// hold the lock.
+func (c *resultLRU) remove(e *list.Element) {
+	item := c.ll.Remove(e).(*resultLRUItem)
+	delete(c.m, item.Key)
+	c.bytes -= item.Bytes
+	defacerResultCacheBytes.WithLabelValues("memory").Sub(float64(item.Bytes))
+}
+
+// resultDisk is the disk tier of the ResultCache. Results are stored
+// as gob files named after their key. Only the index of files and
+// their sizes is kept in memory. Other files in the directory are
+// left alone.
+type resultDisk struct {
+	sync.Mutex
+	dir      string
+	maxBytes int64
+	bytes    int64
+	ll       *list.List // front is most recently used
+	m        map[string]*list.Element
+}
+
+type resultDiskItem struct {
+	Key   string
+	Bytes int64
+}
+
+// resultTempPrefix is the prefix of results being written to disk.
+const resultTempPrefix = ".defacer-tmp-"
+
+// resultFileRE matches the names of result files, see resultKey.
+var resultFileRE = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// newResultDisk creates the disk tier in dir, and indexes the results
+// already in it from the least to the most recently modified.
+func newResultDisk(dir string, maxBytes int64) (*resultDisk, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(byModTime(files))
+	c := &resultDisk{
+		dir:      dir,
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		m:        make(map[string]*list.Element),
+	}
+	c.Lock()
+	defer c.Unlock()
+	for _, fi := range files {
+		switch {
+		case !fi.Mode().IsRegular():
+		case strings.HasPrefix(fi.Name(), resultTempPrefix):
+			os.Remove(filepath.Join(dir, fi.Name()))
+		case resultFileRE.MatchString(fi.Name()):
+			c.add(fi.Name(), fi.Size())
+		}
+	}
+	return c, nil
+}
+
+func (c *resultDisk) Get(key string) *cachedResult {
+	c.Lock()
+	e := c.m[key]
+	if e != nil {
+		c.ll.MoveToFront(e)
+	}
+	c.Unlock()
+	if e == nil {
+		return nil
+	}
+	f, err := os.Open(filepath.Join(c.dir, key))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var res cachedResult
+	if err = gob.NewDecoder(f).Decode(&res); err != nil {
+		c.Lock()
+		if e = c.m[key]; e != nil {
+			c.remove(e)
+		}
+		c.Unlock()
+		return nil
+	}
+	return &res
+}
+
+func (c *resultDisk) Set(key string, res *cachedResult) {
+	if resultBytes(res) > c.maxBytes {
+		return
+	}
+	f, err := ioutil.TempFile(c.dir, resultTempPrefix)
+	if err != nil {
+		return
+	}
+	err = gob.NewEncoder(f).Encode(res)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	fi, serr := os.Stat(f.Name())
+	if err != nil || serr != nil || fi.Size() > c.maxBytes {
+		os.Remove(f.Name())
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if err = os.Rename(f.Name(), filepath.Join(c.dir, key)); err != nil {
+		os.Remove(f.Name())
+		return
+	}
+	if e := c.m[key]; e != nil {
+		c.forget(e)
+	}
+	c.add(key, fi.Size())
+}
+
+// add indexes a result file and evicts least recently used results
+// to make room for it. The caller must hold the lock.
+func (c *resultDisk) add(key string, n int64) {
+	c.m[key] = c.ll.PushFront(&resultDiskItem{Key: key, Bytes: n})
+	c.bytes += n
+	defacerResultCacheBytes.WithLabelValues("disk").Add(float64(n))
+	for c.bytes > c.maxBytes {
+		c.remove(c.ll.Back())
+	}
+}
+
+// remove removes a result file and its index. The caller must hold
+// the lock.
+func (c *resultDisk) remove(e *list.Element) {
+	item := c.forget(e)
+	os.Remove(filepath.Join(c.dir, item.Key))
+}
+
+// forget removes the index of a result file. The caller must hold
+// the lock.
+func (c *resultDisk) forget(e *list.Element) *resultDiskItem {
+	item := c.ll.Remove(e).(*resultDiskItem)
+	delete(c.m, item.Key)
+	c.bytes -= item.Bytes
+	defacerResultCacheBytes.WithLabelValues("disk").Sub(float64(item.Bytes))
+	return item
+}
+
+// byModTime sorts files from the least to the most recently modified.
+type byModTime []os.FileInfo
+
+func (s byModTime) Len() int           { return len(s) }
+func (s byModTime) Less(i, j int) bool { return s[i].ModTime().Before(s[j].ModTime()) }
+func (s byModTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,120 @@
+package apiserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestResult(body string) *cachedResult {
+	return &cachedResult{
+		Header:  http.Header{"Content-Type": {"image/png"}},
+		Body:    []byte(body),
+		Time:    time.Now(),
+		Expires: time.Now().Add(time.Minute),
+		ETag:    `"v1"`,
+	}
+}
+
+func TestResultCacheMemory(t *testing.T) {
+	rc, err := NewResultCache(150, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := string(bytes.Repeat([]byte("x"), 40))
+	rc.Set("a", newTestResult(body))
+	rc.Set("b", newTestResult(body))
+	if rc.Get("a") == nil {
+		t.Fatal("result a not cached")
+	}
+	// b is the least recently used
+	rc.Set("c", newTestResult(body))
+	if rc.Get("b") != nil {
+		t.Fatal("result b not evicted")
+	}
+	if res := rc.Get("a"); res == nil || string(res.Body) != body {
+		t.Fatal("unexpected result a:", res)
+	}
+	rc.Set("d", newTestResult(string(bytes.Repeat([]byte("x"), 200))))
+	if rc.Get("d") != nil {
+		t.Fatal("result larger than the cache was stored")
+	}
+}
+
+func TestResultCacheDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "defacer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// other files are not results, and are never evicted
+	other := dir + "/README"
+	if err = ioutil.WriteFile(other, []byte("not a result"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := NewResultCache(0, dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b, c := resultKey("a", ""), resultKey("b", ""), resultKey("c", "")
+	rc.Set(a, newTestResult("image a"))
+	rc.Set(b, newTestResult("image b"))
+	fi, err := os.Stat(dir + "/" + a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// results survive restarts
+	rc, err = NewResultCache(1<<10, dir, 2*fi.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := rc.Get(a)
+	if res == nil || string(res.Body) != "image a" || res.ETag != `"v1"` {
+		t.Fatal("unexpected result a:", res)
+	}
+	if res.Header.Get("Content-Type") != "image/png" {
+		t.Fatal("unexpected result header:", res.Header)
+	}
+	rc.Set(c, newTestResult("image c"))
+	if _, err = os.Stat(dir + "/" + b); !os.IsNotExist(err) {
+		t.Fatal("result b not evicted from disk:", err)
+	}
+	if rc.Get(b) != nil {
+		t.Fatal("unexpected result b")
+	}
+	if rc.Get(c) == nil {
+		t.Fatal("result c not cached")
+	}
+	if _, err = os.Stat(other); err != nil {
+		t.Fatal("other file removed:", err)
+	}
+}
+
+func TestResultLifetime(t *testing.T) {
+	tests := []struct {
+		CacheControl string
+		TTL          time.Duration
+		OK           bool
+	}{
+		{"", 0, true},
+		{"max-age=60", time.Minute, true},
+		{"public, max-age=60, s-maxage=10", 10 * time.Second, true},
+		{"max-age=60, no-cache", 0, true},
+		{"max-age=invalid", 0, true},
+		{"private, max-age=60", 0, false},
+		{"No-Store", 0, false},
+	}
+	for _, tc := range tests {
+		h := http.Header{}
+		if tc.CacheControl != "" {
+			h.Set("Cache-Control", tc.CacheControl)
+		}
+		ttl, ok := resultLifetime(h)
+		if ttl != tc.TTL || ok != tc.OK {
+			t.Errorf("%q: want %v %t, have %v %t", tc.CacheControl, tc.TTL, tc.OK, ttl, ok)
+		}
+	}
+}
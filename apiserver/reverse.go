@@ -0,0 +1,210 @@
+package apiserver
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// reverseProxy sits in front of an upstream origin and forwards every
+// request to it. Images served by the origin are defaced on the way
+// through, and all other responses are streamed unchanged.
+type reverseProxy struct {
+	*proxy
+	Upstream *url.URL
+	Timeout  time.Duration // of images, see defaceRequest
+	stream   *httputil.ReverseProxy
+}
+
+// DefacerReverseProxy returns a handler that forwards all requests to
+// the upstream origin, and defaces the images it serves.
+func DefacerReverseProxy(df Defacer, upstream *url.URL, cli *http.Client, logger *log.Logger) http.Handler {
+	return newReverseProxy(&proxy{
+		Defacer:  df,
+		Client:   cli,
+		ErrorLog: logger,
+	}, upstream)
+}
+
+// newReverseProxy returns a reverse proxy to upstream that defaces
+// images like p. Redirects from the upstream are not followed, and
+// the timeout of p's client only applies to images.
+func newReverseProxy(p *proxy, upstream *url.URL) *reverseProxy {
+	cli := &http.Client{}
+	if p.Client != nil {
+		*cli = *p.Client
+	}
+	cli.Timeout = 0
+	cli.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	rp := &reverseProxy{Upstream: upstream}
+	pc := *p
+	pc.Client = cli
+	rp.proxy = &pc
+	if p.Client != nil {
+		rp.Timeout = p.Client.Timeout
+	}
+	rp.stream = httputil.NewSingleHostReverseProxy(upstream)
+	rp.stream.Transport = cli.Transport
+	rp.stream.ErrorLog = p.ErrorLog
+	rp.stream.ModifyResponse = func(resp *http.Response) error {
+		rp.rewriteLocation(resp.Header, resp.Request.URL)
+		return nil
+	}
+	return rp
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (rp *reverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		rp.stream.ServeHTTP(w, r)
+		return
+	}
+	opts := rp.Options
+	if err := rp.setOverlay(&opts, rp.Overlay); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	enc := rp.Encode
+	target := rp.target(r.URL)
+	dr := &defaceRequest{
+		URL:     target.String(),
+		Overlay: rp.Overlay,
+		Options: &opts,
+		Encode:  &enc,
+		Header:  forwardHeader(r),
+		Status:  true,
+		// shared caches don't store authenticated responses
+		NoCache: r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "",
+		Timeout: rp.Timeout,
+	}
+	lw := &locationWriter{ResponseWriter: w, rewrite: func(h http.Header) {
+		rp.rewriteLocation(h, target)
+	}}
+	status, err := rp.deface(lw, r, dr)
+	if err != nil {
+		http.Error(lw, err.Error(), status)
+	}
+}
+
+// rewriteLocation maps the Location and Content-Location headers of an
+// upstream response to a request for target back to the proxy, so
+// that clients don't bypass it. Locations outside of the upstream are
+// not changed.
+func (rp *reverseProxy) rewriteLocation(h http.Header, target *url.URL) {
+	for _, k := range []string{"Location", "Content-Location"} {
+		if v := h.Get(k); v != "" {
+			h.Set(k, rp.location(target, v))
+		}
+	}
+}
+
+// location returns the location v, relative to target, as a path of
+// the proxy if it's within the upstream.
+func (rp *reverseProxy) location(target *url.URL, v string) string {
+	u, err := target.Parse(v)
+	if err != nil || u.Scheme != rp.Upstream.Scheme || !strings.EqualFold(u.Host, rp.Upstream.Host) {
+		return v
+	}
+	base := strings.TrimSuffix(rp.Upstream.Path, "/")
+	if u.Path != base && !strings.HasPrefix(u.Path, base+"/") {
+		return v
+	}
+	p := &url.URL{
+		Path:     strings.TrimPrefix(u.Path, base),
+		RawQuery: u.RawQuery,
+		Fragment: u.Fragment,
+	}
+	if p.Path == "" {
+		p.Path = "/"
+	}
+	return p.String()
+}
+
+// locationWriter rewrites the headers of a response before they are
+// written.
+type locationWriter struct {
+	http.ResponseWriter
+	rewrite func(http.Header)
+	done    bool
+}
+
+// WriteHeader implements the http.ResponseWriter interface.
+func (w *locationWriter) WriteHeader(code int) {
+	if !w.done {
+		w.done = true
+		w.rewrite(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements the http.ResponseWriter interface.
+func (w *locationWriter) Write(p []byte) (int, error) {
+	if !w.done {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// target returns the upstream URL of the request URL u.
+func (rp *reverseProxy) target(u *url.URL) *url.URL {
+	t := *rp.Upstream
+	t.Path = singleJoiningSlash(t.Path, u.Path)
+	t.RawPath = ""
+	switch {
+	case t.RawQuery == "":
+		t.RawQuery = u.RawQuery
+	case u.RawQuery != "":
+		t.RawQuery += "&" + u.RawQuery
+	}
+	return &t
+}
+
+// forwardHeader returns the headers of r to send upstream. Hop-by-hop
+// headers are removed, as are conditional and range headers which are
+// handled by the proxy, and the client address is appended to
+// X-Forwarded-For.
+func forwardHeader(r *http.Request) http.Header {
+	h := cloneHeader(r.Header)
+	for _, hdr := range hopHeaders {
+		h.Del(hdr)
+	}
+	for _, hdr := range []string{
+		"Accept-Encoding",
+		"If-Match",
+		"If-Modified-Since",
+		"If-None-Match",
+		"If-Range",
+		"If-Unmodified-Since",
+		"Range",
+	} {
+		h.Del(hdr)
+	}
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := h.Get("X-Forwarded-For"); prior != "" {
+			ip = prior + ", " + ip
+		}
+		h.Set("X-Forwarded-For", ip)
+	}
+	return h
+}
+
+// singleJoiningSlash joins a and b with a single slash.
+//
+// Copied from net/http/httputil.
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
@@ -0,0 +1,188 @@
+package apiserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestReverseProxy(t *testing.T) {
+	src := blankPNG(t)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/media/a.png":
+			if r.URL.RawQuery != "v=2" || r.Header.Get("Cookie") != "id=1" {
+				http.Error(w, "unexpected request", http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(src)
+		case "/media/missing.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write(src)
+		case "/media/old":
+			http.Redirect(w, r, "/media/a.png", http.StatusMovedPermanently)
+		case "/media/moved":
+			http.Redirect(w, r, "http://"+r.Host+"/media/dir/b.png?v=1", http.StatusFound)
+		case "/media/away":
+			http.Redirect(w, r, "http://example.com/media/a.png", http.StatusFound)
+		case "/media/outside":
+			http.Redirect(w, r, "/other/a.png", http.StatusFound)
+		case "/media/upload":
+			b, _ := ioutil.ReadAll(r.Body)
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Location", "/media/uploads/1")
+			w.WriteHeader(http.StatusCreated)
+			w.Write(b)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("<html>not found</html>"))
+		}
+	}))
+	defer origin.Close()
+	upstream, _ := url.Parse(origin.URL + "/media")
+	rp := newReverseProxy(newTestProxy(t), upstream)
+	serve := func(method, path string, body []byte) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest(method, path, bytes.NewReader(body))
+		r.Header.Set("Cookie", "id=1")
+		w := httptest.NewRecorder()
+		rp.ServeHTTP(w, r)
+		return w
+	}
+	w := serve("GET", "/a.png?v=2", nil)
+	if w.Code != http.StatusOK || w.Header().Get("X-Defacer-Faces") != "0" {
+		t.Fatal("unexpected response:", w.Code, w.Body.String())
+	}
+	if bytes.Equal(w.Body.Bytes(), src) {
+		t.Fatal("image was not defaced")
+	}
+	w = serve("GET", "/missing.png", nil)
+	if w.Code != http.StatusNotFound || w.Header().Get("X-Defacer-Faces") != "0" {
+		t.Fatal("unexpected response:", w.Code, w.Header())
+	}
+	w = serve("GET", "/index.html", nil)
+	if w.Code != http.StatusNotFound || w.Body.String() != "<html>not found</html>" {
+		t.Fatal("unexpected response:", w.Code, w.Body.String())
+	}
+	w = serve("GET", "/old", nil)
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/a.png" {
+		t.Fatal("unexpected response:", w.Code, w.Header())
+	}
+	for path, want := range map[string]string{
+		"/moved":   "/dir/b.png?v=1",
+		"/away":    "http://example.com/media/a.png",
+		"/outside": "/other/a.png",
+	} {
+		if w = serve("GET", path, nil); w.Header().Get("Location") != want {
+			t.Errorf("%s: unexpected location: %q", path, w.Header().Get("Location"))
+		}
+	}
+	w = serve("POST", "/upload", []byte("data"))
+	if w.Code != http.StatusCreated || w.Body.String() != "data" {
+		t.Fatal("unexpected response:", w.Code, w.Body.String())
+	}
+	if v := w.Header().Get("Location"); v != "/uploads/1" {
+		t.Fatal("unexpected location:", v)
+	}
+}
+
+func TestReverseProxyTimeout(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Write([]byte("part1"))
+		w.(http.Flusher).Flush()
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("part2"))
+	}))
+	defer origin.Close()
+	upstream, _ := url.Parse(origin.URL)
+	p := newTestProxy(t)
+	p.Client = &http.Client{Timeout: 50 * time.Millisecond}
+	rp := newReverseProxy(p, upstream)
+	r, _ := http.NewRequest("GET", "/video.mp4", nil)
+	w := httptest.NewRecorder()
+	rp.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "part1part2" {
+		t.Fatal("unexpected response:", w.Code, w.Body.String())
+	}
+}
+
+func TestReverseProxyCache(t *testing.T) {
+	src := blankPNG(t)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/private.png" {
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(src)
+	}))
+	defer origin.Close()
+	upstream, _ := url.Parse(origin.URL)
+	p := newTestProxy(t)
+	results, err := NewResultCache(1<<20, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Results = results
+	rp := newReverseProxy(p, upstream)
+	serve := func(path string, header http.Header) string {
+		r, _ := http.NewRequest("GET", path, nil)
+		r.Header = header
+		w := httptest.NewRecorder()
+		rp.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatal("unexpected status:", w.Code, w.Body.String())
+		}
+		return w.Header().Get("X-Defacer-Cache")
+	}
+	cookie := http.Header{"Cookie": {"id=1"}}
+	for i, tc := range []struct {
+		Path   string
+		Header http.Header
+		Want   string
+	}{
+		{"/a.png", cookie, ""},
+		{"/a.png", http.Header{}, "miss"},
+		{"/a.png", cookie, ""},
+		{"/a.png", http.Header{}, "hit"},
+		{"/private.png", http.Header{}, "miss"},
+		{"/private.png", http.Header{}, "miss"},
+	} {
+		if have := serve(tc.Path, tc.Header); have != tc.Want {
+			t.Errorf("request %d: want cache %q, have %q", i, tc.Want, have)
+		}
+	}
+}
+
+func TestForwardHeader(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.2:1234"
+	r.Header.Set("Connection", "close")
+	r.Header.Set("Range", "bytes=0-10")
+	r.Header.Set("If-None-Match", `"v1"`)
+	r.Header.Set("Authorization", "Bearer x")
+	r.Header.Set("X-Forwarded-For", "10.0.0.1")
+	h := forwardHeader(r)
+	for _, hdr := range []string{"Connection", "Range", "If-None-Match"} {
+		if h.Get(hdr) != "" {
+			t.Fatal("unexpected header:", hdr)
+		}
+	}
+	if h.Get("Authorization") != "Bearer x" {
+		t.Fatal("missing authorization header")
+	}
+	if v := h.Get("X-Forwarded-For"); v != "10.0.0.1, 10.0.0.2" {
+		t.Fatal("unexpected X-Forwarded-For:", v)
+	}
+	if r.Header.Get("Range") == "" {
+		t.Fatal("request headers were modified")
+	}
+}
@@ -0,0 +1,154 @@
+package apiserver
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// urlSigner verifies the signatures of request URLs. A signed URL has
+// an expires param with a unix time, and a sig param with the hex
+// HMAC-SHA256 of its path and sorted query params, except sig, see
+// SignURL.
+//
+// Multiple secrets can be active for rotation: URLs signed with any
+// of them are valid, and the first one signs URLs generated by the
+// defacer, such as the image URLs of pages.
+type urlSigner struct {
+	Secrets  [][]byte
+	Required bool // reject unsigned requests
+	KeyAuth  bool // requests with a body are authenticated by API key
+}
+
+// SignURL returns rawurl signed with secret, valid until expires. The
+// path and query of rawurl must be the ones the defacer receives, such
+// as "/api/v1/deface?url=...".
+func SignURL(rawurl string, secret []byte, expires time.Time) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	signURL(secret, u.Path, q, expires)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// signURL sets the expires and sig params of q, the query of path.
+func signURL(secret []byte, path string, q url.Values, expires time.Time) {
+	q.Del("sig")
+	q.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	q.Set("sig", hex.EncodeToString(urlMAC(secret, path, q)))
+}
+
+// urlMAC returns the HMAC of path and q, except for its sig param.
+func urlMAC(secret []byte, path string, q url.Values) []byte {
+	v := make(url.Values, len(q))
+	for k, vv := range q {
+		if k != "sig" {
+			v[k] = vv
+		}
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(path + "?" + v.Encode()))
+	return mac.Sum(nil)
+}
+
+// Wrap returns a handler that verifies the signature of GET requests
+// before calling next. Unsigned requests are only allowed if
+// signatures are not required, but invalid signatures never are.
+// Requests with a body, such as uploads, can't be signed, so they are
+// denied when signatures are required, unless they are authenticated
+// by API key.
+func (s *urlSigner) Wrap(next http.Handler) http.Handler {
+	deny := s.Deny(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && s.Required && !s.KeyAuth {
+			deny.ServeHTTP(w, r)
+			return
+		}
+		if r.Method == "GET" {
+			if err := s.verify(r.URL, time.Now()); err != nil {
+				defacerSignedRequestsSum.WithLabelValues("rejected").Inc()
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			if _, ok := s.expires(r.URL); ok {
+				defacerSignedRequestsSum.WithLabelValues("valid").Inc()
+				r = r.WithContext(context.WithValue(r.Context(), signedContext{}, true))
+			} else {
+				defacerSignedRequestsSum.WithLabelValues("unsigned").Inc()
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Deny returns a handler that rejects all requests, for endpoints that
+// can't be signed when signatures are required, such as the ones that
+// take a request body.
+func (s *urlSigner) Deny(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defacerSignedRequestsSum.WithLabelValues("rejected").Inc()
+		http.Error(w, "Signed requests are required, use an API key", http.StatusForbidden)
+	})
+}
+
+// signedContext is the context key set on requests with a valid
+// signature.
+type signedContext struct{}
+
+// signedRequest reports whether r has a valid signature.
+func signedRequest(r *http.Request) bool {
+	signed, _ := r.Context().Value(signedContext{}).(bool)
+	return signed
+}
+
+// verify checks the signature of u at now.
+func (s *urlSigner) verify(u *url.URL, now time.Time) error {
+	q := u.Query()
+	sig := q.Get("sig")
+	if sig == "" {
+		if s.Required {
+			return errors.New("Missing signature")
+		}
+		return nil
+	}
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil {
+		return errors.New("Invalid `expires` param")
+	}
+	if now.Unix() > expires {
+		return errors.New("Signature expired")
+	}
+	mac, err := hex.DecodeString(sig)
+	if err != nil {
+		return errors.New("Invalid signature")
+	}
+	for _, secret := range s.Secrets {
+		if hmac.Equal(mac, urlMAC(secret, u.Path, q)) {
+			return nil
+		}
+	}
+	return errors.New("Invalid signature")
+}
+
+// expires returns the expiry of a signed request URL, and whether it
+// is signed.
+func (s *urlSigner) expires(u *url.URL) (time.Time, bool) {
+	q := u.Query()
+	if q.Get("sig") == "" {
+		return time.Time{}, false
+	}
+	n, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(n, 0), true
+}
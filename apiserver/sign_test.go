@@ -0,0 +1,117 @@
+package apiserver
+
+import (
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestSignURL(t *testing.T) {
+	old, cur := []byte("old"), []byte("current")
+	s := &urlSigner{Secrets: [][]byte{cur, old}, Required: true}
+	now := time.Now()
+	rawurl := "/api/v1/deface?url=http%3A%2F%2Fexample.com%2Fa.jpg&overlay=cat"
+	signed, err := SignURL(rawurl, old, now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(signed)
+	if err = s.verify(u, now); err != nil {
+		t.Fatal("valid signature rejected:", err)
+	}
+	if err = s.verify(u, now.Add(2*time.Minute)); err == nil || err.Error() != "Signature expired" {
+		t.Fatal("unexpected error:", err)
+	}
+	for _, tamper := range []func(q url.Values){
+		func(q url.Values) { q.Set("url", "http://example.com/b.jpg") },
+		func(q url.Values) { q.Set("overlay", "dog") },
+		func(q url.Values) { q.Set("format", "png") },
+		func(q url.Values) { q.Set("expires", q.Get("expires")+"0") },
+		func(q url.Values) { q.Set("sig", "zz") },
+		func(q url.Values) { q.Del("expires") },
+		func(q url.Values) { q.Del("sig") },
+	} {
+		tu := *u
+		q := tu.Query()
+		tamper(q)
+		tu.RawQuery = q.Encode()
+		if err = s.verify(&tu, now); err == nil {
+			t.Errorf("tampered URL accepted: %s", tu.RawQuery)
+		}
+	}
+	// retired secrets are rejected
+	s.Secrets = [][]byte{cur}
+	if err = s.verify(u, now); err == nil {
+		t.Fatal("signature of retired secret accepted")
+	}
+}
+
+func TestURLSignerWrap(t *testing.T) {
+	s := &urlSigner{Secrets: [][]byte{[]byte("secret")}}
+	h := s.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(method, rawurl string) int {
+		r, _ := http.NewRequest(method, rawurl, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	signed, _ := SignURL("/v1/deface?url=a", []byte("secret"), time.Now().Add(time.Minute))
+	for _, tc := range []struct {
+		required, keyAuth bool
+		method            string
+		url               string
+		status            int
+	}{
+		{false, false, "GET", "/v1/deface?url=a", http.StatusOK},
+		{false, false, "GET", "/v1/deface?url=a&sig=00&expires=9999999999", http.StatusForbidden},
+		{false, false, "GET", signed, http.StatusOK},
+		{false, false, "POST", "/v1/deface", http.StatusOK},
+		{true, false, "GET", "/v1/deface?url=a", http.StatusForbidden},
+		{true, false, "GET", signed, http.StatusOK},
+		{true, false, "POST", "/v1/deface", http.StatusForbidden},
+		{true, false, "POST", "/v1/detect", http.StatusForbidden},
+		{true, true, "POST", "/v1/deface", http.StatusOK},
+	} {
+		s.Required, s.KeyAuth = tc.required, tc.keyAuth
+		if status := serve(tc.method, tc.url); status != tc.status {
+			t.Errorf("%v %v %s %s: unexpected status: %d", tc.required, tc.keyAuth, tc.method, tc.url, status)
+		}
+	}
+	// request bodies are not signed
+	r, _ := http.NewRequest("POST", "/v1/batch", nil)
+	w := httptest.NewRecorder()
+	s.Deny(h).ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatal("unexpected status:", w.Code)
+	}
+}
+
+func TestPageSign(t *testing.T) {
+	upstream := newTestUpstream("text/html", []byte(`<img src="/image.png">`))
+	defer upstream.Close()
+	s := &urlSigner{Secrets: [][]byte{[]byte("secret")}, Required: true}
+	p := &page{proxy: newTestProxy(t), Deface: "/v1/deface", Signer: s}
+	expires := time.Now().Add(time.Minute)
+	signed, _ := SignURL("/v1/page?url="+url.QueryEscape(upstream.URL), []byte("secret"), expires)
+	r, _ := http.NewRequest("GET", signed, nil)
+	w := httptest.NewRecorder()
+	s.Wrap(p).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatal("unexpected status:", w.Code, w.Body.String())
+	}
+	m := regexp.MustCompile(`src="([^"]+)"`).FindStringSubmatch(w.Body.String())
+	if m == nil {
+		t.Fatal("missing image:", w.Body.String())
+	}
+	u, _ := url.Parse(html.UnescapeString(m[1]))
+	if err := s.verify(u, time.Now()); err != nil {
+		t.Fatal("invalid image signature:", err, u)
+	}
+	if e, _ := s.expires(u); !e.Equal(time.Unix(expires.Unix(), 0)) {
+		t.Fatal("unexpected image expiry:", e)
+	}
+}
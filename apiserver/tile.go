@@ -0,0 +1,138 @@
+package apiserver
+
+import (
+	"image"
+	"image/draw"
+)
+
+// detectReq is a request to scan an image tile for faces.
+type detectReq struct {
+	Image image.Image
+	Resp  chan *detectResp
+}
+
+type detectResp struct {
+	Faces []image.Rectangle
+	Error error
+}
+
+// run scans the tile with the given defacer and sends the response.
+func (req *detectReq) run(df *defacer) {
+	faces, err := df.detect(req.Image)
+	req.Resp <- &detectResp{Faces: faces, Error: err}
+}
+
+// detectTiles scans m for faces in overlapping tiles of the given size.
+// Tiles are offered to idle workers of the defacer pool, and scanned
+// by df when no worker is available. Faces detected in more than one
+// tile are merged.
+func (df *defacer) detectTiles(m image.Image, size, overlap int) ([]image.Rectangle, error) {
+	if overlap <= 0 || overlap >= size {
+		overlap = size / 4
+	}
+	tiles := tileRects(m.Bounds(), size, overlap)
+	resp := make(chan *detectResp, len(tiles))
+	for _, r := range tiles {
+		req := &detectReq{Image: subImage(m, r), Resp: resp}
+		select {
+		case df.Tiles <- req:
+			defacerImageDetectTilesSum.WithLabelValues("pool").Inc()
+		default:
+			req.run(df)
+			defacerImageDetectTilesSum.WithLabelValues("local").Inc()
+		}
+	}
+	var err error
+	var faces []image.Rectangle
+	for range tiles {
+		r := <-resp
+		if r.Error != nil {
+			err = r.Error
+			continue
+		}
+		faces = append(faces, r.Faces...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return mergeRects(faces), nil
+}
+
+// tileRects splits b into square tiles of the given size that overlap
+// by the given number of pixels. Tiles at the right and bottom edges
+// are shifted back to stay within b.
+func tileRects(b image.Rectangle, size, overlap int) []image.Rectangle {
+	xs := tileStarts(b.Min.X, b.Max.X, size, overlap)
+	ys := tileStarts(b.Min.Y, b.Max.Y, size, overlap)
+	tiles := make([]image.Rectangle, 0, len(xs)*len(ys))
+	for _, y := range ys {
+		for _, x := range xs {
+			r := image.Rect(x, y, x+size, y+size).Intersect(b)
+			tiles = append(tiles, r)
+		}
+	}
+	return tiles
+}
+
+// tileStarts returns the start of each tile between min and max.
+func tileStarts(min, max, size, overlap int) []int {
+	step := size - overlap
+	starts := []int{min}
+	for v := min; v+size < max; {
+		v += step
+		if v+size > max {
+			v = max - size
+		}
+		starts = append(starts, v)
+	}
+	return starts
+}
+
+// subImage returns the part of m within r.
+func subImage(m image.Image, r image.Rectangle) image.Image {
+	if s, ok := m.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return s.SubImage(r)
+	}
+	dst := image.NewRGBA(r)
+	draw.Draw(dst, r, m, r.Min, draw.Src)
+	return dst
+}
+
+// mergeRects merges rectangles that mostly overlap, such as the same
+// face detected in two adjacent tiles, into their union.
+func mergeRects(rs []image.Rectangle) []image.Rectangle {
+	merged := make([]image.Rectangle, 0, len(rs))
+	for _, r := range rs {
+		for i := 0; i < len(merged); i++ {
+			if !sameObject(merged[i], r) {
+				continue
+			}
+			// the union may now overlap earlier rectangles
+			r = r.Union(merged[i])
+			merged = append(merged[:i], merged[i+1:]...)
+			i = -1
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// sameObject reports whether the intersection of a and b covers at
+// least half of the smallest of them.
+func sameObject(a, b image.Rectangle) bool {
+	in := area(a.Intersect(b))
+	if in == 0 {
+		return false
+	}
+	min := area(a)
+	if n := area(b); n < min {
+		min = n
+	}
+	return 2*in >= min
+}
+
+func area(r image.Rectangle) int {
+	return r.Dx() * r.Dy()
+}
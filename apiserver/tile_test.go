@@ -0,0 +1,44 @@
+package apiserver
+
+import (
+	"image"
+	"reflect"
+	"testing"
+)
+
+func TestTileRects(t *testing.T) {
+	tiles := tileRects(image.Rect(0, 0, 250, 100), 100, 25)
+	want := []image.Rectangle{
+		image.Rect(0, 0, 100, 100),
+		image.Rect(75, 0, 175, 100),
+		image.Rect(150, 0, 250, 100),
+	}
+	if !reflect.DeepEqual(tiles, want) {
+		t.Fatal("unexpected tiles:", tiles)
+	}
+	tiles = tileRects(image.Rect(0, 0, 50, 120), 100, 25)
+	want = []image.Rectangle{
+		image.Rect(0, 0, 50, 100),
+		image.Rect(0, 20, 50, 120),
+	}
+	if !reflect.DeepEqual(tiles, want) {
+		t.Fatal("unexpected tiles:", tiles)
+	}
+}
+
+func TestMergeRects(t *testing.T) {
+	rs := mergeRects([]image.Rectangle{
+		image.Rect(80, 10, 120, 50),
+		image.Rect(0, 0, 10, 10),
+		image.Rect(82, 12, 122, 52),
+		image.Rect(200, 200, 210, 210),
+	})
+	want := []image.Rectangle{
+		image.Rect(0, 0, 10, 10),
+		image.Rect(80, 10, 122, 52),
+		image.Rect(200, 200, 210, 210),
+	}
+	if !reflect.DeepEqual(rs, want) {
+		t.Fatal("unexpected rectangles:", rs)
+	}
+}
@@ -0,0 +1,139 @@
+package apiserver
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// DefaultMaxUploadBytes is the max size of uploaded images when the
+// max size of images is not set.
+const DefaultMaxUploadBytes = 32 << 20
+
+// errUnknownFormat is returned for images of unknown formats.
+var errUnknownFormat = errors.New("Unknown image format")
+
+// defacedImage is an encoded defaced image.
+type defacedImage struct {
+	Body        []byte
+	ContentType string
+	Faces       []image.Rectangle
+	Passthrough bool // Body is the source, no faces were found
+}
+
+// upload replies to r with its body defaced. The body is the image,
+// and the query params are the same as the ones of GET requests,
+// except for url.
+func (p *proxy) upload(w http.ResponseWriter, r *http.Request) (int, error) {
+	dr := &defaceRequest{}
+	if err := p.parseOptions(dr, r.URL.Query().Get); err != nil {
+		return http.StatusBadRequest, err
+	}
+	img, status, err := p.readImage(w, r)
+	if err != nil {
+		return status, err
+	}
+	accept := r.Header.Get("Accept")
+	if dr.Format == nil {
+		w.Header().Add("Vary", "Accept")
+	}
+	res, status, err := p.defaceBytes(img, dr, accept)
+	if err != nil {
+		return status, err
+	}
+	w.Header().Set("Content-Type", res.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(res.Body)))
+	w.Header().Set("X-Defacer-Faces", strconv.Itoa(len(res.Faces)))
+	if res.Passthrough {
+		w.Header().Set("X-Defacer-Passthrough", "true")
+	}
+	w.Write(res.Body)
+	return 0, nil
+}
+
+// readImage reads the image in the body of r, up to MaxBytes, or
+// DefaultMaxUploadBytes if it's not set.
+func (p *proxy) readImage(w http.ResponseWriter, r *http.Request) ([]byte, int, error) {
+	max := p.MaxBytes
+	if max <= 0 {
+		max = DefaultMaxUploadBytes
+	}
+	if r.ContentLength > max {
+		return nil, http.StatusRequestEntityTooLarge, errImageTooLarge
+	}
+	limit := &maxBytesReader{R: r.Body, N: max}
+	img, err := ioutil.ReadAll(limit)
+	switch {
+	case limit.Exceeded:
+		return nil, http.StatusRequestEntityTooLarge, errImageTooLarge
+	case err != nil:
+		return nil, http.StatusBadRequest, err
+	}
+	return img, 0, nil
+}
+
+// defaceBytes defaces the image img with the options of dr, and encodes
+// it in the format of dr, or the one negotiated with accept. The source
+// is passed through when possible.
+func (p *proxy) defaceBytes(img []byte, dr *defaceRequest, accept string) (*defacedImage, int, error) {
+	src, status, err := p.sniffImage(img)
+	if err != nil {
+		return nil, status, err
+	}
+	opts, format := dr.Options, dr.Format
+	if format == nil {
+		if format = negotiateFormat(accept, src); format == nil {
+			return nil, http.StatusNotAcceptable, errNotAcceptable
+		}
+	}
+	if format != src {
+		// the source can't be passed through
+		opts.KeepSource = false
+	}
+	res, err := p.Defacer.Deface(bytes.NewReader(img), opts)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if source := p.passthrough(res, src); source != nil {
+		defacerImageFormatSum.WithLabelValues(src.Name, src.Name).Inc()
+		return &defacedImage{
+			Body:        source,
+			ContentType: src.ContentType,
+			Passthrough: true,
+		}, 0, nil
+	}
+	var b bytes.Buffer
+	var out io.Writer = &b
+	if src.Name == "jpeg" && format.Name == "jpeg" {
+		segs := p.Metadata.filter(readJPEGSegments(img))
+		out = &jpegSegmentWriter{W: &b, Segments: segs}
+	}
+	if err = format.Encode(out, res.Image, dr.Encode); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	defacerImageFormatSum.WithLabelValues(src.Name, format.Name).Inc()
+	return &defacedImage{
+		Body:        b.Bytes(),
+		ContentType: format.ContentType,
+		Faces:       res.Faces,
+	}, 0, nil
+}
+
+// sniffImage returns the format of img, and checks its size.
+func (p *proxy) sniffImage(img []byte) (*imageFormat, int, error) {
+	switch {
+	case len(img) == 0:
+		return nil, http.StatusBadRequest, errors.New("Missing image")
+	case p.MaxBytes > 0 && int64(len(img)) > p.MaxBytes:
+		return nil, http.StatusRequestEntityTooLarge, errImageTooLarge
+	}
+	f := sniffFormat(img)
+	if f == nil {
+		return nil, http.StatusUnsupportedMediaType, errUnknownFormat
+	}
+	return f, 0, nil
+}
@@ -0,0 +1,96 @@
+package apiserver
+
+import (
+	"bytes"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func serveUpload(p *proxy, query string, body []byte) *httptest.ResponseRecorder {
+	r, _ := http.NewRequest("POST", "/v1/deface?"+query, bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	return w
+}
+
+func TestUpload(t *testing.T) {
+	src := blankPNG(t)
+	p := newTestProxy(t)
+	w := serveUpload(p, "format=gif", src)
+	if w.Code != http.StatusOK {
+		t.Fatal("unexpected status:", w.Code, w.Body.String())
+	}
+	if w.Header().Get("X-Defacer-Faces") != "0" {
+		t.Fatal("missing faces header")
+	}
+	if _, format, err := image.Decode(w.Body); err != nil || format != "gif" {
+		t.Fatal("unexpected image:", format, err)
+	}
+	w = serveUpload(p, "passthrough=true", src)
+	if w.Header().Get("X-Defacer-Passthrough") != "true" || !bytes.Equal(w.Body.Bytes(), src) {
+		t.Fatal("upload was not passed through")
+	}
+}
+
+func TestUploadInvalid(t *testing.T) {
+	src := blankPNG(t)
+	p := newTestProxy(t)
+	p.MaxBytes = int64(len(src) - 1)
+	for _, tc := range []struct {
+		query  string
+		body   []byte
+		status int
+	}{
+		{"", nil, http.StatusBadRequest},
+		{"quality=0", src, http.StatusBadRequest},
+		{"", []byte("not an image"), http.StatusUnsupportedMediaType},
+		{"", src, http.StatusRequestEntityTooLarge},
+	} {
+		if w := serveUpload(p, tc.query, tc.body); w.Code != tc.status {
+			t.Errorf("%q: unexpected status: %d", tc.query, w.Code)
+		}
+	}
+}
+
+func TestUploadDefaultMaxBytes(t *testing.T) {
+	p := newTestProxy(t)
+	r, _ := http.NewRequest("POST", "/v1/deface", bytes.NewReader(blankPNG(t)))
+	r.ContentLength = DefaultMaxUploadBytes + 1
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatal("unexpected status:", w.Code)
+	}
+	// bodies of unknown length are not read past the limit
+	body := &countingReader{R: io.LimitReader(zeroReader{}, 2*DefaultMaxUploadBytes)}
+	r, _ = http.NewRequest("POST", "/v1/deface", ioutil.NopCloser(body))
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge || body.N > DefaultMaxUploadBytes+64<<10 {
+		t.Fatal("unexpected response:", w.Code, body.N)
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+type countingReader struct {
+	R io.Reader
+	N int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.R.Read(p)
+	r.N += int64(n)
+	return n, err
+}
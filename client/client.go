@@ -0,0 +1,287 @@
+// Package client is a client of the defacer HTTP API.
+//
+// Images can be defaced by URL, in which case the defacer fetches
+// them, or by sending their bytes. Detection returns the faces of an
+// image without defacing it.
+//
+// Errors returned by the API are of type *Error, with the HTTP status
+// code of the response. Requests that fail with 503 Service Unavailable
+// are retried with exponential backoff.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default retry settings.
+const (
+	DefaultRetries    = 3
+	DefaultRetryDelay = 500 * time.Millisecond
+)
+
+// maxErrorBytes is the max size of error messages read from responses.
+const maxErrorBytes = 4 << 10
+
+// Client is a client of the defacer HTTP API. The zero value of Client
+// is not valid, BaseURL must be set.
+type Client struct {
+	// BaseURL is the prefix of the API handlers, such as
+	// "http://localhost:8080/api".
+	BaseURL string
+
+	// HTTPClient sends the requests.
+	HTTPClient *http.Client // default: http.DefaultClient
+
+	// Requests that fail with 503 are retried up to Retries times,
+	// after RetryDelay, doubled after every attempt. A Retry-After
+	// header longer than the delay is honored.
+	Retries    int           // default: DefaultRetries, < 0 to disable
+	RetryDelay time.Duration // default: DefaultRetryDelay
+}
+
+// New returns a client of the API at baseURL.
+func New(baseURL string) *Client {
+	return &Client{BaseURL: baseURL}
+}
+
+// Options are the per-call options of deface requests. The zero value
+// uses the server defaults.
+type Options struct {
+	// Overlay is the name of the overlay drawn on faces.
+	Overlay string
+
+	// Format is the output format, such as "jpeg" or "png". The
+	// default is the format of the source image.
+	Format string
+
+	// Encoding options, see the server's EncodeOptions.
+	Quality     int    // JPEG quality, 1-100
+	Compression string // PNG compression: default, none, fast or best
+	Colors      int    // GIF palette size, 1-256
+	Quantizer   string // GIF quantizer
+
+	// Passthrough returns the source image unchanged when no faces
+	// are found, if the output format is the same.
+	Passthrough *bool
+
+	// MaxDetectSize is the max width or height of the image that
+	// is scanned for faces. It can only lower the server's limit.
+	MaxDetectSize int
+}
+
+// values returns the query params of o.
+func (o *Options) values() url.Values {
+	v := url.Values{}
+	if o == nil {
+		return v
+	}
+	set := func(k, s string) {
+		if s != "" {
+			v.Set(k, s)
+		}
+	}
+	setInt := func(k string, n int) {
+		if n != 0 {
+			v.Set(k, strconv.Itoa(n))
+		}
+	}
+	set("overlay", o.Overlay)
+	set("format", o.Format)
+	setInt("quality", o.Quality)
+	set("compression", o.Compression)
+	setInt("colors", o.Colors)
+	set("quantizer", o.Quantizer)
+	if o.Passthrough != nil {
+		v.Set("passthrough", strconv.FormatBool(*o.Passthrough))
+	}
+	setInt("max_detect_size", o.MaxDetectSize)
+	return v
+}
+
+// Image is a defaced image.
+type Image struct {
+	Data        []byte
+	ContentType string
+	Faces       int  // number of faces defaced
+	Passthrough bool // Data is the source, no faces were found
+}
+
+// Detection has the faces found in an image, and its format and size.
+type Detection struct {
+	Format string `json:"format"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Faces  []Face `json:"faces"`
+}
+
+// Face is the bounding box of a face, in pixels.
+type Face struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// Error is an error response of the API. StatusCode mirrors the status
+// of the server: 400 for invalid options, 413 for images larger than
+// the server's limit, 415 for unknown image formats, 502 for upstream
+// failures and 503 when the upstream or the server is unavailable.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+// Error implements the error interface.
+func (e *Error) Error() string {
+	return fmt.Sprintf("defacer: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Temporary reports whether the request may succeed if retried.
+func (e *Error) Temporary() bool {
+	switch e.StatusCode {
+	case http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+		http.StatusTooManyRequests:
+		return true
+	}
+	return false
+}
+
+// DefaceURL returns the defaced image at imageURL, which is fetched by
+// the server.
+func (c *Client) DefaceURL(ctx context.Context, imageURL string, opts *Options) (*Image, error) {
+	v := opts.values()
+	v.Set("url", imageURL)
+	resp, body, err := c.do(ctx, "GET", "/v1/deface", v, nil)
+	if err != nil {
+		return nil, err
+	}
+	return defacedImage(resp, body)
+}
+
+// DefaceBytes returns the defaced image of img.
+func (c *Client) DefaceBytes(ctx context.Context, img []byte, opts *Options) (*Image, error) {
+	resp, body, err := c.do(ctx, "POST", "/v1/deface", opts.values(), img)
+	if err != nil {
+		return nil, err
+	}
+	return defacedImage(resp, body)
+}
+
+// DetectURL returns the faces of the image at imageURL, which is
+// fetched by the server. Only the detection options are used.
+func (c *Client) DetectURL(ctx context.Context, imageURL string, opts *Options) (*Detection, error) {
+	v := opts.values()
+	v.Set("url", imageURL)
+	_, body, err := c.do(ctx, "GET", "/v1/detect", v, nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeDetection(body)
+}
+
+// DetectBytes returns the faces of img. Only the detection options
+// are used.
+func (c *Client) DetectBytes(ctx context.Context, img []byte, opts *Options) (*Detection, error) {
+	_, body, err := c.do(ctx, "POST", "/v1/detect", opts.values(), img)
+	if err != nil {
+		return nil, err
+	}
+	return decodeDetection(body)
+}
+
+// defacedImage returns the image of a deface response. Responses
+// without a face count are not images, but upstream responses that
+// the server copied unchanged.
+func defacedImage(resp *http.Response, body []byte) (*Image, error) {
+	faces := resp.Header.Get("X-Defacer-Faces")
+	if faces == "" {
+		return nil, &Error{StatusCode: http.StatusBadGateway, Message: "Upstream is not an image"}
+	}
+	img := &Image{
+		Data:        body,
+		ContentType: resp.Header.Get("Content-Type"),
+		Passthrough: resp.Header.Get("X-Defacer-Passthrough") == "true",
+	}
+	var err error
+	if img.Faces, err = strconv.Atoi(faces); err != nil {
+		return nil, fmt.Errorf("defacer: invalid face count %q", faces)
+	}
+	return img, nil
+}
+
+func decodeDetection(body []byte) (*Detection, error) {
+	var d Detection
+	if err := json.Unmarshal(body, &d); err != nil {
+		return nil, fmt.Errorf("defacer: invalid detection: %v", err)
+	}
+	return &d, nil
+}
+
+// do sends a request to the API endpoint at path, and returns the
+// response with its body. Responses with error status are returned as
+// *Error, after retrying the ones that are 503.
+func (c *Client) do(ctx context.Context, method, path string, params url.Values, body []byte) (*http.Response, []byte, error) {
+	u := strings.TrimRight(c.BaseURL, "/") + path + "?" + params.Encode()
+	cli := c.HTTPClient
+	if cli == nil {
+		cli = http.DefaultClient
+	}
+	retries, delay := c.Retries, c.RetryDelay
+	if retries == 0 {
+		retries = DefaultRetries
+	}
+	if delay == 0 {
+		delay = DefaultRetryDelay
+	}
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, u, bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/octet-stream")
+		}
+		resp, err := cli.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, nil, err
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.StatusCode < 400 {
+			return resp, b, nil
+		}
+		if resp.StatusCode != http.StatusServiceUnavailable || attempt >= retries {
+			if len(b) > maxErrorBytes {
+				b = b[:maxErrorBytes]
+			}
+			return nil, nil, &Error{
+				StatusCode: resp.StatusCode,
+				Message:    strings.TrimSpace(string(b)),
+			}
+		}
+		wait := delay
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && time.Duration(s)*time.Second > wait {
+			wait = time.Duration(s) * time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
@@ -0,0 +1,159 @@
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestServer(h http.HandlerFunc) (*Client, *httptest.Server) {
+	srv := httptest.NewServer(h)
+	c := New(srv.URL + "/api/")
+	c.RetryDelay = time.Millisecond
+	return c, srv
+}
+
+func TestDefaceURL(t *testing.T) {
+	c, srv := newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.Method != "GET" || r.URL.Path != "/api/v1/deface" ||
+			q.Get("url") != "http://example.com/a.jpg" ||
+			q.Get("overlay") != "cat" || q.Get("format") != "png" ||
+			q.Get("quality") != "" || q.Get("passthrough") != "false" {
+			t.Error("unexpected request:", r.Method, r.URL)
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("X-Defacer-Faces", "2")
+		w.Write([]byte("png"))
+	})
+	defer srv.Close()
+	no := false
+	img, err := c.DefaceURL(context.Background(), "http://example.com/a.jpg", &Options{
+		Overlay:     "cat",
+		Format:      "png",
+		Passthrough: &no,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(img.Data) != "png" || img.ContentType != "image/png" || img.Faces != 2 || img.Passthrough {
+		t.Fatal("unexpected image:", img)
+	}
+}
+
+func TestDefaceURLNotImage(t *testing.T) {
+	c, srv := newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html></html>"))
+	})
+	defer srv.Close()
+	_, err := c.DefaceURL(context.Background(), "http://example.com/", nil)
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusBadGateway {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestDefaceBytes(t *testing.T) {
+	c, srv := newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		if r.Method != "POST" || string(b) != "source" || r.URL.Query().Get("max_detect_size") != "512" {
+			t.Error("unexpected request:", r.Method, r.URL, string(b))
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("X-Defacer-Faces", "0")
+		w.Header().Set("X-Defacer-Passthrough", "true")
+		w.Write(b)
+	})
+	defer srv.Close()
+	img, err := c.DefaceBytes(context.Background(), []byte("source"), &Options{MaxDetectSize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(img.Data) != "source" || img.Faces != 0 || !img.Passthrough {
+		t.Fatal("unexpected image:", img)
+	}
+}
+
+func TestDetect(t *testing.T) {
+	c, srv := newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/detect" {
+			t.Error("unexpected path:", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"format":"jpeg","width":640,"height":480,"faces":[{"x":1,"y":2,"width":30,"height":40}]}`))
+	})
+	defer srv.Close()
+	ctx := context.Background()
+	want := Face{X: 1, Y: 2, Width: 30, Height: 40}
+	for _, detect := range []func() (*Detection, error){
+		func() (*Detection, error) { return c.DetectURL(ctx, "http://example.com/a.jpg", nil) },
+		func() (*Detection, error) { return c.DetectBytes(ctx, []byte("source"), nil) },
+	} {
+		d, err := detect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Format != "jpeg" || d.Width != 640 || len(d.Faces) != 1 || d.Faces[0] != want {
+			t.Fatal("unexpected detection:", d)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var n int32
+	c, srv := newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&n, 1) < 3 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("X-Defacer-Faces", "0")
+	})
+	defer srv.Close()
+	if _, err := c.DefaceBytes(context.Background(), []byte("source"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatal("unexpected attempts:", n)
+	}
+	atomic.StoreInt32(&n, 0)
+	c.Retries = 1
+	_, err := c.DefaceBytes(context.Background(), []byte("source"), nil)
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusServiceUnavailable || e.Message != "busy" || !e.Temporary() {
+		t.Fatal("unexpected error:", err)
+	}
+	if n != 2 {
+		t.Fatal("unexpected attempts:", n)
+	}
+}
+
+func TestRetryContext(t *testing.T) {
+	c, srv := newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	})
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.DefaceBytes(ctx, []byte("source"), nil); err != context.DeadlineExceeded {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestError(t *testing.T) {
+	c, srv := newTestServer(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Invalid `quality` param: \"0\"", http.StatusBadRequest)
+	})
+	defer srv.Close()
+	_, err := c.DefaceBytes(context.Background(), []byte("source"), &Options{Quality: -1})
+	e, ok := err.(*Error)
+	if !ok || e.StatusCode != http.StatusBadRequest || e.Temporary() {
+		t.Fatal("unexpected error:", err)
+	}
+	if e.Error() != "defacer: 400 Bad Request: Invalid `quality` param: \"0\"" {
+		t.Fatal("unexpected message:", e.Error())
+	}
+}
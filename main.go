@@ -3,29 +3,135 @@ package main
 import (
 	"flag"
 	"log"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 
+	"google.golang.org/grpc"
+
 	"github.com/fiorix/defacer/apiserver"
 )
 
 func main() {
 	httpAddr := flag.String("http", ":8080", "[ip]:port to listen on for HTTP")
+	grpcAddr := flag.String("grpc", "", "[ip]:port to listen on for gRPC (empty to disable)")
+	grpcMaxMsgBytes := flag.Int("grpc-max-message-bytes", 32<<20, "max size of gRPC messages, including batches")
 	apiPrefix := flag.String("api-prefix", "/api", "prefix for API handlers")
 	timeout := flag.Duration("timeout", 60*time.Second, "timeout for downloading images")
 	nworkers := flag.Uint("workers", 50, "number of defacer workers")
 	defaceImage := flag.String("overlay-image", "", "overlay image for the defacer")
+	overlayDir := flag.String("overlay-dir", "", "directory of named overlay images")
+	overlay := flag.String("overlay", "", "default named overlay, or random or rotate")
+	cacheBytes := flag.Int64("cache-bytes", apiserver.DefaultImageCacheBytes, "max bytes of resized overlays to cache (-1 for no limit)")
+	cacheTTL := flag.Duration("cache-ttl", apiserver.DefaultImageCacheTTL, "evict resized overlays unused for this long (-1s to never evict)")
+	resizeFilter := flag.String("resize-filter", "bicubic", "overlay resize filter: nearest, bilinear, bicubic, mitchell, lanczos2 or lanczos3")
+	maxDetectSize := flag.Int("max-detect-size", 0, "downscale images larger than this width or height for face detection (0 for no limit)")
+	tileSize := flag.Int("tile-size", 0, "scan images larger than this in tiles for small faces (0 for no tiling)")
+	tileOverlap := flag.Int("tile-overlap", 0, "overlap between detection tiles (default tile-size/4)")
+	passthrough := flag.Bool("passthrough", false, "return upstream images without re-encoding when no faces are found")
+	maxImageBytes := flag.Int64("max-image-bytes", 0, "max size of upstream and uploaded images (0 for no upstream limit)")
+	jpegQuality := flag.Int("jpeg-quality", 75, "default JPEG quality, 1-100")
+	pngCompression := flag.String("png-compression", "default", "default PNG compression: default, none, fast or best")
+	gifColors := flag.Int("gif-colors", 256, "default GIF palette size, 1-256")
+	gifQuantizer := flag.String("gif-quantizer", "plan9", "default GIF quantizer: "+strings.Join(apiserver.GIFQuantizers(), ", "))
+	metadata := flag.String("metadata", "strip", "metadata policy for JPEG images: strip, sensitive or allowlist")
+	metadataKeep := flag.String("metadata-keep", "", "comma separated EXIF tags, xmp or iptc kept by the allowlist policy")
+	stripICC := flag.Bool("strip-icc", false, "remove ICC color profiles from JPEG images")
+	resultCacheBytes := flag.Int64("result-cache-bytes", 0, "max bytes of defaced images to cache in memory (0 to disable)")
+	resultCacheDir := flag.String("result-cache-dir", "", "directory to cache defaced images on disk (empty to disable)")
+	resultCacheDiskBytes := flag.Int64("result-cache-disk-bytes", apiserver.DefaultResultCacheDiskBytes, "max bytes of defaced images to cache on disk")
+	batchSize := flag.Int("batch-size", apiserver.DefaultBatchSize, "max number of URLs per batch")
+	batchConcurrency := flag.Int("batch-concurrency", apiserver.DefaultBatchConcurrency, "max images of a batch fetched at once")
+	jobDir := flag.String("job-dir", "", "directory to store asynchronous jobs (empty to disable)")
+	jobWorkers := flag.Int("job-workers", apiserver.DefaultJobWorkers, "number of jobs run at once")
+	jobTTL := flag.Duration("job-ttl", apiserver.DefaultJobTTL, "delete jobs done for this long")
+	jobSecret := flag.String("job-secret", "", "HMAC secret to sign job callbacks (empty to disable callbacks)")
+	keyFile := flag.String("key-file", "", "JSON file of API keys to require, reloaded on change (empty to disable)")
+	signingSecrets := flag.String("signing-secrets", "", "comma separated HMAC secrets of signed URLs, the first signs page images (empty to disable)")
+	requireSignature := flag.Bool("require-signature", false, "reject unsigned requests, and uploads, batches and jobs without API keys")
+	clientRate := flag.Float64("client-rate", 0, "max requests per second of each client (0 for no limit)")
+	clientBurst := flag.Int("client-burst", 0, "max burst of requests of each client (0 for the rate rounded up)")
+	clientConcurrency := flag.Int("client-concurrency", 0, "max requests, and pending jobs, at once of each client (0 for no limit)")
+	trustedProxies := flag.String("trusted-proxies", "", "comma separated IPs or CIDRs of proxies whose X-Forwarded-For is trusted")
+	upstream := flag.String("upstream", "", "origin URL to reverse proxy, defacing the images it serves")
 	flag.Parse()
+	pngLevel, err := apiserver.ParsePNGCompression(*pngCompression)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var secrets []string
+	if *signingSecrets != "" {
+		secrets = strings.Split(*signingSecrets, ",")
+	}
+	var trusted []string
+	if *trustedProxies != "" {
+		trusted = strings.Split(*trustedProxies, ",")
+	}
+	var keep []string
+	if *metadataKeep != "" {
+		keep = strings.Split(*metadataKeep, ",")
+	}
 	handler := &apiserver.Handler{
-		Prefix:    *apiPrefix,
-		Workers:   *nworkers,
-		ImageFile: *defaceImage,
-		Client:    &http.Client{Timeout: *timeout},
+		Prefix:        *apiPrefix,
+		Workers:       *nworkers,
+		ImageFile:     *defaceImage,
+		ImageDir:      *overlayDir,
+		Overlay:       *overlay,
+		Client:        &http.Client{Timeout: *timeout},
+		CacheBytes:    *cacheBytes,
+		CacheTTL:      *cacheTTL,
+		ResizeFilter:  *resizeFilter,
+		MaxDetectSize: *maxDetectSize,
+		TileSize:      *tileSize,
+		TileOverlap:   *tileOverlap,
+		Passthrough:   *passthrough,
+		MaxImageBytes: *maxImageBytes,
+		Encode: apiserver.EncodeOptions{
+			JPEGQuality:    *jpegQuality,
+			PNGCompression: pngLevel,
+			GIFColors:      *gifColors,
+			GIFQuantizer:   *gifQuantizer,
+		},
+		Metadata: apiserver.MetadataOptions{
+			Policy:   apiserver.MetadataPolicy(*metadata),
+			Keep:     keep,
+			StripICC: *stripICC,
+		},
+		ResultCacheBytes:     *resultCacheBytes,
+		ResultCacheDir:       *resultCacheDir,
+		ResultCacheDiskBytes: *resultCacheDiskBytes,
+		BatchSize:            *batchSize,
+		BatchConcurrency:     *batchConcurrency,
+		JobDir:               *jobDir,
+		JobWorkers:           *jobWorkers,
+		JobTTL:               *jobTTL,
+		JobSecret:            *jobSecret,
+		KeyFile:              *keyFile,
+		SigningSecrets:       secrets,
+		RequireSignature:     *requireSignature,
+		ClientRate:           *clientRate,
+		ClientBurst:          *clientBurst,
+		ClientConcurrency:    *clientConcurrency,
+		TrustedProxies:       trusted,
+		Upstream:             *upstream,
 	}
 	log.Println("Starting workers, please wait...")
 	if err := handler.Register(http.DefaultServeMux); err != nil {
 		log.Fatal(err)
 	}
+	if *grpcAddr != "" {
+		lis, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		gs, err := handler.NewGRPCServer(grpc.MaxMsgSize(*grpcMaxMsgBytes))
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Starting gRPC server on", *grpcAddr)
+		go func() { log.Fatal(gs.Serve(lis)) }()
+	}
 	srv := &http.Server{
 		Addr:         *httpAddr,
 		Handler:      http.DefaultServeMux,